@@ -15,37 +15,80 @@
 package client
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gookit/slog"
 
+	"github.com/gucooing/weiwei/pkg/auth"
+	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/ipfilter"
 	"github.com/gucooing/weiwei/pkg/msg"
 	"github.com/gucooing/weiwei/pkg/net"
 	"github.com/gucooing/weiwei/pkg/util/backoff"
 )
 
+const (
+	callTimeout = 10 * time.Second
+	// loginTimeout how long weis has to answer the login
+	loginTimeout = 10 * time.Second
+	// ipFileCheckInterval how often ip rule files are checked for changes
+	ipFileCheckInterval = 5 * time.Second
+)
+
 type Control struct {
+	// svr owner service
+	svr *Service
 	// conn and weic network conn
 	conn net.Conn
-	// runId
-	runId int64
-	// seed
-	seed int64
+	// runId session id
+	runId string
+	// sessionKey keys the control crypt and work conn auth
+	sessionKey string
+	// workVerifier signs work conn logins with the session key
+	workVerifier auth.Verifier
+	// caps features shared with weis
+	caps msg.Capability
 	// dispatcher msg handler
 	dispatcher *msg.Dispatcher
 	// doneChan
 	doneChan chan struct{}
+	// proxies registered proxies by name
+	proxiesMu sync.Mutex
+	proxies   map[string]*v1.Proxy
+	// reconnectDelay weis hint from a kick or going away, nanoseconds
+	reconnectDelay atomic.Int64
+	// kickCode set when weis kicked the control
+	kickCode atomic.Uint32
+	// rtt last ping round trip, nanoseconds
+	rtt atomic.Int64
+	// resumedProxies still registered on weis from the resumed session
+	resumedProxies []string
 }
 
-func NewControl(conn net.Conn) (*Control, error) {
+func NewControl(svr *Service, conn net.Conn) (*Control, error) {
 	c := &Control{
-		conn:       conn,
-		dispatcher: msg.NewDispatcher(conn),
-		doneChan:   make(chan struct{}),
+		svr:  svr,
+		conn: conn,
+		dispatcher: msg.NewDispatcherWithOptions(conn, &msg.DispatcherOptions{
+			QueueSize:   config.Client.Dispatcher.QueueSize,
+			QueuePolicy: msg.QueuePolicy(config.Client.Dispatcher.QueuePolicy),
+		}),
+		doneChan: make(chan struct{}),
+		proxies:  make(map[string]*v1.Proxy),
 	}
 	// dispatcher
 	c.dispatcher.RegisterMsg(&msg.SCPingRsp{}, c.handlerPing)
+	c.dispatcher.RegisterMsg(&msg.SCNewProxyRsp{}, c.handlerNewProxy)
+	c.dispatcher.RegisterMsg(&msg.SCKickNotify{}, c.handlerKick)
+	c.dispatcher.RegisterMsg(&msg.SCGoingAwayNotify{}, c.handlerGoingAway)
+	c.dispatcher.RegisterMsg(&msg.SCAddWorkConnReq{}, c.handlerAddWorkConn)
+	c.dispatcher.SetUnknownHandler(c.handlerUnknown)
 	slog.Infof("new weis control")
 	return c, nil
 }
@@ -53,11 +96,52 @@ func NewControl(conn net.Conn) (*Control, error) {
 func (c *Control) Run() {
 	go c.keepController()
 	go c.dispatcher.Start()
+	resumed := make(map[string]struct{}, len(c.resumedProxies))
+	for _, name := range c.resumedProxies {
+		resumed[name] = struct{}{}
+	}
+	for _, p := range config.Client.Proxies {
+		if _, ok := resumed[p.Name]; ok {
+			delete(resumed, p.Name)
+			c.proxiesMu.Lock()
+			c.proxies[p.Name] = p
+			c.proxiesMu.Unlock()
+			slog.Infof("proxy:%s resumed", p.Name)
+			continue
+		}
+		if err := c.AddProxy(p); err != nil {
+			slog.Errorf("proxy:%s start err:%v", p.Name, err)
+		}
+	}
+	// no longer configured
+	for name := range resumed {
+		if err := c.CloseProxy(name); err != nil {
+			slog.Errorf("proxy:%s close err:%v", name, err)
+		}
+	}
 
 	<-c.dispatcher.DoneChan()
+	c.svr.metrics.connected.Set(0)
 	close(c.doneChan)
 	c.conn.Close()
-	slog.Infof("weis control done")
+	slog.Infof("weis control done: %v", c.dispatcher.Err())
+}
+
+// Logout tells weis this weic is leaving and closes the control
+func (c *Control) Logout(reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	return c.dispatcher.SendAndClose(ctx, &msg.CSLogoutReq{Reason: reason}, errors.New("logout"))
+}
+
+// ReconnectDelay how long weis asked to wait before logging in again
+func (c *Control) ReconnectDelay() time.Duration {
+	return time.Duration(c.reconnectDelay.Load())
+}
+
+// Kicked kick code, KickUnknown when weis did not kick the control
+func (c *Control) Kicked() msg.KickCode {
+	return msg.KickCode(c.kickCode.Load())
 }
 
 func (c *Control) keepController() {
@@ -76,6 +160,91 @@ func (c *Control) keepController() {
 	)
 }
 
-func (c *Control) AddProxy() {
+func (c *Control) AddProxy(p *v1.Proxy) error {
+	if typ, ok := msg.CapabilityByName(string(p.Type)); ok && !c.caps.Has(typ) {
+		return fmt.Errorf("weis does not support proxy type %s", p.Type)
+	}
+	allow, deny, err := loadProxyIPs(p)
+	if err != nil {
+		return fmt.Errorf("proxy:%s %w", p.Name, err)
+	}
+	c.proxiesMu.Lock()
+	c.proxies[p.Name] = p
+	c.proxiesMu.Unlock()
+
+	req := &msg.CSNewProxyReq{
+		ProxyName:     p.Name,
+		ProxyType:     string(p.Type),
+		RemotePort:    p.RemotePort,
+		CustomDomains: p.CustomDomains,
+		AllowIPs:      allow,
+		DenyIPs:       deny,
+	}
+	if p.BandwidthLimitMode == v1.BandwidthLimitModeServer {
+		req.BandwidthLimit, _ = p.BandwidthLimit.Bytes()
+	}
+	if p.Quota != nil {
+		req.QuotaLimit, _ = p.Quota.Limit.Bytes()
+		req.QuotaPeriod = string(p.Quota.Period)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	rawMsg, err := c.dispatcher.Call(ctx, req)
+	if errors.Is(err, msg.ErrEnvelopeUnsupported) {
+		// answered through handlerNewProxy
+		return c.dispatcher.Send(req)
+	}
+	if err != nil {
+		c.proxiesMu.Lock()
+		delete(c.proxies, p.Name)
+		c.proxiesMu.Unlock()
+		return err
+	}
+	rsp, ok := rawMsg.(*msg.SCNewProxyRsp)
+	if !ok {
+		return errors.New("newProxy unexpected response")
+	}
+	return c.newProxyResult(rsp)
+}
+
+// UpdateProxyIPs sends the reloaded ip rules of a registered proxy
+func (c *Control) UpdateProxyIPs(p *v1.Proxy) error {
+	c.proxiesMu.Lock()
+	_, ok := c.proxies[p.Name]
+	c.proxiesMu.Unlock()
+	if !ok {
+		return nil
+	}
+	if !c.caps.Has(msg.CapUpdateProxyIPs) {
+		return errors.New("weis does not support updating ip rules, they apply from the next login")
+	}
+	allow, deny, err := loadProxyIPs(p)
+	if err != nil {
+		return err
+	}
+	return c.dispatcher.Send(&msg.CSUpdateProxyIPsReq{
+		ProxyName: p.Name,
+		AllowIPs:  allow,
+		DenyIPs:   deny,
+	})
+}
+
+func loadProxyIPs(p *v1.Proxy) (allow, deny []string, err error) {
+	if allow, err = ipfilter.Load(p.AllowIPs, p.AllowIPsFile); err != nil {
+		return nil, nil, err
+	}
+	if deny, err = ipfilter.Load(p.DenyIPs, p.DenyIPsFile); err != nil {
+		return nil, nil, err
+	}
+	return allow, deny, nil
+}
+
+func (c *Control) CloseProxy(name string) error {
+	c.proxiesMu.Lock()
+	delete(c.proxies, name)
+	c.proxiesMu.Unlock()
 
+	return c.dispatcher.Send(&msg.CSCloseProxyReq{
+		ProxyName: name,
+	})
 }
@@ -15,6 +15,7 @@
 package client
 
 import (
+	"errors"
 	"time"
 
 	"github.com/gookit/slog"
@@ -23,8 +24,9 @@ import (
 )
 
 func (c *Control) sendPingReq() error {
-	_, err := msg.WriteMsg(c.conn, &msg.CSPingReq{
+	err := c.dispatcher.Send(&msg.CSPingReq{
 		ClientTimestamp: time.Now().UnixNano(),
+		Rtt:             c.rtt.Load(),
 	})
 	if err != nil {
 		return err
@@ -37,6 +39,47 @@ func (c *Control) handlerPing(rawMsg msg.Message) {
 
 	clientTime := time.Unix(0, rsp.ClientTimestamp)
 	serverTime := time.Unix(0, rsp.ServerTimestamp)
+	rtt := time.Since(clientTime)
+	c.rtt.Store(int64(rtt))
+	c.svr.metrics.pingRtt.Observe(rtt.Seconds())
 
-	slog.Tracef("weis ping:%s", serverTime.Sub(clientTime).String())
+	slog.Tracef("weis ping:%s rtt:%s", serverTime.Sub(clientTime).String(), rtt.String())
+}
+
+func (c *Control) handlerNewProxy(rawMsg msg.Message) {
+	rsp := rawMsg.(*msg.SCNewProxyRsp)
+
+	if err := c.newProxyResult(rsp); err != nil {
+		slog.Errorf("proxy:%s start err:%v", rsp.ProxyName, err)
+	}
+}
+
+func (c *Control) newProxyResult(rsp *msg.SCNewProxyRsp) error {
+	if rsp.Error != "" {
+		c.proxiesMu.Lock()
+		delete(c.proxies, rsp.ProxyName)
+		c.proxiesMu.Unlock()
+		return errors.New(rsp.Error)
+	}
+	slog.Infof("proxy:%s start success remotePort:%v", rsp.ProxyName, rsp.RemotePort)
+	return nil
+}
+
+func (c *Control) handlerKick(rawMsg msg.Message) {
+	notify := rawMsg.(*msg.SCKickNotify)
+
+	slog.Warnf("weis kicked weic, %s: %s", notify.Code, notify.Reason)
+	c.reconnectDelay.Store(int64(time.Duration(notify.ReconnectDelay) * time.Second))
+	c.kickCode.Store(uint32(notify.Code))
+}
+
+func (c *Control) handlerGoingAway(rawMsg msg.Message) {
+	notify := rawMsg.(*msg.SCGoingAwayNotify)
+
+	slog.Warnf("weis going away: %s, reconnect in %ds", notify.Reason, notify.ReconnectDelay)
+	c.reconnectDelay.Store(int64(time.Duration(notify.ReconnectDelay) * time.Second))
+}
+
+func (c *Control) handlerUnknown(rawMsg msg.Message) {
+	slog.Warnf("weis unknown msg:%T", rawMsg)
 }
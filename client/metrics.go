@@ -0,0 +1,171 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/metrics"
+	"github.com/gucooing/weiwei/pkg/msg"
+)
+
+// Metric names are stable, dashboards and alerts depend on them:
+//
+//	weic_connected                        gauge     1 while the control is logged in
+//	weic_logins_total{result}             counter   logins, result success or failure
+//	weic_work_conns_total{result}         counter   work conns opened for weis, result ok or error
+//	weic_proxy_bytes_total{proxy,direction} counter bytes from weis users (in) and to them (out)
+//	weic_proxy_conns{proxy}               gauge     local service conns open now
+//	weic_proxy_conns_total{proxy}         counter   local service conns opened
+//	weic_dispatcher_queue_depth           gauge     control messages queued for sending
+//	weic_ping_rtt_seconds                 histogram ping round trip to weis
+
+const (
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+type clientMetrics struct {
+	registry   *metrics.Registry
+	connected  *metrics.Gauge
+	logins     *metrics.CounterVec
+	workConns  *metrics.CounterVec
+	pingRtt    *metrics.Histogram
+	dispatcher atomic.Pointer[msg.Dispatcher]
+	// proxies counters by proxy name, kept across logins
+	proxiesMu sync.Mutex
+	proxies   map[string]*proxyStats
+}
+
+type proxyStats struct {
+	conns      atomic.Int64
+	totalConns atomic.Int64
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+}
+
+func newClientMetrics() *clientMetrics {
+	r := metrics.NewRegistry()
+	m := &clientMetrics{
+		registry: r,
+		connected: r.NewGauge("weic_connected",
+			"1 while the control is logged in."),
+		logins: r.NewCounterVec("weic_logins_total",
+			"Logins by result.", "result"),
+		workConns: r.NewCounterVec("weic_work_conns_total",
+			"Work conns opened for weis by result.", "result"),
+		pingRtt: r.NewHistogram("weic_ping_rtt_seconds",
+			"Ping round trip to weis.", nil),
+		proxies: make(map[string]*proxyStats),
+	}
+	r.NewGaugeFunc("weic_dispatcher_queue_depth", "Control messages queued for sending.", func() float64 {
+		if d := m.dispatcher.Load(); d != nil {
+			return float64(d.Stats().QueueDepth)
+		}
+		return 0
+	})
+	r.NewFunc("weic_proxy_bytes_total", "Bytes from weis users (in) and to them (out).",
+		metrics.TypeCounter, []string{"proxy", "direction"},
+		func(emit func(float64, ...string)) {
+			m.eachProxy(func(name string, s *proxyStats) {
+				emit(float64(s.bytesIn.Load()), name, "in")
+				emit(float64(s.bytesOut.Load()), name, "out")
+			})
+		})
+	r.NewFunc("weic_proxy_conns", "Local service conns open now.",
+		metrics.TypeGauge, []string{"proxy"},
+		func(emit func(float64, ...string)) {
+			m.eachProxy(func(name string, s *proxyStats) {
+				emit(float64(s.conns.Load()), name)
+			})
+		})
+	r.NewFunc("weic_proxy_conns_total", "Local service conns opened.",
+		metrics.TypeCounter, []string{"proxy"},
+		func(emit func(float64, ...string)) {
+			m.eachProxy(func(name string, s *proxyStats) {
+				emit(float64(s.totalConns.Load()), name)
+			})
+		})
+	return m
+}
+
+func (m *clientMetrics) proxy(name string) *proxyStats {
+	m.proxiesMu.Lock()
+	defer m.proxiesMu.Unlock()
+	s, ok := m.proxies[name]
+	if !ok {
+		s = new(proxyStats)
+		m.proxies[name] = s
+	}
+	return s
+}
+
+func (m *clientMetrics) eachProxy(fn func(name string, s *proxyStats)) {
+	m.proxiesMu.Lock()
+	names := make([]string, 0, len(m.proxies))
+	for name := range m.proxies {
+		names = append(names, name)
+	}
+	m.proxiesMu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		fn(name, m.proxy(name))
+	}
+}
+
+func (m *clientMetrics) login(err error) {
+	if err != nil {
+		m.logins.WithLabelValues("failure").Inc()
+		return
+	}
+	m.logins.WithLabelValues("success").Inc()
+}
+
+// metricsServer serves /metrics on MetricsAddr
+type metricsServer struct {
+	http *http.Server
+}
+
+func newMetricsServer(addr string, m *clientMetrics) *metricsServer {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m.registry.Handler())
+	return &metricsServer{
+		http: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+func (s *metricsServer) Run() {
+	slog.Infof("metrics listen %s", s.http.Addr)
+	if err := s.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Errorf("metrics server err:%v", err)
+	}
+}
+
+func (s *metricsServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	return s.http.Shutdown(ctx)
+}
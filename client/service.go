@@ -18,17 +18,26 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gookit/slog"
 
 	"github.com/gucooing/weiwei/pkg/auth"
 	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/enroll"
 	"github.com/gucooing/weiwei/pkg/env"
+	"github.com/gucooing/weiwei/pkg/ipfilter"
 	"github.com/gucooing/weiwei/pkg/msg"
 	"github.com/gucooing/weiwei/pkg/net"
+	"github.com/gucooing/weiwei/pkg/util"
 	"github.com/gucooing/weiwei/pkg/util/backoff"
+	"github.com/gucooing/weiwei/pkg/util/compress"
 	"github.com/gucooing/weiwei/pkg/util/crypt"
+	"github.com/gucooing/weiwei/pkg/util/limit"
 )
 
 type Service struct {
@@ -36,20 +45,77 @@ type Service struct {
 	ctx context.Context
 	// cancel
 	cancel context.CancelFunc
-	// control
-	control *Control
+	// control of the current login, replaced on every login again
+	control atomic.Pointer[Control]
 	// weicLoginVerifier weic login auth
 	weicLoginVerifier auth.Verifier
 	// weicLoginCrypt weic login crypt
 	weicLoginCrypt crypt.Crypt
+	// state local state
+	state *State
+	// enrollTokenId and enrollKey set until the enrollment succeeds
+	enrollTokenId string
+	enrollKey     string
+	// instanceId stable weic identity
+	instanceId string
+	// resumeToken from the last login, resumes that session
+	resumeToken string
+	// metrics prometheus metrics
+	metrics *clientMetrics
+	// metricsServer serves metrics, nil when MetricsAddr is empty
+	metricsServer *metricsServer
+	// limiters client mode bandwidth limits by proxy name, read only after NewService
+	limiters map[string]*proxyLimiters
+}
+
+// proxyLimiters bytes from and to users of one proxy
+type proxyLimiters struct {
+	in  *limit.Limiter
+	out *limit.Limiter
 }
 
 func NewService() (*Service, error) {
 	slog.Debugf("new client service...")
 	s := &Service{}
 
+	slog.Debugf("load state file:%s...", config.Client.StateFile)
+	state, err := LoadState(config.Client.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	s.state = state
+
+	s.instanceId = config.Client.InstanceId
+	if s.instanceId == "" {
+		if state.InstanceId == "" {
+			state.InstanceId = util.NewNonce(16)
+			if err := state.Save(config.Client.StateFile); err != nil {
+				return nil, err
+			}
+		}
+		s.instanceId = state.InstanceId
+	}
+	slog.Debugf("instanceId:%s", s.instanceId)
+
 	slog.Debugf("new weicLoginVerifier...")
-	wlv, err := auth.NewVerifier(config.Client.Auth.Method, config.Client.Auth.Token)
+	var wlv auth.Verifier
+	switch {
+	case state.ClientId != "":
+		if config.Client.EnrollToken != "" {
+			slog.Warnf("clientId:%s already enrolled, enroll token ignored", state.ClientId)
+		}
+		wlv, err = auth.NewHmac(state.ClientSecret)
+	case config.Client.EnrollToken != "":
+		var secret string
+		s.enrollTokenId, secret, err = enroll.SplitToken(config.Client.EnrollToken)
+		if err != nil {
+			return nil, err
+		}
+		s.enrollKey = enroll.HashSecret(secret)
+		wlv, err = auth.NewHmac(s.enrollKey)
+	default:
+		wlv, err = auth.NewClientVerifier(config.Client.Auth)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +130,22 @@ func NewService() (*Service, error) {
 	slog.Debugf("weicLoginCrypt xor key hex:%s", hex.EncodeToString(cry.XorKey))
 	s.weicLoginCrypt = cry
 
+	s.limiters = make(map[string]*proxyLimiters)
+	for _, p := range config.Client.Proxies {
+		bps, _ := p.BandwidthLimit.Bytes()
+		if bps > 0 && p.BandwidthLimitMode == v1.BandwidthLimitModeClient {
+			s.limiters[p.Name] = &proxyLimiters{
+				in:  limit.NewLimiter(bps),
+				out: limit.NewLimiter(bps),
+			}
+		}
+	}
+
+	s.metrics = newClientMetrics()
+	if config.Client.MetricsAddr != "" {
+		s.metricsServer = newMetricsServer(config.Client.MetricsAddr, s.metrics)
+	}
+
 	slog.Debugf("new client service success")
 	return s, nil
 }
@@ -74,12 +156,16 @@ func (svr *Service) Run(ctx context.Context) error {
 	svr.ctx = ctx
 	svr.cancel = cancel
 
+	if svr.metricsServer != nil {
+		go svr.metricsServer.Run()
+	}
 	// login weis
-	svr.cycleLoginWeis()
-	if svr.control == nil {
+	svr.cycleLoginWeis(0)
+	if svr.control.Load() == nil {
 		return errors.New("weic login weis error")
 	}
 	go svr.keepController()
+	go svr.ipFilesLoop()
 
 	<-svr.ctx.Done()
 	// service context
@@ -90,14 +176,35 @@ func (svr *Service) Run(ctx context.Context) error {
 
 func (svr *Service) Close() {
 	slog.Debugf("client service close...")
+	if ctl := svr.control.Load(); ctl != nil {
+		if err := ctl.Logout("weic shutdown"); err != nil {
+			slog.Debugf("logout err:%v", err)
+		}
+	}
+	if svr.metricsServer != nil {
+		svr.metricsServer.Close()
+	}
 
 	slog.Debugf("client service close success")
 }
 
-func (svr *Service) cycleLoginWeis() {
+// cycleLoginWeis logs in until it succeeds, after the weis reconnect hint
+func (svr *Service) cycleLoginWeis(delay time.Duration) {
+	if delay > 0 {
+		slog.Infof("login weis again in %s", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-svr.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
 	err := backoff.BackoffStart(
 		func() error {
-			if err := svr.loginWeis(); err != nil {
+			err := svr.loginWeis()
+			svr.metrics.login(err)
+			if err != nil {
 				slog.Debugf("login weis err: %v", err)
 				return err
 			}
@@ -115,24 +222,49 @@ func (svr *Service) cycleLoginWeis() {
 	}
 }
 
-func (svr *Service) loginWeis() error {
+func (svr *Service) loginWeis() (err error) {
 	slog.Debugf("new weisConn...")
 	conn, err := net.Dial(config.Client.ServerNetwork, config.Client.ServerAddr)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
 	conn.SetCrypt(svr.weicLoginCrypt)
 	slog.Debugf("network:%s address:%s new weisConn success", config.Client.ServerNetwork, config.Client.ServerAddr)
 
 	// login
+	if r, ok := svr.weicLoginVerifier.(auth.Refresher); ok {
+		if err := r.Refresh(svr.ctx); err != nil {
+			return err
+		}
+	}
 	timestamp := time.Now().UnixNano()
+	nonce := util.NewNonce(16)
 	loginReq := &msg.CSLoginReq{
 		Version:   env.Version,
 		Timestamp: timestamp,
-		LoginKey:  svr.weicLoginVerifier.SetVerifyLogin(timestamp),
+		LoginKey:  svr.weicLoginVerifier.SetVerifyLogin(timestamp, "", nonce),
+		Nonce:     nonce,
+		User:      config.Client.Auth.User,
+		ClientId:  svr.state.ClientId,
+
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    localCapabilities(),
+		Compress:        config.Client.Compress,
+		InstanceId:      svr.instanceId,
+		ResumeToken:     svr.resumeToken,
+	}
+	if svr.enrollTokenId != "" {
+		loginReq.EnrollToken = svr.enrollTokenId
 	}
 
-	slog.Debugf("token:%s start login...", loginReq.LoginKey)
+	slog.Debugf("auth:%s user:%s start login...", config.Client.Auth.Method, config.Client.Auth.User)
+	// a weis that never answers must not hold up the reconnect loop
+	conn.SetDeadline(time.Now().Add(loginTimeout))
 	_, err = msg.WriteMsg(conn, loginReq)
 	if err != nil {
 		return err
@@ -141,38 +273,159 @@ func (svr *Service) loginWeis() error {
 	if err != nil {
 		return err
 	}
+	if notify, ok := rawMsg.(*msg.SCKickNotify); ok {
+		return fmt.Errorf("weis kicked login: %s: %s", notify.Code, notify.Reason)
+	}
 	loginRsp, ok := rawMsg.(*msg.SCLoginRsp)
 	if !ok {
 		return errors.New("login weis read msg no loginRsp")
 	}
-	cry, err := crypt.NewCrypt(crypt.CryptTypeXor, loginRsp.Seed)
+	if loginRsp.Error != "" {
+		return errors.New("weis refused login: " + loginRsp.Error)
+	}
+	version := msg.NegotiateVersion(loginRsp.ProtocolVersion)
+	if version == 0 {
+		return fmt.Errorf("weis protocol %d not supported", loginRsp.ProtocolVersion)
+	}
+	if svr.enrollTokenId != "" {
+		if err := svr.saveEnrollment(loginRsp, nonce); err != nil {
+			return err
+		}
+	}
+	// a weis without the capability keys the session with a seed
+	seedSession := !loginRsp.Capabilities.Has(msg.CapSessionKey)
+	var cry crypt.Crypt
+	var workVerifier auth.Verifier
+	if seedSession {
+		if loginRsp.RunId == "" || loginRsp.Seed == 0 {
+			return errors.New("weis sent no session")
+		}
+		cry, err = crypt.NewCrypt(crypt.CryptTypeXor, loginRsp.Seed)
+		if err == nil && version == msg.LegacyProtocolVersion {
+			workVerifier, err = auth.NewToken(strconv.FormatInt(loginRsp.Seed, 10))
+		} else if err == nil {
+			workVerifier, err = auth.NewHmacV2(strconv.FormatInt(loginRsp.Seed, 10))
+		}
+	} else {
+		if len(loginRsp.RunId) != 32 || len(loginRsp.SessionKey) != 32 {
+			return errors.New("weis sent no session")
+		}
+		cry, err = crypt.NewCrypt(crypt.CryptTypeXor, []byte(loginRsp.SessionKey))
+		if err == nil {
+			workVerifier, err = auth.NewHmac(loginRsp.SessionKey)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetCrypt(cry)
+	cmp, err := compress.NewCompress(compress.CompressType(util.EmptyDefault(loginRsp.Compress, "none")))
 	if err != nil {
 		return err
 	}
-	defer conn.SetCrypt(cry)
+	conn.SetCompress(cmp)
 
-	ctl, err := NewControl(conn)
+	conn.SetDeadline(time.Time{})
+	ctl, err := NewControl(svr, conn)
 	if err != nil {
 		return err
 	}
-	slog.Debugf("loginRsp version:%s runId:%v seed:%v",
-		loginRsp.Version, loginRsp.RunId, loginRsp.Seed)
+	codec, ok := msg.GetCodec(util.EmptyDefault(loginRsp.Codec, msg.CodecJson))
+	if !ok {
+		return errors.New("weis chose unknown codec: " + loginRsp.Codec)
+	}
+	ctl.dispatcher.SetCodec(codec)
+	ctl.dispatcher.SetEnvelope(loginRsp.Capabilities.Has(msg.CapEnvelope))
+	slog.Debugf("loginRsp version:%s protocol:%d runId:%v codec:%s compress:%s caps:%v",
+		loginRsp.Version, loginRsp.ProtocolVersion, loginRsp.RunId,
+		codec.Name(), util.EmptyDefault(loginRsp.Compress, "none"), loginRsp.Capabilities.Names())
 
-	ctl.runId = loginRsp.RunId
-	ctl.seed = loginRsp.Seed
-	svr.control = ctl
+	ctl.runId = string(loginRsp.RunId)
+	ctl.sessionKey = loginRsp.SessionKey
+	ctl.workVerifier = workVerifier
+	ctl.caps = loginRsp.Capabilities
+	ctl.resumedProxies = loginRsp.ResumedProxies
+	svr.resumeToken = loginRsp.ResumeToken
+	svr.control.Store(ctl)
+	svr.metrics.dispatcher.Store(ctl.dispatcher)
+	svr.metrics.connected.Set(1)
 
 	go ctl.Run()
 	return nil
 }
 
+// localCapabilities features weic asks for, binary only when preferred
+func localCapabilities() msg.Capability {
+	caps := msg.LocalCapabilities
+	if config.Client.Codec != msg.CodecBinary {
+		caps &^= msg.CapCodecBinary
+	}
+	return caps
+}
+
+// saveEnrollment persists the issued credential and logs in with it from now on
+func (svr *Service) saveEnrollment(loginRsp *msg.SCLoginRsp, nonce string) error {
+	if loginRsp.ClientId == "" {
+		return errors.New("weis issued no credential")
+	}
+	secret, err := enroll.SealSecret(svr.enrollKey, nonce, loginRsp.ClientSecret)
+	if err != nil {
+		return err
+	}
+	verifier, err := auth.NewHmac(secret)
+	if err != nil {
+		return err
+	}
+	svr.state.ClientId = loginRsp.ClientId
+	svr.state.ClientSecret = secret
+	if err := svr.state.Save(config.Client.StateFile); err != nil {
+		return err
+	}
+	svr.weicLoginVerifier = verifier
+	svr.enrollTokenId = ""
+	svr.enrollKey = ""
+	slog.Infof("enrolled clientId:%s state saved to %s", loginRsp.ClientId, config.Client.StateFile)
+	return nil
+}
+
+// ipFilesLoop sends the ip rules of proxies again when their files change
+func (svr *Service) ipFilesLoop() {
+	files := make([]string, 0)
+	for _, p := range config.Client.Proxies {
+		for _, file := range []string{p.AllowIPsFile, p.DenyIPsFile} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
+	}
+	ipfilter.Watch(svr.ctx, ipFileCheckInterval, files, func() {
+		ctl := svr.control.Load()
+		for _, p := range config.Client.Proxies {
+			if p.AllowIPsFile == "" && p.DenyIPsFile == "" {
+				continue
+			}
+			if err := ctl.UpdateProxyIPs(p); err != nil {
+				slog.Warnf("proxy:%s reload ip rules err:%v", p.Name, err)
+				continue
+			}
+			slog.Infof("proxy:%s ip rules reloaded", p.Name)
+		}
+	})
+}
+
 func (svr *Service) keepController() {
 	for {
+		ctl := svr.control.Load()
 		select {
 		case <-svr.ctx.Done():
 			return
-		case <-svr.control.doneChan:
-			svr.cycleLoginWeis()
+		case <-ctl.doneChan:
+			if code := ctl.Kicked(); code.Fatal() {
+				slog.Errorf("weis kicked weic: %s, not logging in again", code)
+				svr.cancel()
+				return
+			}
+			svr.cycleLoginWeis(ctl.ReconnectDelay())
 		}
 	}
 }
@@ -0,0 +1,63 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// State weic local state persisted across restarts
+type State struct {
+	// ClientId and ClientSecret credential issued on enrollment
+	ClientId     string `json:"clientId,omitempty"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// InstanceId generated weic identity, used when none is configured
+	InstanceId string `json:"instanceId,omitempty"`
+}
+
+func LoadState(path string) (*State, error) {
+	s := new(State)
+	buff, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buff, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *State) Save(path string) error {
+	buff, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buff, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,128 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	gonet "net"
+	"strconv"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/msg"
+	"github.com/gucooing/weiwei/pkg/net"
+	"github.com/gucooing/weiwei/pkg/proxyproto"
+	"github.com/gucooing/weiwei/pkg/util"
+	"github.com/gucooing/weiwei/pkg/util/limit"
+)
+
+const (
+	localDialTimeout = 5 * time.Second
+)
+
+func (c *Control) handlerAddWorkConn(rawMsg msg.Message) {
+	go c.newWorkConn()
+}
+
+// newWorkConn opens a work conn and waits on it until weis hands it a user conn
+func (c *Control) newWorkConn() {
+	conn, err := net.Dial(config.Client.ServerNetwork, config.Client.ServerAddr)
+	if err != nil {
+		c.svr.metrics.workConns.WithLabelValues("error").Inc()
+		slog.Warnf("new work conn err:%v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetCrypt(c.svr.weicLoginCrypt)
+
+	timestamp := time.Now().UnixNano()
+	nonce := util.NewNonce(16)
+	if _, err := msg.WriteMsg(conn, &msg.CSAddWorkConnRsp{
+		RunId:     msg.SessionId(c.runId),
+		Timestamp: timestamp,
+		LoginKey:  c.workVerifier.SetVerifyLogin(timestamp, c.runId, nonce),
+		Nonce:     nonce,
+	}); err != nil {
+		c.svr.metrics.workConns.WithLabelValues("error").Inc()
+		slog.Warnf("work conn login err:%v", err)
+		return
+	}
+	c.svr.metrics.workConns.WithLabelValues("ok").Inc()
+
+	rawMsg, err := msg.ReadMsg(conn)
+	if err != nil {
+		slog.Debugf("work conn closed before use: %v", err)
+		return
+	}
+	start, ok := rawMsg.(*msg.SCStartWorkConn)
+	if !ok {
+		slog.Warnf("work conn unexpected msg:%T", rawMsg)
+		return
+	}
+	c.handleWorkConn(conn, start)
+}
+
+// handleWorkConn joins the work conn with the proxy local service
+func (c *Control) handleWorkConn(conn net.Conn, start *msg.SCStartWorkConn) {
+	c.proxiesMu.Lock()
+	p, ok := c.proxies[start.ProxyName]
+	c.proxiesMu.Unlock()
+	if !ok {
+		slog.Warnf("work conn for unknown proxy:%s", start.ProxyName)
+		return
+	}
+
+	addr := gonet.JoinHostPort(p.LocalIP, strconv.Itoa(p.LocalPort))
+	local, err := gonet.DialTimeout("tcp", addr, localDialTimeout)
+	if err != nil {
+		slog.Warnf("proxy:%s dial local %s err:%v", p.Name, addr, err)
+		return
+	}
+	if err := writeProxyProtocol(local, p, start); err != nil {
+		local.Close()
+		slog.Warnf("proxy:%s proxy protocol err:%v", p.Name, err)
+		return
+	}
+	stats := c.svr.metrics.proxy(p.Name)
+	stats.conns.Add(1)
+	defer stats.conns.Add(-1)
+	stats.totalConns.Add(1)
+	// in is what users send, written to the local service
+	var stream gonet.Conn = net.NewStream(conn)
+	if l, ok := c.svr.limiters[p.Name]; ok {
+		// reading the work conn is what users send
+		stream = net.NewLimitConn(stream, []*limit.Limiter{l.in}, []*limit.Limiter{l.out})
+	}
+	in, out, err := net.Join(stream, net.NewTrafficConn(local, &stats.bytesOut, &stats.bytesIn))
+	slog.Debugf("proxy:%s user conn %s closed in:%d out:%d err:%v",
+		p.Name, start.SrcAddr, in, out, err)
+}
+
+// writeProxyProtocol sends the PROXY protocol header of the user conn first
+func writeProxyProtocol(local gonet.Conn, p *v1.Proxy, start *msg.SCStartWorkConn) error {
+	var header []byte
+	switch p.ProxyProtocolVersion {
+	case v1.ProxyProtocolV1:
+		header = proxyproto.HeaderV1(start.SrcAddr, start.DstAddr)
+	case v1.ProxyProtocolV2:
+		header = proxyproto.HeaderV2(start.SrcAddr, start.DstAddr)
+	default:
+		return nil
+	}
+	_, err := local.Write(header)
+	return err
+}
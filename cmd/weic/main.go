@@ -18,6 +18,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gookit/slog"
 	"github.com/spf13/cobra"
@@ -31,11 +33,13 @@ import (
 func init() {
 	weicCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "weic.json", "config file")
 	weicCmd.PersistentFlags().BoolVarP(&showVersion, "version", "v", false, "show version")
+	weicCmd.PersistentFlags().StringVar(&enrollToken, "enroll", "", "one-time enrollment token")
 }
 
 var (
 	cfgFile     string
 	showVersion bool
+	enrollToken string
 
 	weicCmd = &cobra.Command{
 		Use:                        env.WeiC,
@@ -88,6 +92,9 @@ func initWeic(cmd *cobra.Command, args []string) error {
 		fmt.Println(err)
 		return err
 	}
+	if enrollToken != "" {
+		config.Client.EnrollToken = enrollToken
+	}
 	// run
 	if err := runWeic(); err != nil {
 		fmt.Println(err)
@@ -114,7 +121,9 @@ func runWeic() error {
 	}
 	slog.Infof("%s is startup success", env.WeiC)
 
-	ctx := context.Background()
+	// SIGINT/SIGTERM start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	return svr.Run(ctx)
 }
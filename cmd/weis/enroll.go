@@ -0,0 +1,141 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	"github.com/gucooing/weiwei/pkg/enroll"
+)
+
+func init() {
+	enrollCreateCmd.Flags().StringVar(&enrollUser, "user", "", "user the enrolled weic logs in as")
+	enrollCreateCmd.Flags().DurationVar(&enrollTTL, "ttl", time.Hour, "token lifetime")
+
+	enrollCmd.AddCommand(enrollCreateCmd, enrollListCmd, enrollRevokeCmd)
+	weisCmd.AddCommand(enrollCmd)
+}
+
+var (
+	enrollUser string
+	enrollTTL  time.Duration
+
+	enrollCmd = &cobra.Command{
+		Use:   "enroll",
+		Short: "manage one-time enrollment tokens and weic credentials",
+	}
+	enrollCreateCmd = &cobra.Command{
+		Use:   "create",
+		Short: "mint a single-use enrollment token",
+		Args:  cobra.NoArgs,
+		RunE:  enrollCreate,
+	}
+	enrollListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "list enrollment tokens and enrolled weic",
+		Args:  cobra.NoArgs,
+		RunE:  enrollList,
+	}
+	enrollRevokeCmd = &cobra.Command{
+		Use:   "revoke <clientId>",
+		Short: "revoke the credential of an enrolled weic, a running weis kicks it",
+		Args:  cobra.ExactArgs(1),
+		RunE:  enrollRevoke,
+	}
+)
+
+func loadEnrollStore() (*enroll.Store, error) {
+	if err := config.LoadServerConfig(cfgFile); err != nil {
+		return nil, err
+	}
+	return enroll.NewStore(config.Server.EnrollFile()), nil
+}
+
+func enrollCreate(cmd *cobra.Command, args []string) error {
+	store, err := loadEnrollStore()
+	if err != nil {
+		return err
+	}
+	if enrollUser != "" {
+		found := false
+		for _, u := range config.Server.Auth.Users {
+			if u.Name == enrollUser {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("unknown user: " + enrollUser)
+		}
+	}
+	if enrollTTL <= 0 {
+		return errors.New("ttl must be positive")
+	}
+	token, t, err := store.Mint(enrollUser, enrollTTL)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	fmt.Fprintf(os.Stderr, "expires at %s, use: weic --enroll %s\n",
+		t.ExpiresAt.Format(time.RFC3339), token)
+	return nil
+}
+
+func enrollList(cmd *cobra.Command, args []string) error {
+	store, err := loadEnrollStore()
+	if err != nil {
+		return err
+	}
+	tokens, creds, err := store.List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOKEN\tUSER\tEXPIRES\tUSED BY")
+	for _, t := range tokens {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			t.Id, t.User, t.ExpiresAt.Format(time.RFC3339), t.ClientId)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CLIENT ID\tUSER\tENROLLED\tADDR\tREVOKED")
+	for _, c := range creds {
+		revoked := ""
+		if !c.RevokedAt.IsZero() {
+			revoked = c.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			c.ClientId, c.User, c.EnrolledAt.Format(time.RFC3339), c.RemoteAddr, revoked)
+	}
+	return w.Flush()
+}
+
+func enrollRevoke(cmd *cobra.Command, args []string) error {
+	store, err := loadEnrollStore()
+	if err != nil {
+		return err
+	}
+	if err := store.Revoke(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("clientId:%s revoked\n", args[0])
+	return nil
+}
@@ -18,6 +18,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gookit/slog"
 	"github.com/spf13/cobra"
@@ -122,7 +124,9 @@ func runWeis() error {
 	}
 	slog.Infof("%s is startup success", env.WeiS)
 
-	ctx := context.Background()
+	// SIGINT/SIGTERM start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	svr.Run(ctx)
 
 	return nil
@@ -0,0 +1,135 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	"github.com/gucooing/weiwei/pkg/traffic"
+)
+
+func init() {
+	trafficCmd.Flags().StringVar(&trafficPeriod, "period", "day", "rollup, hour or day")
+	trafficCmd.Flags().StringVar(&trafficFrom, "from", "", "first period, RFC 3339 or YYYY-MM-DD in UTC")
+	trafficCmd.Flags().StringVar(&trafficTo, "to", "", "end of the range, exclusive")
+	trafficCmd.Flags().StringVar(&trafficUser, "user", "", "only this user")
+	trafficCmd.Flags().StringVar(&trafficClient, "client", "", "only this client id")
+	trafficCmd.Flags().StringVar(&trafficProxy, "proxy", "", "only this proxy")
+	trafficCmd.Flags().StringVar(&trafficGroupBy, "group-by", "", "add up by user, client and/or proxy, comma separated")
+	trafficCmd.Flags().StringVar(&trafficFormat, "format", "table", "output, table csv or json")
+
+	weisCmd.AddCommand(trafficCmd)
+}
+
+var (
+	trafficPeriod  string
+	trafficFrom    string
+	trafficTo      string
+	trafficUser    string
+	trafficClient  string
+	trafficProxy   string
+	trafficGroupBy string
+	trafficFormat  string
+
+	trafficCmd = &cobra.Command{
+		Use:   "traffic",
+		Short: "show or export traffic per user, client and proxy",
+		Long: "show or export traffic per user, client and proxy from the data file,\n" +
+			"a running weis writes it every traffic.flushInterval seconds",
+		Args: cobra.NoArgs,
+		RunE: trafficShow,
+	}
+)
+
+func trafficShow(cmd *cobra.Command, args []string) error {
+	if err := config.LoadServerConfig(cfgFile); err != nil {
+		return err
+	}
+	q := &traffic.Query{
+		User:   trafficUser,
+		Client: trafficClient,
+		Proxy:  trafficProxy,
+	}
+	var err error
+	if q.Period, err = traffic.ParsePeriod(trafficPeriod); err != nil {
+		return err
+	}
+	if q.From, err = traffic.ParseTime(trafficFrom); err != nil {
+		return err
+	}
+	if q.To, err = traffic.ParseTime(trafficTo); err != nil {
+		return err
+	}
+	if q.GroupBy, err = traffic.ParseGroupBy(trafficGroupBy); err != nil {
+		return err
+	}
+
+	// retention is applied by weis, the cli only reads
+	store := traffic.NewStore(config.Server.TrafficFile(), 0, 0)
+	if err := store.Load(); err != nil {
+		return err
+	}
+	records := store.Query(q)
+
+	switch trafficFormat {
+	case "table":
+		return trafficTable(records)
+	case "csv":
+		return traffic.WriteCSV(os.Stdout, records)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+	return errors.New("unknown format: " + trafficFormat)
+}
+
+func trafficTable(records []*traffic.Record) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tUSER\tCLIENT\tPROXY\tIN\tOUT\tCONNS")
+	var total traffic.Usage
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n",
+			r.Start.Format(time.RFC3339), r.User, r.Client, r.Proxy,
+			formatBytes(r.BytesIn), formatBytes(r.BytesOut), r.Conns)
+		total.BytesIn += r.BytesIn
+		total.BytesOut += r.BytesOut
+		total.Conns += r.Conns
+	}
+	fmt.Fprintf(w, "TOTAL\t\t\t\t%s\t%s\t%d\n",
+		formatBytes(total.BytesIn), formatBytes(total.BytesOut), total.Conns)
+	return w.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -24,16 +24,36 @@ var (
 	ErrUnknownAuthMethod = errors.New("unknown auth method")
 )
 
+// Verifier signs and checks login keys. runId is empty for control logins
+// and nonce is a random value chosen by weic for every login.
 type Verifier interface {
-	SetVerifyLogin(timestamp int64) string
-	VerifyLogin(timestamp int64, loginKey string) error
+	SetVerifyLogin(timestamp int64, runId string, nonce string) string
+	VerifyLogin(timestamp int64, runId string, nonce string, loginKey string) error
 }
 
 func NewVerifier(method v1.AuthMethod, token string) (Verifier, error) {
 	switch method {
 	case v1.AuthMethodToken:
 		return NewToken(token)
+	case v1.AuthMethodHmac:
+		return NewHmac(token)
 	default:
 		return nil, ErrUnknownAuthMethod
 	}
 }
+
+// NewServerVerifier weis login verifier
+func NewServerVerifier(cfg *v1.AuthConfig) (Verifier, error) {
+	if cfg.Method == v1.AuthMethodOidc {
+		return NewOidcVerifier(cfg.Oidc)
+	}
+	return NewVerifier(cfg.Method, cfg.Token)
+}
+
+// NewClientVerifier weic login signer
+func NewClientVerifier(cfg *v1.AuthConfig) (Verifier, error) {
+	if cfg.Method == v1.AuthMethodOidc {
+		return NewOidcTokenSource(cfg.Oidc)
+	}
+	return NewVerifier(cfg.Method, cfg.Token)
+}
@@ -0,0 +1,162 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrInvalidAuthKey = errors.New("invalid auth key")
+	ErrLoginExpired   = errors.New("login key timestamp out of range")
+	ErrLoginReplayed  = errors.New("login key replayed")
+)
+
+// DefaultMaxSkew login key timestamps further from now are refused
+const DefaultMaxSkew = 5 * time.Minute
+
+var maxSkew atomic.Int64
+
+func init() {
+	maxSkew.Store(int64(DefaultMaxSkew))
+}
+
+// SetMaxSkew window around now a login key timestamp must be in, a nonce is
+// remembered twice as long
+func SetMaxSkew(d time.Duration) {
+	if d > 0 {
+		maxSkew.Store(int64(d))
+	}
+}
+
+type Hmac struct {
+	key []byte
+	// v2 runId is a decimal int64 signed as 8 bytes, protocol 2 sessions
+	v2 bool
+}
+
+// nonceCache nonces seen by VerifyLogin by runId, until their timestamp
+// leaves the window. Shared by every verifier, a credential gets a new one
+// on each login
+type nonceCache struct {
+	mu        sync.Mutex
+	nonces    map[string]map[string]time.Time
+	lastPrune time.Time
+}
+
+var nonces = &nonceCache{
+	nonces: make(map[string]map[string]time.Time),
+}
+
+func NewHmac(token string) (*Hmac, error) {
+	if token == "" {
+		return nil, errors.New("hmac token is empty")
+	}
+	h := &Hmac{
+		key: []byte(token),
+	}
+	return h, nil
+}
+
+// NewHmacV2 work conn verifier of a session without msg.CapSessionKey
+func NewHmacV2(token string) (*Hmac, error) {
+	h, err := NewHmac(token)
+	if err != nil {
+		return nil, err
+	}
+	h.v2 = true
+	return h, nil
+}
+
+func (h *Hmac) SetVerifyLogin(timestamp int64, runId string, nonce string) string {
+	return hex.EncodeToString(h.sum(timestamp, runId, nonce))
+}
+
+func (h *Hmac) VerifyLogin(timestamp int64, runId string, nonce string, loginKey string) error {
+	mac, err := hex.DecodeString(loginKey)
+	if err != nil {
+		return ErrInvalidAuthKey
+	}
+	if subtle.ConstantTimeCompare(mac, h.sum(timestamp, runId, nonce)) != 1 {
+		return ErrInvalidAuthKey
+	}
+	skew := time.Duration(maxSkew.Load())
+	now := time.Now()
+	if d := now.Sub(time.Unix(0, timestamp)); d > skew || d < -skew {
+		return ErrLoginExpired
+	}
+	return nonces.use(runId, nonce, now.Add(2*skew))
+}
+
+// use remembers nonce until expire, a nonce seen before is a replay
+func (c *nonceCache) use(runId, nonce string, expire time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastPrune) > time.Minute {
+		c.lastPrune = now
+		for id, seen := range c.nonces {
+			for n, exp := range seen {
+				if now.After(exp) {
+					delete(seen, n)
+				}
+			}
+			if len(seen) == 0 {
+				delete(c.nonces, id)
+			}
+		}
+	}
+	seen, ok := c.nonces[runId]
+	if !ok {
+		seen = make(map[string]time.Time)
+		c.nonces[runId] = seen
+	}
+	if exp, ok := seen[nonce]; ok && now.Before(exp) {
+		return ErrLoginReplayed
+	}
+	seen[nonce] = expire
+	return nil
+}
+
+// sum HMAC-SHA256(token, timestamp‖len(runId)‖runId‖nonce),
+// HMAC-SHA256(token, timestamp‖runId‖nonce) with an int64 runId for v2
+func (h *Hmac) sum(timestamp int64, runId string, nonce string) []byte {
+	mac := hmac.New(sha256.New, h.key)
+	if h.v2 {
+		var buf [16]byte
+		id, _ := strconv.ParseInt(runId, 10, 64)
+		binary.BigEndian.PutUint64(buf[:8], uint64(timestamp))
+		binary.BigEndian.PutUint64(buf[8:], uint64(id))
+		mac.Write(buf[:])
+		mac.Write([]byte(nonce))
+		return mac.Sum(nil)
+	}
+	var buf [10]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(timestamp))
+	binary.BigEndian.PutUint16(buf[8:], uint16(len(runId)))
+	mac.Write(buf[:])
+	mac.Write([]byte(runId))
+	mac.Write([]byte(nonce))
+	return mac.Sum(nil)
+}
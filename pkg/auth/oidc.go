@@ -0,0 +1,421 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+var (
+	ErrInvalidJwt    = errors.New("invalid jwt")
+	ErrJwtExpired    = errors.New("jwt expired")
+	ErrJwtIssuer     = errors.New("jwt issuer mismatch")
+	ErrJwtAudience   = errors.New("jwt audience mismatch")
+	ErrJwtUnknownKey = errors.New("jwt signing key not found")
+	ErrJwtAlg        = errors.New("jwt alg unsupported")
+)
+
+const (
+	// jwtLeeway allowed clock skew
+	jwtLeeway = 30 * time.Second
+	// jwksRefreshInterval minimum interval between remote jwks fetches
+	jwksRefreshInterval = time.Minute
+)
+
+// IdentityVerifier verifiers whose login key carries the weic identity
+type IdentityVerifier interface {
+	Verifier
+	VerifyIdentity(loginKey string) (identity string, err error)
+}
+
+// OidcVerifier checks bearer jwt login keys against a jwks
+type OidcVerifier struct {
+	cfg    *v1.OidcConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// refreshing closed when the running jwks fetch is done, nil when none runs
+	refreshing chan struct{}
+}
+
+func NewOidcVerifier(cfg *v1.OidcConfig) (*OidcVerifier, error) {
+	if cfg == nil {
+		return nil, errors.New("oidc config is nil")
+	}
+	// tokens the idp issued for other clients must not log in
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("oidc issuer and audience are required")
+	}
+	o := &OidcVerifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]crypto.PublicKey),
+	}
+	if err := o.loadKeys(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// SetVerifyLogin weis never signs oidc logins
+func (o *OidcVerifier) SetVerifyLogin(timestamp int64, runId string, nonce string) string {
+	return ""
+}
+
+func (o *OidcVerifier) VerifyLogin(timestamp int64, runId string, nonce string, loginKey string) error {
+	_, err := o.VerifyIdentity(loginKey)
+	return err
+}
+
+func (o *OidcVerifier) VerifyIdentity(loginKey string) (string, error) {
+	parts := strings.Split(loginKey, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidJwt
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	claims := make(map[string]any)
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidJwt
+	}
+	key, err := o.getKey(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJwtSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+	if err := o.checkClaims(claims); err != nil {
+		return "", err
+	}
+	identity, _ := claims[o.cfg.UserClaim].(string)
+	if identity == "" {
+		return "", fmt.Errorf("jwt claim %s is empty", o.cfg.UserClaim)
+	}
+	return identity, nil
+}
+
+func (o *OidcVerifier) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return ErrJwtExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok &&
+		now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return ErrInvalidJwt
+	}
+	if iss, _ := claims["iss"].(string); o.cfg.Issuer == "" || iss != o.cfg.Issuer {
+		return ErrJwtIssuer
+	}
+	if o.cfg.Audience == "" {
+		return ErrJwtAudience
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud != o.cfg.Audience {
+			return ErrJwtAudience
+		}
+	case []any:
+		found := false
+		for _, a := range aud {
+			if s, _ := a.(string); s == o.cfg.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrJwtAudience
+		}
+	default:
+		return ErrJwtAudience
+	}
+	return nil
+}
+
+func (o *OidcVerifier) getKey(kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	if key, ok := o.lookupKey(kid); ok {
+		o.mu.Unlock()
+		return key, nil
+	}
+	// key rotation, refetch the remote jwks
+	if o.cfg.JwksFile != "" || (o.refreshing == nil && time.Since(o.fetchedAt) <= jwksRefreshInterval) {
+		o.mu.Unlock()
+		return nil, ErrJwtUnknownKey
+	}
+	done := o.refreshing
+	if done == nil {
+		done = make(chan struct{})
+		o.refreshing = done
+		o.mu.Unlock()
+		o.refresh(done)
+	} else {
+		o.mu.Unlock()
+		<-done
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, ErrJwtUnknownKey
+}
+
+// refresh fetches the jwks without holding mu, logins waiting on the same
+// unknown kid share the fetch through done
+func (o *OidcVerifier) refresh(done chan struct{}) {
+	keys, err := o.fetchKeys()
+	o.mu.Lock()
+	if err == nil {
+		o.keys = keys
+	}
+	// a failing idp is not asked again before the interval either
+	o.fetchedAt = time.Now()
+	o.refreshing = nil
+	o.mu.Unlock()
+	close(done)
+}
+
+// lookupKey a token without kid matches the only key
+func (o *OidcVerifier) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, true
+		}
+	}
+	key, ok := o.keys[kid]
+	return key, ok
+}
+
+func (o *OidcVerifier) loadKeys() error {
+	keys, err := o.fetchKeys()
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.keys = keys
+	o.fetchedAt = time.Now()
+	return nil
+}
+
+func (o *OidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	if o.cfg.JwksFile != "" {
+		buff, err := os.ReadFile(o.cfg.JwksFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseJwks(buff)
+	}
+	jwksURL := o.cfg.JwksURL
+	if jwksURL == "" {
+		discovery := struct {
+			JwksURI string `json:"jwks_uri"`
+		}{}
+		if err := o.getJSON(strings.TrimSuffix(o.cfg.Issuer, "/")+
+			"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JwksURI == "" {
+			return nil, errors.New("oidc discovery jwks_uri is empty")
+		}
+		jwksURL = discovery.JwksURI
+	}
+	var raw json.RawMessage
+	if err := o.getJSON(jwksURL, &raw); err != nil {
+		return nil, err
+	}
+	return parseJwks(raw)
+}
+
+func (o *OidcVerifier) getJSON(url string, v any) error {
+	rsp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s status:%s", url, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJwks(buff []byte) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(buff, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwk kid:%s %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unknown curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown kty %s", k.Kty)
+	}
+}
+
+func decodeJwtPart(part string, v any) error {
+	buff, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrInvalidJwt
+	}
+	if err := json.Unmarshal(buff, v); err != nil {
+		return ErrInvalidJwt
+	}
+	return nil
+}
+
+func verifyJwtSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return ErrJwtAlg
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[0] {
+		case 'R':
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case 'P':
+			err = rsa.VerifyPSS(k, hash, digest, sig, nil)
+		default:
+			return ErrJwtAlg
+		}
+		if err != nil {
+			return ErrInvalidJwt
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			return ErrJwtAlg
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidJwt
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return ErrInvalidJwt
+		}
+		return nil
+	default:
+		return ErrJwtAlg
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+// Refresher verifiers whose login key must be fetched before login
+type Refresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// OidcTokenSource obtains weic login jwt by client credentials
+type OidcTokenSource struct {
+	cfg    *v1.OidcConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func NewOidcTokenSource(cfg *v1.OidcConfig) (*OidcTokenSource, error) {
+	if cfg == nil || cfg.TokenEndpoint == "" {
+		return nil, errors.New("oidc tokenEndpoint is required")
+	}
+	o := &OidcTokenSource{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	return o, nil
+}
+
+func (o *OidcTokenSource) SetVerifyLogin(timestamp int64, runId string, nonce string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.token
+}
+
+// VerifyLogin weic never verifies oidc logins
+func (o *OidcTokenSource) VerifyLogin(timestamp int64, runId string, nonce string, loginKey string) error {
+	return ErrUnknownAuthMethod
+}
+
+// Refresh fetches a new token when the cached one expires within RefreshBefore
+func (o *OidcTokenSource) Refresh(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token != "" &&
+		time.Until(o.expiresAt) > time.Duration(o.cfg.RefreshBefore)*time.Second {
+		return nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", o.cfg.ClientId)
+	form.Set("client_secret", o.cfg.ClientSecret)
+	if o.cfg.Scope != "" {
+		form.Set("scope", o.cfg.Scope)
+	}
+	if o.cfg.Audience != "" {
+		form.Set("audience", o.cfg.Audience)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		o.cfg.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	rsp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc token endpoint status:%s", rsp.Status)
+	}
+	body := struct {
+		AccessToken string `json:"access_token"`
+		IdToken     string `json:"id_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(rsp.Body).Decode(&body); err != nil {
+		return err
+	}
+	token := body.AccessToken
+	if token == "" {
+		token = body.IdToken
+	}
+	if token == "" {
+		return errors.New("oidc token endpoint returned no token")
+	}
+	o.token = token
+	o.expiresAt = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return nil
+}
@@ -17,7 +17,6 @@ package auth
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"strconv"
 	"strings"
 
@@ -35,15 +34,16 @@ func NewToken(token string) (*Token, error) {
 	return t, nil
 }
 
-func (t *Token) SetVerifyLogin(timestamp int64) string {
+// SetVerifyLogin legacy key, runId and nonce are not signed
+func (t *Token) SetVerifyLogin(timestamp int64, runId string, nonce string) string {
 	return t.GetAuthKey(t.Token, timestamp)
 }
 
-func (t *Token) VerifyLogin(timestamp int64, loginKey string) error {
+func (t *Token) VerifyLogin(timestamp int64, runId string, nonce string, loginKey string) error {
 	if strings.Compare(loginKey, t.GetAuthKey(t.Token, timestamp)) == 0 {
 		return nil
 	}
-	return errors.New("invalid auth key")
+	return ErrInvalidAuthKey
 }
 
 func (t *Token) GetAuthKey(token string, timestamp int64) string {
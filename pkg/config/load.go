@@ -52,8 +52,26 @@ func LoadServerConfig(path string) error {
 	if err := LoadConfig(buff, Server); err != nil {
 		return err
 	}
-	Server.Init()
-	return nil
+	if Server.Auth != nil && Server.Auth.UsersFile != "" {
+		users, err := LoadUsersFile(Server.Auth.UsersFile)
+		if err != nil {
+			return err
+		}
+		Server.Auth.Users = append(Server.Auth.Users, users...)
+	}
+	return Server.Init()
+}
+
+func LoadUsersFile(path string) ([]*v1.User, error) {
+	buff, err := loadConfFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*v1.User, 0)
+	if err := LoadConfig(buff, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
 func LoadClientConfig(path string) error {
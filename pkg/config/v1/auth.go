@@ -14,14 +14,96 @@
 
 package v1
 
+import (
+	"fmt"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
 type AuthConfig struct {
 	Method AuthMethod `json:"method" yaml:"method" toml:"method" default:"token"`
 	Token  string     `json:"token" toml:"token" yaml:"token"`
 	XorKey int64      `json:"xorKey" toml:"xorKey" yaml:"xorKey"`
+	// User weic login user, empty uses the shared token
+	User string `json:"user" toml:"user" yaml:"user"`
+	// Users weis accounts
+	Users []*User `json:"users" toml:"users" yaml:"users"`
+	// UsersFile weis accounts yaml/json file, merged into Users
+	UsersFile string `json:"usersFile" toml:"usersFile" yaml:"usersFile"`
+	// Oidc used when Method is oidc
+	Oidc *OidcConfig `json:"oidc" toml:"oidc" yaml:"oidc"`
+	// MaxClockSkew seconds a hmac login key timestamp may differ from weis time
+	MaxClockSkew int64 `json:"maxClockSkew" toml:"maxClockSkew" yaml:"maxClockSkew" default:"300"`
+}
+
+type OidcConfig struct {
+	// weis
+
+	// Issuer expected iss claim, required on weis, jwks is discovered from it
+	// when JwksURL and JwksFile are empty
+	Issuer string `json:"issuer" toml:"issuer" yaml:"issuer"`
+	// Audience expected aud claim, required on weis
+	Audience string `json:"audience" toml:"audience" yaml:"audience"`
+	// JwksFile local jwks json file
+	JwksFile string `json:"jwksFile" toml:"jwksFile" yaml:"jwksFile"`
+	// JwksURL remote jwks url
+	JwksURL string `json:"jwksURL" toml:"jwksURL" yaml:"jwksURL"`
+	// UserClaim claim mapped to the user name
+	UserClaim string `json:"userClaim" toml:"userClaim" yaml:"userClaim" default:"sub"`
+	// DefaultUser limits, proxy types and ports of identities not in users,
+	// its name and token are ignored. Nil refuses those identities
+	DefaultUser *User `json:"defaultUser" toml:"defaultUser" yaml:"defaultUser"`
+
+	// weic
+
+	// TokenEndpoint client credentials token endpoint
+	TokenEndpoint string `json:"tokenEndpoint" toml:"tokenEndpoint" yaml:"tokenEndpoint"`
+	ClientId      string `json:"clientId" toml:"clientId" yaml:"clientId"`
+	ClientSecret  string `json:"clientSecret" toml:"clientSecret" yaml:"clientSecret"`
+	Scope         string `json:"scope" toml:"scope" yaml:"scope"`
+	// RefreshBefore seconds before expiry the token is refreshed
+	RefreshBefore int64 `json:"refreshBefore" toml:"refreshBefore" yaml:"refreshBefore" default:"60"`
+}
+
+func (o *OidcConfig) Init() {
+	o.UserClaim = util.EmptyDefault(o.UserClaim, "sub")
+	o.RefreshBefore = util.EmptyDefault(o.RefreshBefore, 60)
 }
 
 func (a *AuthConfig) Init() {
 	if a == nil {
 		panic("nil auth")
 	}
+	a.MaxClockSkew = util.EmptyDefault(a.MaxClockSkew, 300)
+	if a.Method == AuthMethodOidc {
+		if a.Oidc == nil {
+			a.Oidc = new(OidcConfig)
+		}
+		a.Oidc.Init()
+	}
+}
+
+func (a *AuthConfig) InitUsers() error {
+	names := make(map[string]struct{}, len(a.Users))
+	for _, u := range a.Users {
+		if err := u.Init(); err != nil {
+			return err
+		}
+		// oidc users authenticate with the issuer, not a token
+		if u.Token == "" && a.Method != AuthMethodOidc {
+			return fmt.Errorf("user:%s token is empty", u.Name)
+		}
+		if _, ok := names[u.Name]; ok {
+			return fmt.Errorf("user:%s repeat", u.Name)
+		}
+		names[u.Name] = struct{}{}
+	}
+	if a.Method == AuthMethodOidc && a.Oidc.DefaultUser != nil {
+		d := a.Oidc.DefaultUser
+		d.Name = util.EmptyDefault(d.Name, "defaultUser")
+		if err := d.Init(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
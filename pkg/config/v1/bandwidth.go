@@ -0,0 +1,73 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	BandwidthLimitModeClient = "client"
+	BandwidthLimitModeServer = "server"
+)
+
+// BandwidthQuantity bytes per second like 512KB or 1.5MB, units B KB MB GB
+// are 1024 based, empty is unlimited
+type BandwidthQuantity string
+
+// ByteQuantity bytes like 100GB, units B KB MB GB TB are 1024 based, empty is unlimited
+type ByteQuantity string
+
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// Bytes per second, 0 when empty
+func (q BandwidthQuantity) Bytes() (int64, error) {
+	return parseBytes(string(q))
+}
+
+// Bytes 0 when empty
+func (q ByteQuantity) Bytes() (int64, error) {
+	return parseBytes(string(q))
+}
+
+func parseBytes(q string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(q))
+	if s == "" {
+		return 0, nil
+	}
+	for _, u := range byteUnits {
+		num, ok := strings.CutSuffix(s, u.suffix)
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+		if err != nil || f <= 0 {
+			break
+		}
+		return int64(f * u.size), nil
+	}
+	return 0, errors.New("bad size " + q + ", use a number with B KB MB GB or TB like 1MB")
+}
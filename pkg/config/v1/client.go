@@ -16,6 +16,8 @@ package v1
 
 import (
 	"errors"
+
+	"github.com/gucooing/weiwei/pkg/util"
 )
 
 type ClientConfig struct {
@@ -23,6 +25,21 @@ type ClientConfig struct {
 	ServerNetwork string      `json:"serverNetwork" yaml:"serverNetwork" toml:"serverNetwork"`
 	ServerAddr    string      `json:"serverAddr" yaml:"serverAddr" toml:"serverAddr"`
 	Auth          *AuthConfig `json:"auth" toml:"auth" yaml:"auth"`
+	Proxies       []*Proxy    `json:"proxies" yaml:"proxies" toml:"proxies"`
+	// StateFile weic state, holds the credential issued on enrollment
+	StateFile string `json:"stateFile" yaml:"stateFile" toml:"stateFile" default:"weic_state.json"`
+	// EnrollToken one-time enrollment token, set by --enroll
+	EnrollToken string `json:"enrollToken" yaml:"enrollToken" toml:"enrollToken"`
+	// Dispatcher control message queue
+	Dispatcher *DispatcherConfig `json:"dispatcher" yaml:"dispatcher" toml:"dispatcher"`
+	// Codec preferred control message codec, json or binary
+	Codec string `json:"codec" yaml:"codec" toml:"codec" default:"binary"`
+	// Compress control conn compression, none gzip or snappy, used when weis supports it
+	Compress string `json:"compress" yaml:"compress" toml:"compress" default:"none"`
+	// InstanceId stable weic identity, generated and kept in the state file when empty
+	InstanceId string `json:"instanceId" yaml:"instanceId" toml:"instanceId"`
+	// MetricsAddr prometheus /metrics listen address, host:port, empty disables it
+	MetricsAddr string `json:"metricsAddr" yaml:"metricsAddr" toml:"metricsAddr"`
 }
 
 func (c *ClientConfig) Init() error {
@@ -32,6 +49,30 @@ func (c *ClientConfig) Init() error {
 
 	c.Log.Init()
 	c.Auth.Init()
+	c.StateFile = util.EmptyDefault(c.StateFile, "weic_state.json")
+	c.Codec = util.EmptyDefault(c.Codec, "binary")
+	c.Compress = util.EmptyDefault(c.Compress, "none")
+	switch c.Compress {
+	case "none", "gzip", "snappy":
+	default:
+		return errors.New("unknown compress: " + c.Compress)
+	}
+	if c.Dispatcher == nil {
+		c.Dispatcher = new(DispatcherConfig)
+	}
+	if err := c.Dispatcher.Init(); err != nil {
+		return err
+	}
+	names := make(map[string]struct{}, len(c.Proxies))
+	for _, p := range c.Proxies {
+		if err := p.Init(); err != nil {
+			return err
+		}
+		if _, ok := names[p.Name]; ok {
+			return errors.New("proxy name repeat: " + p.Name)
+		}
+		names[p.Name] = struct{}{}
+	}
 
 	return nil
 }
@@ -18,4 +18,6 @@ type AuthMethod string
 
 const (
 	AuthMethodToken AuthMethod = "token"
+	AuthMethodHmac  AuthMethod = "hmac"
+	AuthMethodOidc  AuthMethod = "oidc"
 )
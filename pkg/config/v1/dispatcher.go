@@ -0,0 +1,39 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"fmt"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+type DispatcherConfig struct {
+	// QueueSize control message send queue size
+	QueueSize int `json:"queueSize" yaml:"queueSize" toml:"queueSize" default:"100"`
+	// QueuePolicy full send queue policy: block, drop or disconnect
+	QueuePolicy string `json:"queuePolicy" yaml:"queuePolicy" toml:"queuePolicy" default:"block"`
+}
+
+func (d *DispatcherConfig) Init() error {
+	d.QueueSize = util.EmptyDefault(d.QueueSize, 100)
+	d.QueuePolicy = util.EmptyDefault(d.QueuePolicy, "block")
+	switch d.QueuePolicy {
+	case "block", "drop", "disconnect":
+		return nil
+	default:
+		return fmt.Errorf("unknown dispatcher queuePolicy: %s", d.QueuePolicy)
+	}
+}
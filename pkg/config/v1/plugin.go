@@ -0,0 +1,43 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+type HTTPPluginOptions struct {
+	Name string `json:"name" yaml:"name" toml:"name"`
+	// Addr plugin http address, http:// is added without a scheme
+	Addr string `json:"addr" yaml:"addr" toml:"addr"`
+	Path string `json:"path" yaml:"path" toml:"path"`
+	// Ops Login, NewProxy, CloseProxy, NewWorkConn, NewUserConn, Quota
+	Ops []string `json:"ops" yaml:"ops" toml:"ops"`
+	// Timeout seconds
+	Timeout int64 `json:"timeout" yaml:"timeout" toml:"timeout" default:"5"`
+}
+
+func (p *HTTPPluginOptions) Init() error {
+	if p == nil {
+		return errors.New("plugin is nil")
+	}
+	if p.Name == "" || p.Addr == "" {
+		return errors.New("plugin name and addr are required")
+	}
+	p.Timeout = util.EmptyDefault(p.Timeout, 5)
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+// WorkPoolConfig idle work conns weis keeps per weic
+type WorkPoolConfig struct {
+	// MinIdle idle work conns kept without demand
+	MinIdle int `json:"minIdle" yaml:"minIdle" toml:"minIdle"`
+	// MaxIdle idle work conns kept at most
+	MaxIdle int `json:"maxIdle" yaml:"maxIdle" toml:"maxIdle" default:"10"`
+	// IdleTimeout seconds an idle work conn is kept
+	IdleTimeout int64 `json:"idleTimeout" yaml:"idleTimeout" toml:"idleTimeout" default:"60"`
+	// MaxLifetime seconds a work conn may be handed out after it was opened
+	MaxLifetime int64 `json:"maxLifetime" yaml:"maxLifetime" toml:"maxLifetime" default:"3600"`
+	// DialTimeout seconds to wait for a requested work conn
+	DialTimeout int64 `json:"dialTimeout" yaml:"dialTimeout" toml:"dialTimeout" default:"5"`
+}
+
+func (w *WorkPoolConfig) Init() error {
+	w.MaxIdle = util.EmptyDefault(w.MaxIdle, 10)
+	w.IdleTimeout = util.EmptyDefault(w.IdleTimeout, 60)
+	w.MaxLifetime = util.EmptyDefault(w.MaxLifetime, 3600)
+	w.DialTimeout = util.EmptyDefault(w.DialTimeout, 5)
+	if w.MinIdle < 0 || w.MinIdle > w.MaxIdle {
+		return errors.New("workPool minIdle must be between 0 and maxIdle")
+	}
+	return nil
+}
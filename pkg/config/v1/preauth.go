@@ -0,0 +1,53 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+// PreAuthConfig limits on weis listener conns until they authenticate
+type PreAuthConfig struct {
+	// LoginTimeout seconds from accept until the login or work conn is authenticated
+	LoginTimeout int64 `json:"loginTimeout" yaml:"loginTimeout" toml:"loginTimeout" default:"10"`
+	// MaxConns unauthenticated conns at once
+	MaxConns int `json:"maxConns" yaml:"maxConns" toml:"maxConns" default:"1024"`
+	// MaxConnsPerIP unauthenticated conns at once from one address
+	MaxConnsPerIP int `json:"maxConnsPerIP" yaml:"maxConnsPerIP" toml:"maxConnsPerIP" default:"16"`
+	// MaxConnRate conns per minute from one address that did not authenticate
+	// lately, more bans it
+	MaxConnRate int `json:"maxConnRate" yaml:"maxConnRate" toml:"maxConnRate" default:"120"`
+	// MaxLoginFailures failed logins and work conns per minute from one
+	// address, more bans it
+	MaxLoginFailures int `json:"maxLoginFailures" yaml:"maxLoginFailures" toml:"maxLoginFailures" default:"10"`
+	// BanDuration seconds a banned address is refused
+	BanDuration int64 `json:"banDuration" yaml:"banDuration" toml:"banDuration" default:"600"`
+}
+
+func (p *PreAuthConfig) Init() error {
+	p.LoginTimeout = util.EmptyDefault(p.LoginTimeout, 10)
+	p.MaxConns = util.EmptyDefault(p.MaxConns, 1024)
+	p.MaxConnsPerIP = util.EmptyDefault(p.MaxConnsPerIP, 16)
+	p.MaxConnRate = util.EmptyDefault(p.MaxConnRate, 120)
+	p.MaxLoginFailures = util.EmptyDefault(p.MaxLoginFailures, 10)
+	p.BanDuration = util.EmptyDefault(p.BanDuration, 600)
+	if p.LoginTimeout < 0 || p.MaxConns < 0 || p.MaxConnsPerIP < 0 ||
+		p.MaxConnRate < 0 || p.MaxLoginFailures < 0 || p.BanDuration < 0 {
+		return errors.New("preAuth limits must not be negative")
+	}
+	return nil
+}
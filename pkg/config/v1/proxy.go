@@ -14,5 +14,94 @@
 
 package v1
 
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gucooing/weiwei/pkg/ipfilter"
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+type ProxyType string
+
+const (
+	ProxyTypeTcp   ProxyType = "tcp"
+	ProxyTypeUdp   ProxyType = "udp"
+	ProxyTypeHttp  ProxyType = "http"
+	ProxyTypeHttps ProxyType = "https"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
 type Proxy struct {
+	Name          string    `json:"name" yaml:"name" toml:"name"`
+	Type          ProxyType `json:"type" yaml:"type" toml:"type"`
+	LocalIP       string    `json:"localIP" yaml:"localIP" toml:"localIP"`
+	LocalPort     int       `json:"localPort" yaml:"localPort" toml:"localPort"`
+	RemotePort    int       `json:"remotePort" yaml:"remotePort" toml:"remotePort"`
+	CustomDomains []string  `json:"customDomains" yaml:"customDomains" toml:"customDomains"`
+	// BandwidthLimit bytes per second each way, like 1MB, empty is unlimited
+	BandwidthLimit BandwidthQuantity `json:"bandwidthLimit" yaml:"bandwidthLimit" toml:"bandwidthLimit"`
+	// BandwidthLimitMode client limits on weic before data leaves, server on weis
+	BandwidthLimitMode string `json:"bandwidthLimitMode" yaml:"bandwidthLimitMode" toml:"bandwidthLimitMode" default:"client"`
+	// ProxyProtocolVersion v1 or v2 PROXY protocol header weic sends the local
+	// service with the user address, empty sends none. Tcp proxies only: udp
+	// headers and X-Forwarded-For for http wait on a udp and http data plane
+	// in weis
+	ProxyProtocolVersion string `json:"proxyProtocolVersion" yaml:"proxyProtocolVersion" toml:"proxyProtocolVersion"`
+	// AllowIPs addresses and CIDR ranges users may connect from, empty allows all
+	AllowIPs []string `json:"allowIPs" yaml:"allowIPs" toml:"allowIPs"`
+	// DenyIPs addresses and CIDR ranges rejected before AllowIPs
+	DenyIPs []string `json:"denyIPs" yaml:"denyIPs" toml:"denyIPs"`
+	// AllowIPsFile and DenyIPsFile more rules, one per line, reloaded when they change
+	AllowIPsFile string `json:"allowIPsFile" yaml:"allowIPsFile" toml:"allowIPsFile"`
+	DenyIPsFile  string `json:"denyIPsFile" yaml:"denyIPsFile" toml:"denyIPsFile"`
+	// Quota traffic of the proxy per period enforced by weis, nil is unlimited.
+	// It can only lower the quota weis has for the proxy
+	Quota *QuotaConfig `json:"quota" yaml:"quota" toml:"quota"`
+}
+
+func (p *Proxy) Init() error {
+	if p == nil {
+		return errors.New("proxy is nil")
+	}
+	if p.Name == "" {
+		return errors.New("proxy name is empty")
+	}
+	p.Type = util.EmptyDefault(p.Type, ProxyTypeTcp)
+	p.LocalIP = util.EmptyDefault(p.LocalIP, "127.0.0.1")
+	if _, err := p.BandwidthLimit.Bytes(); err != nil {
+		return fmt.Errorf("proxy:%s %w", p.Name, err)
+	}
+	p.BandwidthLimitMode = util.EmptyDefault(p.BandwidthLimitMode, BandwidthLimitModeClient)
+	switch p.BandwidthLimitMode {
+	case BandwidthLimitModeClient, BandwidthLimitModeServer:
+	default:
+		return fmt.Errorf("proxy:%s unknown bandwidthLimitMode %s, client or server", p.Name, p.BandwidthLimitMode)
+	}
+	switch p.ProxyProtocolVersion {
+	case "":
+	case ProxyProtocolV1, ProxyProtocolV2:
+		if p.Type != ProxyTypeTcp {
+			return fmt.Errorf("proxy:%s proxyProtocolVersion needs a tcp proxy, weis has no %s data plane yet",
+				p.Name, p.Type)
+		}
+	default:
+		return fmt.Errorf("proxy:%s unknown proxyProtocolVersion %s, v1 or v2", p.Name, p.ProxyProtocolVersion)
+	}
+	if err := ipfilter.Validate(p.AllowIPs); err != nil {
+		return fmt.Errorf("proxy:%s allowIPs %w", p.Name, err)
+	}
+	if err := ipfilter.Validate(p.DenyIPs); err != nil {
+		return fmt.Errorf("proxy:%s denyIPs %w", p.Name, err)
+	}
+	if p.Quota != nil {
+		if err := p.Quota.Init(); err != nil {
+			return fmt.Errorf("proxy:%s %w", p.Name, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,96 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+type QuotaPeriod string
+
+const (
+	QuotaPeriodDay   QuotaPeriod = "day"
+	QuotaPeriodWeek  QuotaPeriod = "week"
+	QuotaPeriodMonth QuotaPeriod = "month"
+)
+
+// Start of the calendar period t is in, in UTC, weeks start on Monday
+func (p QuotaPeriod) Start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch p {
+	case QuotaPeriodDay:
+		return day
+	case QuotaPeriodWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Next start of the period after the one starting at start
+func (p QuotaPeriod) Next(start time.Time) time.Time {
+	switch p {
+	case QuotaPeriodDay:
+		return start.AddDate(0, 0, 1)
+	case QuotaPeriodWeek:
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+func (p QuotaPeriod) Valid() bool {
+	switch p {
+	case QuotaPeriodDay, QuotaPeriodWeek, QuotaPeriodMonth:
+		return true
+	}
+	return false
+}
+
+// QuotaConfig bytes in and out allowed per calendar period, the proxies are
+// suspended once it is used up and resumed in the next period
+type QuotaConfig struct {
+	// Limit bytes per period, like 100GB
+	Limit ByteQuantity `json:"limit" yaml:"limit" toml:"limit"`
+	// Period day, week or month in UTC
+	Period QuotaPeriod `json:"period" yaml:"period" toml:"period" default:"month"`
+	// WarnAt percents of the limit that are logged and sent to plugins
+	WarnAt []int `json:"warnAt" yaml:"warnAt" toml:"warnAt" default:"[80, 90]"`
+}
+
+func (q *QuotaConfig) Init() error {
+	limit, err := q.Limit.Bytes()
+	if err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return errors.New("quota limit is empty")
+	}
+	q.Period = util.EmptyDefault(q.Period, QuotaPeriodMonth)
+	if !q.Period.Valid() {
+		return errors.New("unknown quota period " + string(q.Period) + ", day week or month")
+	}
+	if q.WarnAt == nil {
+		q.WarnAt = []int{80, 90}
+	}
+	for _, w := range q.WarnAt {
+		if w <= 0 || w >= 100 {
+			return errors.New("quota warnAt must be between 1 and 99")
+		}
+	}
+	return nil
+}
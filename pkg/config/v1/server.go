@@ -16,6 +16,11 @@ package v1
 
 import (
 	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/gucooing/weiwei/pkg/ipfilter"
+	"github.com/gucooing/weiwei/pkg/util"
 )
 
 type ServerConfig struct {
@@ -24,6 +29,42 @@ type ServerConfig struct {
 	ApiAddress  string      `json:"apiAddress" yaml:"apiAddress" toml:"apiAddress"`
 	Auth        *AuthConfig `json:"auth" toml:"auth" yaml:"auth"`
 	WeicTimeout int64       `json:"weicTimeout" yaml:"weicTimeout" toml:"weicTimeout"`
+	// HTTPPlugins operation webhooks
+	HTTPPlugins []*HTTPPluginOptions `json:"httpPlugins" yaml:"httpPlugins" toml:"httpPlugins"`
+	// Dispatcher control message queue
+	Dispatcher *DispatcherConfig `json:"dispatcher" yaml:"dispatcher" toml:"dispatcher"`
+	// DataDir weis state files
+	DataDir string `json:"dataDir" yaml:"dataDir" toml:"dataDir" default:"data"`
+	// ShutdownTimeout seconds to wait for work conns to drain on shutdown
+	ShutdownTimeout int64 `json:"shutdownTimeout" yaml:"shutdownTimeout" toml:"shutdownTimeout" default:"10"`
+	// ReconnectDelay seconds weic is asked to wait before logging in again after shutdown
+	ReconnectDelay int64 `json:"reconnectDelay" yaml:"reconnectDelay" toml:"reconnectDelay" default:"5"`
+	// Session weic session resumption
+	Session *SessionConfig `json:"session" yaml:"session" toml:"session"`
+	// ProxyBindAddr address proxy remote ports listen on
+	ProxyBindAddr string `json:"proxyBindAddr" yaml:"proxyBindAddr" toml:"proxyBindAddr" default:"0.0.0.0"`
+	// MaxFrameSize bytes, largest frame read from an authenticated weic
+	MaxFrameSize int `json:"maxFrameSize" yaml:"maxFrameSize" toml:"maxFrameSize" default:"1048576"`
+	// PreAuthMaxFrameSize bytes, largest frame read before login
+	PreAuthMaxFrameSize int `json:"preAuthMaxFrameSize" yaml:"preAuthMaxFrameSize" toml:"preAuthMaxFrameSize" default:"65536"`
+	// WorkPool idle work conns per weic
+	WorkPool *WorkPoolConfig `json:"workPool" yaml:"workPool" toml:"workPool"`
+	// WebServer admin HTTP API, nil disables it
+	WebServer *WebServerConfig `json:"webServer" yaml:"webServer" toml:"webServer"`
+	// Traffic usage accounting kept in the data dir
+	Traffic *TrafficConfig `json:"traffic" yaml:"traffic" toml:"traffic"`
+	// AllowPorts remote ports proxies may use, remotePort 0 is allocated from
+	// them, empty allows all
+	AllowPorts []PortRange `json:"allowPorts" yaml:"allowPorts" toml:"allowPorts"`
+	// PortLease seconds an allocated port stays reserved for its proxy while it
+	// is offline, then the allocation is dropped
+	PortLease int64 `json:"portLease" yaml:"portLease" toml:"portLease" default:"2592000"`
+	// PreAuth limits on conns that have not authenticated yet
+	PreAuth *PreAuthConfig `json:"preAuth" yaml:"preAuth" toml:"preAuth"`
+	// DenyIPs addresses and CIDR ranges rejected on every proxy
+	DenyIPs []string `json:"denyIPs" yaml:"denyIPs" toml:"denyIPs"`
+	// DenyIPsFile more DenyIPs, one per line, reloaded when it changes
+	DenyIPsFile string `json:"denyIPsFile" yaml:"denyIPsFile" toml:"denyIPsFile"`
 }
 
 func (s *ServerConfig) Init() error {
@@ -32,5 +73,76 @@ func (s *ServerConfig) Init() error {
 	}
 	s.Log.Init()
 	s.Auth.Init()
-	return nil
+	s.DataDir = util.EmptyDefault(s.DataDir, "data")
+	s.ProxyBindAddr = util.EmptyDefault(s.ProxyBindAddr, "0.0.0.0")
+	s.MaxFrameSize = util.EmptyDefault(s.MaxFrameSize, 1<<20)
+	s.PreAuthMaxFrameSize = util.EmptyDefault(s.PreAuthMaxFrameSize, 64<<10)
+	s.ShutdownTimeout = util.EmptyDefault(s.ShutdownTimeout, 10)
+	s.ReconnectDelay = util.EmptyDefault(s.ReconnectDelay, 5)
+	s.PortLease = util.EmptyDefault(s.PortLease, 30*24*3600)
+	if s.Dispatcher == nil {
+		s.Dispatcher = new(DispatcherConfig)
+	}
+	if err := s.Dispatcher.Init(); err != nil {
+		return err
+	}
+	if s.Session == nil {
+		s.Session = new(SessionConfig)
+	}
+	if err := s.Session.Init(); err != nil {
+		return err
+	}
+	if s.WorkPool == nil {
+		s.WorkPool = new(WorkPoolConfig)
+	}
+	if err := s.WorkPool.Init(); err != nil {
+		return err
+	}
+	if s.PreAuth == nil {
+		s.PreAuth = new(PreAuthConfig)
+	}
+	if err := s.PreAuth.Init(); err != nil {
+		return err
+	}
+	if s.Traffic == nil {
+		s.Traffic = new(TrafficConfig)
+	}
+	if err := s.Traffic.Init(); err != nil {
+		return err
+	}
+	for _, r := range s.AllowPorts {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("allowPorts %w", err)
+		}
+	}
+	if err := ipfilter.Validate(s.DenyIPs); err != nil {
+		return fmt.Errorf("denyIPs %w", err)
+	}
+	if s.WebServer != nil {
+		if err := s.WebServer.Init(); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.HTTPPlugins {
+		if err := p.Init(); err != nil {
+			return err
+		}
+	}
+	return s.Auth.InitUsers()
+}
+
+func (s *ServerConfig) EnrollFile() string {
+	return filepath.Join(s.DataDir, "enroll.json")
+}
+
+func (s *ServerConfig) TrafficFile() string {
+	return filepath.Join(s.DataDir, "traffic.json")
+}
+
+func (s *ServerConfig) QuotaFile() string {
+	return filepath.Join(s.DataDir, "quota.json")
+}
+
+func (s *ServerConfig) PortsFile() string {
+	return filepath.Join(s.DataDir, "ports.json")
 }
@@ -0,0 +1,50 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"fmt"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+const (
+	// DuplicateLoginKick the new login kicks the old session
+	DuplicateLoginKick = "kick"
+	// DuplicateLoginReject the new login is refused while the old session is online
+	DuplicateLoginReject = "reject"
+)
+
+type SessionConfig struct {
+	// ResumeGrace seconds the proxies of a dropped weic are kept for it to
+	// resume, 0 closes them at once
+	ResumeGrace int64 `json:"resumeGrace" yaml:"resumeGrace" toml:"resumeGrace" default:"30"`
+	// DuplicateLogin what a login with an instance id already online does: kick or reject
+	DuplicateLogin string `json:"duplicateLogin" yaml:"duplicateLogin" toml:"duplicateLogin" default:"kick"`
+}
+
+func (s *SessionConfig) Init() error {
+	s.ResumeGrace = util.EmptyDefault(s.ResumeGrace, 30)
+	if s.ResumeGrace < 0 {
+		s.ResumeGrace = 0
+	}
+	s.DuplicateLogin = util.EmptyDefault(s.DuplicateLogin, DuplicateLoginKick)
+	switch s.DuplicateLogin {
+	case DuplicateLoginKick, DuplicateLoginReject:
+		return nil
+	default:
+		return fmt.Errorf("unknown session duplicateLogin: %s", s.DuplicateLogin)
+	}
+}
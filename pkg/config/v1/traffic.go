@@ -0,0 +1,36 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+// TrafficConfig persistent traffic accounting per user, client and proxy
+type TrafficConfig struct {
+	// FlushInterval seconds between counter samples written to the data file
+	FlushInterval int64 `json:"flushInterval" yaml:"flushInterval" toml:"flushInterval" default:"60"`
+	// HourlyRetention days hourly rollups are kept
+	HourlyRetention int `json:"hourlyRetention" yaml:"hourlyRetention" toml:"hourlyRetention" default:"7"`
+	// DailyRetention days daily rollups are kept
+	DailyRetention int `json:"dailyRetention" yaml:"dailyRetention" toml:"dailyRetention" default:"400"`
+}
+
+func (t *TrafficConfig) Init() error {
+	t.FlushInterval = util.EmptyDefault(t.FlushInterval, 60)
+	t.HourlyRetention = util.EmptyDefault(t.HourlyRetention, 7)
+	t.DailyRetention = util.EmptyDefault(t.DailyRetention, 400)
+	return nil
+}
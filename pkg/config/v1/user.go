@@ -0,0 +1,89 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+	"fmt"
+)
+
+// User a weic account on weis, zero limits mean unlimited
+type User struct {
+	Name            string      `json:"name" yaml:"name" toml:"name"`
+	Token           string      `json:"token" yaml:"token" toml:"token"`
+	AllowProxyTypes []ProxyType `json:"allowProxyTypes" yaml:"allowProxyTypes" toml:"allowProxyTypes"`
+	AllowPorts      []PortRange `json:"allowPorts" yaml:"allowPorts" toml:"allowPorts"`
+	AllowDomains    []string    `json:"allowDomains" yaml:"allowDomains" toml:"allowDomains"`
+	MaxProxies      int         `json:"maxProxies" yaml:"maxProxies" toml:"maxProxies"`
+	MaxClients      int         `json:"maxClients" yaml:"maxClients" toml:"maxClients"`
+	// BandwidthLimit bytes per second each way over all proxies of the user, enforced by weis
+	BandwidthLimit BandwidthQuantity `json:"bandwidthLimit" yaml:"bandwidthLimit" toml:"bandwidthLimit"`
+	// Quota traffic over all proxies of the user per period, nil is unlimited
+	Quota *QuotaConfig `json:"quota" yaml:"quota" toml:"quota"`
+	// ProxyQuotas traffic of a proxy of the user per period keyed by proxy name,
+	// weic may only ask for a lower limit
+	ProxyQuotas map[string]*QuotaConfig `json:"proxyQuotas" yaml:"proxyQuotas" toml:"proxyQuotas"`
+}
+
+func (u *User) Init() error {
+	if u == nil {
+		return errors.New("user is nil")
+	}
+	if u.Name == "" {
+		return errors.New("user name is empty")
+	}
+	if _, err := u.BandwidthLimit.Bytes(); err != nil {
+		return fmt.Errorf("user:%s %w", u.Name, err)
+	}
+	for _, r := range u.AllowPorts {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("user:%s allowPorts %w", u.Name, err)
+		}
+	}
+	if u.Quota != nil {
+		if err := u.Quota.Init(); err != nil {
+			return fmt.Errorf("user:%s %w", u.Name, err)
+		}
+	}
+	for name, q := range u.ProxyQuotas {
+		if q == nil {
+			return fmt.Errorf("user:%s proxy:%s quota is empty", u.Name, name)
+		}
+		if err := q.Init(); err != nil {
+			return fmt.Errorf("user:%s proxy:%s %w", u.Name, name, err)
+		}
+	}
+	return nil
+}
+
+type PortRange struct {
+	Start int `json:"start" yaml:"start" toml:"start"`
+	End   int `json:"end" yaml:"end" toml:"end"`
+}
+
+func (r PortRange) Validate() error {
+	if r.Start < 1 || r.Start > 65535 || r.End != 0 && (r.End < r.Start || r.End > 65535) {
+		return fmt.Errorf("bad port range %d-%d", r.Start, r.End)
+	}
+	return nil
+}
+
+// Contains End 0 means a single port
+func (r PortRange) Contains(port int) bool {
+	if r.End == 0 {
+		return port == r.Start
+	}
+	return port >= r.Start && port <= r.End
+}
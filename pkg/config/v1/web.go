@@ -0,0 +1,41 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	"errors"
+)
+
+// WebServerConfig admin HTTP API, disabled when the block is missing
+type WebServerConfig struct {
+	// Addr listen address, host:port
+	Addr string `json:"addr" yaml:"addr" toml:"addr" default:"127.0.0.1:7500"`
+	// User and Password basic auth, POST and DELETE with it also need an
+	// X-Requested-With header
+	User     string `json:"user" yaml:"user" toml:"user"`
+	Password string `json:"password" yaml:"password" toml:"password"`
+	// Token bearer token
+	Token string `json:"token" yaml:"token" toml:"token"`
+}
+
+func (w *WebServerConfig) Init() error {
+	if w.Addr == "" {
+		w.Addr = "127.0.0.1:7500"
+	}
+	if w.Token == "" && (w.User == "" || w.Password == "") {
+		return errors.New("webServer needs user and password or token")
+	}
+	return nil
+}
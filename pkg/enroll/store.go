@@ -0,0 +1,311 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enroll
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gucooing/weiwei/pkg/util"
+)
+
+var (
+	ErrInvalidToken      = errors.New("invalid enrollment token")
+	ErrTokenUsed         = errors.New("enrollment token already used")
+	ErrTokenExpired      = errors.New("enrollment token expired")
+	ErrUnknownCredential = errors.New("unknown client credential")
+	ErrRevoked           = errors.New("client credential revoked")
+)
+
+// Token a single use enrollment token, the secret is only stored hashed
+type Token struct {
+	Id         string    `json:"id"`
+	SecretHash string    `json:"secretHash"`
+	User       string    `json:"user,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	UsedAt     time.Time `json:"usedAt,omitempty"`
+	ClientId   string    `json:"clientId,omitempty"`
+}
+
+// Credential a long-lived per-client credential handed out on enrollment
+type Credential struct {
+	ClientId   string    `json:"clientId"`
+	Secret     string    `json:"secret"`
+	User       string    `json:"user,omitempty"`
+	EnrolledAt time.Time `json:"enrolledAt"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	RevokedAt  time.Time `json:"revokedAt,omitempty"`
+}
+
+type data struct {
+	Tokens      map[string]*Token      `json:"tokens"`
+	Credentials map[string]*Credential `json:"credentials"`
+}
+
+// Store enrollment state file, reloaded on every access so
+// tokens minted by the weis enroll command are seen by a running weis
+type Store struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewStore(path string) *Store {
+	s := &Store{
+		path: path,
+	}
+	return s
+}
+
+func (s *Store) load() (*data, error) {
+	d := &data{
+		Tokens:      make(map[string]*Token),
+		Credentials: make(map[string]*Credential),
+	}
+	buff, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buff, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *Store) save(d *data) error {
+	buff, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	// a temp file of its own, the weis enroll command may save concurrently
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buff)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// update the read-modify-write runs under a flock on path.lock,
+// shared with every other process using the store file
+func (s *Store) update(f func(d *data) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	lf, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	unlock, err := lockFile(lf)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	d, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := f(d); err != nil {
+		return err
+	}
+	return s.save(d)
+}
+
+// Mint returns the token "<id>.<secret>" handed to the new weic
+func (s *Store) Mint(user string, ttl time.Duration) (string, *Token, error) {
+	secret := util.NewNonce(32)
+	t := &Token{
+		Id:         util.NewNonce(8),
+		SecretHash: HashSecret(secret),
+		User:       user,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  time.Now().Add(ttl),
+	}
+	err := s.update(func(d *data) error {
+		d.Tokens[t.Id] = t
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return t.Id + "." + secret, t, nil
+}
+
+// Redeem verify checks the login signed with the enrollment key, the token
+// is then marked used and the client credential created.
+// The caller must Rollback when the login fails afterwards
+func (s *Store) Redeem(tokenId, remoteAddr string, verify func(enrollKey string) error) (*Credential, string, error) {
+	var cred *Credential
+	var enrollKey string
+	err := s.update(func(d *data) error {
+		t, ok := d.Tokens[tokenId]
+		if !ok {
+			return ErrInvalidToken
+		}
+		if err := verify(t.SecretHash); err != nil {
+			return ErrInvalidToken
+		}
+		if !t.UsedAt.IsZero() {
+			return ErrTokenUsed
+		}
+		if time.Now().After(t.ExpiresAt) {
+			return ErrTokenExpired
+		}
+		cred = &Credential{
+			ClientId:   util.NewNonce(16),
+			Secret:     util.NewNonce(32),
+			User:       t.User,
+			EnrolledAt: time.Now(),
+			RemoteAddr: remoteAddr,
+		}
+		t.UsedAt = cred.EnrolledAt
+		t.ClientId = cred.ClientId
+		d.Credentials[cred.ClientId] = cred
+		enrollKey = t.SecretHash
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cred, enrollKey, nil
+}
+
+// Rollback undoes a Redeem whose login did not complete,
+// the token can be redeemed again
+func (s *Store) Rollback(tokenId, clientId string) error {
+	return s.update(func(d *data) error {
+		t, ok := d.Tokens[tokenId]
+		if !ok || t.ClientId != clientId {
+			return ErrInvalidToken
+		}
+		t.UsedAt = time.Time{}
+		t.ClientId = ""
+		delete(d.Credentials, clientId)
+		return nil
+	})
+}
+
+func (s *Store) GetCredential(clientId string) (*Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	cred, ok := d.Credentials[clientId]
+	if !ok {
+		return nil, ErrUnknownCredential
+	}
+	if !cred.RevokedAt.IsZero() {
+		return nil, ErrRevoked
+	}
+	return cred, nil
+}
+
+func (s *Store) Revoke(clientId string) error {
+	return s.update(func(d *data) error {
+		cred, ok := d.Credentials[clientId]
+		if !ok {
+			return ErrUnknownCredential
+		}
+		if cred.RevokedAt.IsZero() {
+			cred.RevokedAt = time.Now()
+		}
+		return nil
+	})
+}
+
+func (s *Store) List() ([]*Token, []*Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens := make([]*Token, 0, len(d.Tokens))
+	for _, t := range d.Tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	creds := make([]*Credential, 0, len(d.Credentials))
+	for _, c := range d.Credentials {
+		creds = append(creds, c)
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		return creds[i].EnrolledAt.Before(creds[j].EnrolledAt)
+	})
+	return tokens, creds, nil
+}
+
+// SplitToken "<id>.<secret>"
+func SplitToken(token string) (id, secret string, err error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return "", "", ErrInvalidToken
+	}
+	return id, secret, nil
+}
+
+// HashSecret the enrollment key both sides sign the login with
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// SealSecret hides the credential secret in the login response with a pad
+// derived from the enrollment key, SealSecret is its own inverse
+func SealSecret(enrollKey, nonce, secret string) (string, error) {
+	raw, err := hex.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(enrollKey))
+	mac.Write([]byte("weiwei-enroll"))
+	mac.Write([]byte(nonce))
+	pad := mac.Sum(nil)
+	if len(raw) > len(pad) {
+		return "", errors.New("secret too long")
+	}
+	out := make([]byte, len(raw))
+	subtle.XORBytes(out, raw, pad[:len(raw)])
+	return hex.EncodeToString(out), nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipfilter allow and deny lists of ip addresses and CIDR ranges
+package ipfilter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrBadRule = errors.New("bad ip rule")
+)
+
+// RuleNotAllowed rejects addresses missing from a non-empty allow list
+const RuleNotAllowed = "not-allowed"
+
+// ParsePrefix an ip address or a CIDR range
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return p, fmt.Errorf("%w %q", ErrBadRule, s)
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), max(p.Bits()-96, 0))
+		}
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w %q", ErrBadRule, s)
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+func parsePrefixes(rules []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(rules))
+	for _, r := range rules {
+		p, err := ParsePrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// Validate every rule is an ip address or a CIDR range
+func Validate(rules []string) error {
+	_, err := parsePrefixes(rules)
+	return err
+}
+
+// ReadFile one rule per line, # starts a comment
+func ReadFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules := make([]string, 0)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if _, err := ParsePrefix(text); err != nil {
+			return nil, fmt.Errorf("%s:%d %w", path, line, err)
+		}
+		rules = append(rules, text)
+	}
+	return rules, sc.Err()
+}
+
+// Load rules and those of file, file may be empty
+func Load(rules []string, file string) ([]string, error) {
+	if err := Validate(rules); err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return rules, nil
+	}
+	fileRules, err := ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]string, 0, len(rules)+len(fileRules)), rules...), fileRules...), nil
+}
+
+// Filter rejects addresses in the deny list and, with a non-empty allow
+// list, addresses not in it. The lists can be replaced while in use
+type Filter struct {
+	mu    sync.RWMutex
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	// hits rejections by rule, kept across updates
+	hits map[string]*atomic.Int64
+}
+
+func New(allow, deny []string) (*Filter, error) {
+	f := &Filter{
+		hits: make(map[string]*atomic.Int64),
+	}
+	if err := f.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Filter) Update(allow, deny []string) error {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return err
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allow, f.deny = allowPrefixes, denyPrefixes
+	for _, p := range denyPrefixes {
+		if _, ok := f.hits[p.String()]; !ok {
+			f.hits[p.String()] = new(atomic.Int64)
+		}
+	}
+	if len(allowPrefixes) > 0 {
+		if _, ok := f.hits[RuleNotAllowed]; !ok {
+			f.hits[RuleNotAllowed] = new(atomic.Int64)
+		}
+	}
+	return nil
+}
+
+// Check the rule that rejects addr and counts the hit, ok when addr is accepted
+func (f *Filter) Check(addr netip.Addr) (rule string, ok bool) {
+	addr = addr.Unmap()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			rule = p.String()
+			f.hits[rule].Add(1)
+			return rule, false
+		}
+	}
+	if len(f.allow) == 0 {
+		return "", true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return "", true
+		}
+	}
+	f.hits[RuleNotAllowed].Add(1)
+	return RuleNotAllowed, false
+}
+
+// Hits rejections by rule, rules removed by an update keep their count
+func (f *Filter) Hits() map[string]int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	hits := make(map[string]int64, len(f.hits))
+	for rule, n := range f.hits {
+		hits[rule] = n.Load()
+	}
+	return hits
+}
+
+// Watch calls reload after one of files changed, checking every interval
+// until ctx is done
+func Watch(ctx context.Context, interval time.Duration, files []string, reload func()) {
+	if len(files) == 0 {
+		return
+	}
+	stat := func() []string {
+		states := make([]string, len(files))
+		for i, file := range files {
+			if fi, err := os.Stat(file); err == nil {
+				states[i] = fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+			}
+		}
+		return states
+	}
+	last := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			states := stat()
+			changed := false
+			for i := range states {
+				changed = changed || states[i] != last[i]
+			}
+			last = states
+			if changed {
+				reload()
+			}
+		}
+	}
+}
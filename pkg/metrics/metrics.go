@@ -0,0 +1,432 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics is a small registry that writes the Prometheus text
+// exposition format, enough for weis and weic without extra dependencies.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Type string
+
+const (
+	TypeCounter   Type = "counter"
+	TypeGauge     Type = "gauge"
+	TypeHistogram Type = "histogram"
+)
+
+// DefBuckets seconds, from 1ms to 10s
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type desc struct {
+	name   string
+	help   string
+	typ    Type
+	labels []string
+}
+
+type metric interface {
+	describe() *desc
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]struct{}),
+	}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := m.describe().name
+	if _, ok := r.names[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, m)
+}
+
+// Handler serves the registry in the text exposition format 0.0.4
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := bufio.NewWriter(rw)
+		r.mu.Lock()
+		metrics := r.metrics
+		r.mu.Unlock()
+		for _, m := range metrics {
+			d := m.describe()
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+			m.write(w)
+		}
+		w.Flush()
+	})
+}
+
+// vec children by label values
+type vec[T any] struct {
+	desc
+	mu       sync.RWMutex
+	children map[string]*T
+	newChild func(labelValues []string) *T
+}
+
+func (v *vec[T]) describe() *desc {
+	return &v.desc
+}
+
+func (v *vec[T]) with(labelValues []string) *T {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d",
+			v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = v.newChild(append([]string(nil), labelValues...))
+		v.children[key] = c
+	}
+	return c
+}
+
+// sorted children for a stable output
+func (v *vec[T]) sorted() []*T {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*T, len(keys))
+	for i, key := range keys {
+		children[i] = v.children[key]
+	}
+	return children
+}
+
+// value float64 updated with atomics
+type value struct {
+	labelValues []string
+	bits        atomic.Uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) Value() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+type Counter struct {
+	value
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add delta must not be negative
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.value.Add(delta)
+}
+
+type CounterVec struct {
+	vec[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{vec[Counter]{
+		desc:     desc{name: name, help: help, typ: TypeCounter, labels: labels},
+		children: make(map[string]*Counter),
+		newChild: func(labelValues []string) *Counter {
+			return &Counter{value{labelValues: labelValues}}
+		},
+	}}
+	r.register(v)
+	return v
+}
+
+// NewCounter counter without labels
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).WithLabelValues()
+}
+
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return v.with(labelValues)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	for _, c := range v.sorted() {
+		writeSample(w, v.name, v.labels, c.labelValues, "", "", c.Value())
+	}
+}
+
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Set(val float64) {
+	g.bits.Store(math.Float64bits(val))
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{vec[Gauge]{
+		desc:     desc{name: name, help: help, typ: TypeGauge, labels: labels},
+		children: make(map[string]*Gauge),
+		newChild: func(labelValues []string) *Gauge {
+			return &Gauge{value{labelValues: labelValues}}
+		},
+	}}
+	r.register(v)
+	return v
+}
+
+// NewGauge gauge without labels
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).WithLabelValues()
+}
+
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return v.with(labelValues)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	for _, g := range v.sorted() {
+		writeSample(w, v.name, v.labels, g.labelValues, "", "", g.Value())
+	}
+}
+
+type Histogram struct {
+	labelValues []string
+	buckets     []float64
+	counts      []atomic.Uint64
+	count       atomic.Uint64
+	sum         value
+}
+
+func (h *Histogram) Observe(val float64) {
+	// counts are per bucket, write adds them up
+	i := sort.SearchFloat64s(h.buckets, val)
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.sum.Add(val)
+	h.count.Add(1)
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+	buckets []float64
+}
+
+// NewHistogramVec buckets upper bounds in increasing order, DefBuckets when nil
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: " + name + " buckets are not sorted")
+	}
+	v := &HistogramVec{buckets: buckets}
+	v.vec = vec[Histogram]{
+		desc:     desc{name: name, help: help, typ: TypeHistogram, labels: labels},
+		children: make(map[string]*Histogram),
+		newChild: func(labelValues []string) *Histogram {
+			return &Histogram{
+				labelValues: labelValues,
+				buckets:     buckets,
+				counts:      make([]atomic.Uint64, len(buckets)),
+			}
+		},
+	}
+	r.register(v)
+	return v
+}
+
+// NewHistogram histogram without labels
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).WithLabelValues()
+}
+
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return v.with(labelValues)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	for _, h := range v.sorted() {
+		// count first so no bucket ends above it
+		count := h.count.Load()
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += h.counts[i].Load()
+			writeSample(w, v.name+"_bucket", v.labels, h.labelValues, "le", formatValue(le), float64(min(cumulative, count)))
+		}
+		writeSample(w, v.name+"_bucket", v.labels, h.labelValues, "le", "+Inf", float64(count))
+		writeSample(w, v.name+"_sum", v.labels, h.labelValues, "", "", h.sum.Value())
+		writeSample(w, v.name+"_count", v.labels, h.labelValues, "", "", float64(count))
+	}
+}
+
+// funcMetric samples read from live state on every scrape
+type funcMetric struct {
+	desc
+	fn func(emit func(val float64, labelValues ...string))
+}
+
+func (f *funcMetric) describe() *desc {
+	return &f.desc
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	// sum samples with the same label values, the source may repeat them
+	type sample struct {
+		labelValues []string
+		val         float64
+	}
+	samples := make(map[string]*sample)
+	f.fn(func(val float64, labelValues ...string) {
+		if len(labelValues) != len(f.labels) {
+			panic(fmt.Sprintf("metrics: %s wants %d label values, got %d",
+				f.name, len(f.labels), len(labelValues)))
+		}
+		key := strings.Join(labelValues, "\xff")
+		if s, ok := samples[key]; ok {
+			s.val += val
+			return
+		}
+		samples[key] = &sample{labelValues: labelValues, val: val}
+	})
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := samples[key]
+		writeSample(w, f.name, f.labels, s.labelValues, "", "", s.val)
+	}
+}
+
+// NewFunc counter or gauge read by fn on every scrape, samples with the
+// same label values are added up
+func (r *Registry) NewFunc(name, help string, typ Type, labels []string,
+	fn func(emit func(val float64, labelValues ...string))) {
+	r.register(&funcMetric{
+		desc: desc{name: name, help: help, typ: typ, labels: labels},
+		fn:   fn,
+	})
+}
+
+// NewGaugeFunc gauge without labels read by fn on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.NewFunc(name, help, TypeGauge, nil, func(emit func(float64, ...string)) {
+		emit(fn())
+	})
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraLabel, extraValue string, val float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, label, labelValues[i])
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(val))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeLabel(w *bufio.Writer, label, val string) {
+	w.WriteString(label)
+	w.WriteString(`="`)
+	labelEscaper.WriteString(w, val)
+	w.WriteByte('"')
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
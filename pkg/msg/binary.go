@@ -0,0 +1,331 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+var (
+	ErrBinaryShort = errors.New("binary msg too short")
+)
+
+// binaryCodec compact varint encoding of exported struct fields in
+// declaration order, prefixed by the field count. New fields must only be
+// appended: trailing fields unknown to the reader are skipped, missing
+// ones are left zero. Registered messages use their hand written coders in
+// binary_msgs.go, the reflect plan covers any other type.
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return CodecBinary
+}
+
+func (binaryCodec) Marshal(message Message) ([]byte, error) {
+	if m, ok := message.(binaryMessage); ok {
+		return marshalBinary(m), nil
+	}
+	v := reflect.ValueOf(message)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	p, err := getBinaryPlan(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	return p.encode(make([]byte, 0, 64), v), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, message Message) error {
+	if m, ok := message.(binaryMessage); ok {
+		return m.decodeBinary(data)
+	}
+	v := reflect.ValueOf(message)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return errors.New("binary unmarshal non-pointer")
+	}
+	v = v.Elem()
+	p, err := getBinaryPlan(v.Type())
+	if err != nil {
+		return err
+	}
+	_, err = p.decode(data, v)
+	return err
+}
+
+type binaryEncodeFunc func(b []byte, v reflect.Value) []byte
+type binaryDecodeFunc func(b []byte, v reflect.Value) ([]byte, error)
+
+// binaryPlan cached field coders of a struct type
+type binaryPlan struct {
+	fields []int
+	enc    []binaryEncodeFunc
+	dec    []binaryDecodeFunc
+}
+
+var (
+	binaryPlans sync.Map // reflect.Type -> *binaryPlan
+)
+
+func getBinaryPlan(t reflect.Type) (*binaryPlan, error) {
+	if p, ok := binaryPlans.Load(t); ok {
+		return p.(*binaryPlan), nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("binary codec unsupported type %s", t)
+	}
+	p := new(binaryPlan)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		enc, dec, err := binaryCoder(f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		p.fields = append(p.fields, i)
+		p.enc = append(p.enc, enc)
+		p.dec = append(p.dec, dec)
+	}
+	actual, _ := binaryPlans.LoadOrStore(t, p)
+	return actual.(*binaryPlan), nil
+}
+
+func (p *binaryPlan) encode(b []byte, v reflect.Value) []byte {
+	b = binary.AppendUvarint(b, uint64(len(p.fields)))
+	for i, idx := range p.fields {
+		b = p.enc[i](b, v.Field(idx))
+	}
+	return b
+}
+
+func (p *binaryPlan) decode(b []byte, v reflect.Value) ([]byte, error) {
+	n, b, err := readUvarint(b)
+	if err != nil {
+		return nil, err
+	}
+	for i, idx := range p.fields {
+		if uint64(i) >= n {
+			break
+		}
+		if b, err = p.dec[i](b, v.Field(idx)); err != nil {
+			return nil, err
+		}
+	}
+	if n > uint64(len(p.fields)) {
+		// fields appended by a newer peer, only valid for the outermost struct
+		return nil, nil
+	}
+	return b, nil
+}
+
+func binaryCoder(t reflect.Type) (binaryEncodeFunc, binaryDecodeFunc, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		return func(b []byte, v reflect.Value) []byte {
+				if v.Bool() {
+					return append(b, 1)
+				}
+				return append(b, 0)
+			}, func(b []byte, v reflect.Value) ([]byte, error) {
+				if len(b) < 1 {
+					return nil, ErrBinaryShort
+				}
+				v.SetBool(b[0] != 0)
+				return b[1:], nil
+			}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(b []byte, v reflect.Value) []byte {
+				return binary.AppendVarint(b, v.Int())
+			}, func(b []byte, v reflect.Value) ([]byte, error) {
+				x, n := binary.Varint(b)
+				if n <= 0 {
+					return nil, ErrBinaryShort
+				}
+				v.SetInt(x)
+				return b[n:], nil
+			}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return func(b []byte, v reflect.Value) []byte {
+				return binary.AppendUvarint(b, v.Uint())
+			}, func(b []byte, v reflect.Value) ([]byte, error) {
+				x, b, err := readUvarint(b)
+				if err != nil {
+					return nil, err
+				}
+				v.SetUint(x)
+				return b, nil
+			}, nil
+	case reflect.Float32, reflect.Float64:
+		return func(b []byte, v reflect.Value) []byte {
+				return binary.BigEndian.AppendUint64(b, math.Float64bits(v.Float()))
+			}, func(b []byte, v reflect.Value) ([]byte, error) {
+				if len(b) < 8 {
+					return nil, ErrBinaryShort
+				}
+				v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+				return b[8:], nil
+			}, nil
+	case reflect.String:
+		return func(b []byte, v reflect.Value) []byte {
+				s := v.String()
+				b = binary.AppendUvarint(b, uint64(len(s)))
+				return append(b, s...)
+			}, func(b []byte, v reflect.Value) ([]byte, error) {
+				data, b, err := readBytes(b)
+				if err != nil {
+					return nil, err
+				}
+				v.SetString(string(data))
+				return b, nil
+			}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return func(b []byte, v reflect.Value) []byte {
+					data := v.Bytes()
+					b = binary.AppendUvarint(b, uint64(len(data)))
+					return append(b, data...)
+				}, func(b []byte, v reflect.Value) ([]byte, error) {
+					data, b, err := readBytes(b)
+					if err != nil {
+						return nil, err
+					}
+					v.SetBytes(append([]byte(nil), data...))
+					return b, nil
+				}, nil
+		}
+		elemEnc, elemDec, err := binaryCoder(t.Elem())
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(b []byte, v reflect.Value) []byte {
+				b = binary.AppendUvarint(b, uint64(v.Len()))
+				for i := 0; i < v.Len(); i++ {
+					b = elemEnc(b, v.Index(i))
+				}
+				return b
+			}, func(b []byte, v reflect.Value) ([]byte, error) {
+				n, b, err := readUvarint(b)
+				if err != nil {
+					return nil, err
+				}
+				// every element takes at least one byte
+				if n > uint64(len(b)) {
+					return nil, ErrBinaryShort
+				}
+				if n == 0 {
+					v.Set(reflect.Zero(t))
+					return b, nil
+				}
+				s := reflect.MakeSlice(t, int(n), int(n))
+				for i := 0; i < int(n); i++ {
+					if b, err = elemDec(b, s.Index(i)); err != nil {
+						return nil, err
+					}
+				}
+				v.Set(s)
+				return b, nil
+			}, nil
+	case reflect.Map:
+		keyEnc, keyDec, err := binaryCoder(t.Key())
+		if err != nil {
+			return nil, nil, err
+		}
+		elemEnc, elemDec, err := binaryCoder(t.Elem())
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(b []byte, v reflect.Value) []byte {
+				b = binary.AppendUvarint(b, uint64(v.Len()))
+				iter := v.MapRange()
+				for iter.Next() {
+					b = keyEnc(b, iter.Key())
+					b = elemEnc(b, iter.Value())
+				}
+				return b
+			}, func(b []byte, v reflect.Value) ([]byte, error) {
+				n, b, err := readUvarint(b)
+				if err != nil {
+					return nil, err
+				}
+				if n > uint64(len(b)) {
+					return nil, ErrBinaryShort
+				}
+				if n == 0 {
+					v.Set(reflect.Zero(t))
+					return b, nil
+				}
+				m := reflect.MakeMapWithSize(t, int(n))
+				for i := uint64(0); i < n; i++ {
+					key := reflect.New(t.Key()).Elem()
+					if b, err = keyDec(b, key); err != nil {
+						return nil, err
+					}
+					elem := reflect.New(t.Elem()).Elem()
+					if b, err = elemDec(b, elem); err != nil {
+						return nil, err
+					}
+					m.SetMapIndex(key, elem)
+				}
+				v.Set(m)
+				return b, nil
+			}, nil
+	case reflect.Struct:
+		p, err := getBinaryPlan(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p.encode, p.decodeNested, nil
+	default:
+		return nil, nil, fmt.Errorf("binary codec unsupported kind %s", t.Kind())
+	}
+}
+
+// decodeNested nested structs cannot skip appended fields, their count must match
+func (p *binaryPlan) decodeNested(b []byte, v reflect.Value) ([]byte, error) {
+	n, _, err := readUvarint(b)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(p.fields)) {
+		return nil, fmt.Errorf("binary codec %s has %v unknown fields", v.Type(), n-uint64(len(p.fields)))
+	}
+	return p.decode(b, v)
+}
+
+func readUvarint(b []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, ErrBinaryShort
+	}
+	return x, b[n:], nil
+}
+
+func readBytes(b []byte) ([]byte, []byte, error) {
+	n, b, err := readUvarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n > uint64(len(b)) {
+		return nil, nil, ErrBinaryShort
+	}
+	return b[:n], b[n:], nil
+}
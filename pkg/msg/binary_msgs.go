@@ -0,0 +1,409 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msg
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// binaryMessage a message with a hand written binary coder, it writes the
+// same bytes as the reflect plan of its type without walking the fields.
+// Fields are listed in declaration order, a new field is appended here too.
+type binaryMessage interface {
+	appendBinary(b []byte) []byte
+	decodeBinary(b []byte) error
+}
+
+// binaryBufs encode buffers, the message is copied out at its final size
+var binaryBufs = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// binaryBufMax larger buffers are left to the gc
+const binaryBufMax = 64 << 10
+
+func marshalBinary(m binaryMessage) []byte {
+	bp := binaryBufs.Get().(*[]byte)
+	b := m.appendBinary((*bp)[:0])
+	out := append([]byte(nil), b...)
+	if cap(b) <= binaryBufMax {
+		*bp = b[:0]
+		binaryBufs.Put(bp)
+	}
+	return out
+}
+
+// binaryReader reads the fields of one message, fields the peer did not
+// send are left zero and fields it appended are skipped
+type binaryReader struct {
+	b []byte
+	// raw the whole body, s is its copy made on the first string
+	// so all strings of a message share one allocation
+	raw []byte
+	s   string
+	// n fields left to read
+	n   uint64
+	err error
+}
+
+func newBinaryReader(b []byte) binaryReader {
+	raw := b
+	n, b, err := readUvarint(b)
+	return binaryReader{b: b, raw: raw, n: n, err: err}
+}
+
+func (r *binaryReader) readString() string {
+	var data, rest []byte
+	if data, rest, r.err = readBytes(r.b); r.err != nil || len(data) == 0 {
+		return ""
+	}
+	if r.s == "" {
+		r.s = string(r.raw)
+	}
+	off := len(r.raw) - len(rest) - len(data)
+	r.b = rest
+	return r.s[off : off+len(data)]
+}
+
+func (r *binaryReader) next() bool {
+	if r.err != nil || r.n == 0 {
+		return false
+	}
+	r.n--
+	return true
+}
+
+func (r *binaryReader) string(s *string) {
+	if !r.next() {
+		return
+	}
+	*s = r.readString()
+}
+
+func (r *binaryReader) strings(s *[]string) {
+	if !r.next() {
+		return
+	}
+	var n uint64
+	if n, r.b, r.err = readUvarint(r.b); r.err != nil {
+		return
+	}
+	// every element takes at least one byte
+	if n > uint64(len(r.b)) {
+		r.err = ErrBinaryShort
+		return
+	}
+	if n == 0 {
+		*s = nil
+		return
+	}
+	out := make([]string, n)
+	for i := range out {
+		if out[i] = r.readString(); r.err != nil {
+			return
+		}
+	}
+	*s = out
+}
+
+func (r *binaryReader) varint(x *int64) {
+	if !r.next() {
+		return
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = ErrBinaryShort
+		return
+	}
+	*x, r.b = v, r.b[n:]
+}
+
+func (r *binaryReader) int(x *int) {
+	var v int64
+	r.varint(&v)
+	*x = int(v)
+}
+
+func (r *binaryReader) uvarint(x *uint64) {
+	if !r.next() {
+		return
+	}
+	*x, r.b, r.err = readUvarint(r.b)
+}
+
+func (r *binaryReader) uint32(x *uint32) {
+	var v uint64
+	r.uvarint(&v)
+	*x = uint32(v)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendStrings(b []byte, s []string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	for _, v := range s {
+		b = appendString(b, v)
+	}
+	return b
+}
+
+func (m *CSLoginReq) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 12)
+	b = appendString(b, m.Version)
+	b = binary.AppendVarint(b, m.Timestamp)
+	b = appendString(b, m.LoginKey)
+	b = appendString(b, m.Nonce)
+	b = appendString(b, m.User)
+	b = appendString(b, m.EnrollToken)
+	b = appendString(b, m.ClientId)
+	b = binary.AppendUvarint(b, uint64(m.ProtocolVersion))
+	b = binary.AppendUvarint(b, uint64(m.Capabilities))
+	b = appendString(b, m.Compress)
+	b = appendString(b, m.InstanceId)
+	return appendString(b, m.ResumeToken)
+}
+
+func (m *CSLoginReq) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.Version)
+	r.varint(&m.Timestamp)
+	r.string(&m.LoginKey)
+	r.string(&m.Nonce)
+	r.string(&m.User)
+	r.string(&m.EnrollToken)
+	r.string(&m.ClientId)
+	r.uint32(&m.ProtocolVersion)
+	r.uvarint((*uint64)(&m.Capabilities))
+	r.string(&m.Compress)
+	r.string(&m.InstanceId)
+	r.string(&m.ResumeToken)
+	return r.err
+}
+
+func (m *SCLoginRsp) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 13)
+	b = appendString(b, m.Version)
+	b = appendString(b, m.SessionKey)
+	b = appendString(b, string(m.RunId))
+	b = appendString(b, m.ClientId)
+	b = appendString(b, m.ClientSecret)
+	b = appendString(b, m.Codec)
+	b = binary.AppendUvarint(b, uint64(m.ProtocolVersion))
+	b = binary.AppendUvarint(b, uint64(m.Capabilities))
+	b = appendString(b, m.Compress)
+	b = appendString(b, m.Error)
+	b = appendString(b, m.ResumeToken)
+	b = appendStrings(b, m.ResumedProxies)
+	return binary.AppendVarint(b, m.Seed)
+}
+
+func (m *SCLoginRsp) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.Version)
+	r.string(&m.SessionKey)
+	r.string((*string)(&m.RunId))
+	r.string(&m.ClientId)
+	r.string(&m.ClientSecret)
+	r.string(&m.Codec)
+	r.uint32(&m.ProtocolVersion)
+	r.uvarint((*uint64)(&m.Capabilities))
+	r.string(&m.Compress)
+	r.string(&m.Error)
+	r.string(&m.ResumeToken)
+	r.strings(&m.ResumedProxies)
+	r.varint(&m.Seed)
+	return r.err
+}
+
+func (m *CSPingReq) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 2)
+	b = binary.AppendVarint(b, m.ClientTimestamp)
+	return binary.AppendVarint(b, m.Rtt)
+}
+
+func (m *CSPingReq) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.varint(&m.ClientTimestamp)
+	r.varint(&m.Rtt)
+	return r.err
+}
+
+func (m *SCPingRsp) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 2)
+	b = binary.AppendVarint(b, m.ClientTimestamp)
+	return binary.AppendVarint(b, m.ServerTimestamp)
+}
+
+func (m *SCPingRsp) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.varint(&m.ClientTimestamp)
+	r.varint(&m.ServerTimestamp)
+	return r.err
+}
+
+func (m *SCAddWorkConnReq) appendBinary(b []byte) []byte {
+	return binary.AppendUvarint(b, 0)
+}
+
+func (m *SCAddWorkConnReq) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	return r.err
+}
+
+func (m *CSAddWorkConnRsp) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 4)
+	b = appendString(b, string(m.RunId))
+	b = binary.AppendVarint(b, m.Timestamp)
+	b = appendString(b, m.LoginKey)
+	return appendString(b, m.Nonce)
+}
+
+func (m *CSAddWorkConnRsp) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string((*string)(&m.RunId))
+	r.varint(&m.Timestamp)
+	r.string(&m.LoginKey)
+	r.string(&m.Nonce)
+	return r.err
+}
+
+func (m *CSNewProxyReq) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 9)
+	b = appendString(b, m.ProxyName)
+	b = appendString(b, m.ProxyType)
+	b = binary.AppendVarint(b, int64(m.RemotePort))
+	b = appendStrings(b, m.CustomDomains)
+	b = binary.AppendVarint(b, m.BandwidthLimit)
+	b = binary.AppendVarint(b, m.QuotaLimit)
+	b = appendString(b, m.QuotaPeriod)
+	b = appendStrings(b, m.AllowIPs)
+	return appendStrings(b, m.DenyIPs)
+}
+
+func (m *CSNewProxyReq) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.ProxyName)
+	r.string(&m.ProxyType)
+	r.int(&m.RemotePort)
+	r.strings(&m.CustomDomains)
+	r.varint(&m.BandwidthLimit)
+	r.varint(&m.QuotaLimit)
+	r.string(&m.QuotaPeriod)
+	r.strings(&m.AllowIPs)
+	r.strings(&m.DenyIPs)
+	return r.err
+}
+
+func (m *SCNewProxyRsp) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 3)
+	b = appendString(b, m.ProxyName)
+	b = binary.AppendVarint(b, int64(m.RemotePort))
+	return appendString(b, m.Error)
+}
+
+func (m *SCNewProxyRsp) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.ProxyName)
+	r.int(&m.RemotePort)
+	r.string(&m.Error)
+	return r.err
+}
+
+func (m *CSCloseProxyReq) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 1)
+	return appendString(b, m.ProxyName)
+}
+
+func (m *CSCloseProxyReq) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.ProxyName)
+	return r.err
+}
+
+func (m *CSLogoutReq) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 1)
+	return appendString(b, m.Reason)
+}
+
+func (m *CSLogoutReq) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.Reason)
+	return r.err
+}
+
+func (m *SCKickNotify) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 3)
+	b = binary.AppendUvarint(b, uint64(m.Code))
+	b = appendString(b, m.Reason)
+	return binary.AppendVarint(b, m.ReconnectDelay)
+}
+
+func (m *SCKickNotify) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.uint32((*uint32)(&m.Code))
+	r.string(&m.Reason)
+	r.varint(&m.ReconnectDelay)
+	return r.err
+}
+
+func (m *SCGoingAwayNotify) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 2)
+	b = appendString(b, m.Reason)
+	return binary.AppendVarint(b, m.ReconnectDelay)
+}
+
+func (m *SCGoingAwayNotify) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.Reason)
+	r.varint(&m.ReconnectDelay)
+	return r.err
+}
+
+func (m *SCStartWorkConn) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 3)
+	b = appendString(b, m.ProxyName)
+	b = appendString(b, m.SrcAddr)
+	return appendString(b, m.DstAddr)
+}
+
+func (m *SCStartWorkConn) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.ProxyName)
+	r.string(&m.SrcAddr)
+	r.string(&m.DstAddr)
+	return r.err
+}
+
+func (m *CSUpdateProxyIPsReq) appendBinary(b []byte) []byte {
+	b = binary.AppendUvarint(b, 3)
+	b = appendString(b, m.ProxyName)
+	b = appendStrings(b, m.AllowIPs)
+	return appendStrings(b, m.DenyIPs)
+}
+
+func (m *CSUpdateProxyIPsReq) decodeBinary(b []byte) error {
+	r := newBinaryReader(b)
+	r.string(&m.ProxyName)
+	r.strings(&m.AllowIPs)
+	r.strings(&m.DenyIPs)
+	return r.err
+}
@@ -0,0 +1,193 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// sampleMessages one filled message of every registered type, sorted by cmd id
+func sampleMessages(tb testing.TB) []Message {
+	tb.Helper()
+	cmds := make([]int, 0, len(msgCmdMap))
+	for cmd := range msgCmdMap {
+		cmds = append(cmds, int(cmd))
+	}
+	sort.Ints(cmds)
+	messages := make([]Message, 0, len(cmds))
+	for _, cmd := range cmds {
+		v := reflect.New(msgCmdMap[uint16(cmd)])
+		fillSample(v.Elem())
+		messages = append(messages, v.Interface())
+	}
+	return messages
+}
+
+func fillSample(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(-12345)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(54321)
+	case reflect.String:
+		v.SetString("0123456789abcdef0123456789abcdef")
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 3, 3)
+		for i := 0; i < s.Len(); i++ {
+			fillSample(s.Index(i))
+		}
+		v.Set(s)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fillSample(v.Field(i))
+			}
+		}
+	}
+}
+
+func messageName(m Message) string {
+	return reflect.TypeOf(m).Elem().Name()
+}
+
+// TestBinaryMessages the hand written coders must write the bytes of the reflect plan
+func TestBinaryMessages(t *testing.T) {
+	for _, m := range sampleMessages(t) {
+		t.Run(messageName(m), func(t *testing.T) {
+			bm, ok := m.(binaryMessage)
+			if !ok {
+				t.Fatalf("no hand written binary coder")
+			}
+			v := reflect.ValueOf(m).Elem()
+			p, err := getBinaryPlan(v.Type())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := p.encode(nil, v)
+			got := bm.appendBinary(nil)
+			if string(got) != string(want) {
+				t.Fatalf("encode mismatch\n got %x\nwant %x", got, want)
+			}
+			out := reflect.New(v.Type()).Interface()
+			if err := BinaryCodec.Unmarshal(got, out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, m) {
+				t.Fatalf("decode mismatch\n got %+v\nwant %+v", out, m)
+			}
+			// truncated bodies are refused exactly like the reflect plan does
+			for n := 0; n < len(got); n++ {
+				herr := BinaryCodec.Unmarshal(got[:n], reflect.New(v.Type()).Interface())
+				_, perr := p.decode(got[:n], reflect.New(v.Type()).Elem())
+				if (herr == nil) != (perr == nil) {
+					t.Fatalf("truncated at %d: err:%v reflect plan err:%v", n, herr, perr)
+				}
+			}
+		})
+	}
+}
+
+// TestBinaryFieldCount fields unknown to either side are skipped or left zero
+func TestBinaryFieldCount(t *testing.T) {
+	m := &CSPingReq{ClientTimestamp: 7, Rtt: 9}
+	b := m.appendBinary(nil)
+
+	// newer peer appended a field
+	newer := binary.AppendUvarint(nil, 3)
+	newer = append(newer, b[1:]...)
+	newer = binary.AppendVarint(newer, 11)
+	got := new(CSPingReq)
+	if err := BinaryCodec.Unmarshal(newer, got); err != nil || *got != *m {
+		t.Fatalf("newer peer: %+v err:%v", got, err)
+	}
+
+	// older peer only knows the first field
+	older := binary.AppendUvarint(nil, 1)
+	older = binary.AppendVarint(older, 7)
+	got = new(CSPingReq)
+	if err := BinaryCodec.Unmarshal(older, got); err != nil || *got != (CSPingReq{ClientTimestamp: 7}) {
+		t.Fatalf("older peer: %+v err:%v", got, err)
+	}
+}
+
+// reflectCodec the reflect plan alone, the binary codec before the hand written coders
+type reflectCodec struct{}
+
+func (reflectCodec) Name() string {
+	return "reflect"
+}
+
+func (reflectCodec) Marshal(message Message) ([]byte, error) {
+	v := reflect.ValueOf(message).Elem()
+	p, err := getBinaryPlan(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	return p.encode(make([]byte, 0, 64), v), nil
+}
+
+func (reflectCodec) Unmarshal(data []byte, message Message) error {
+	v := reflect.ValueOf(message).Elem()
+	p, err := getBinaryPlan(v.Type())
+	if err != nil {
+		return err
+	}
+	_, err = p.decode(data, v)
+	return err
+}
+
+var benchCodecs = []Codec{JsonCodec, reflectCodec{}, BinaryCodec}
+
+func BenchmarkMarshal(b *testing.B) {
+	for _, m := range sampleMessages(b) {
+		for _, codec := range benchCodecs {
+			b.Run(fmt.Sprintf("%s/%s", messageName(m), codec.Name()), func(b *testing.B) {
+				b.ReportAllocs()
+				for b.Loop() {
+					if _, err := codec.Marshal(m); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	for _, m := range sampleMessages(b) {
+		t := reflect.TypeOf(m).Elem()
+		for _, codec := range benchCodecs {
+			data, err := codec.Marshal(m)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/%s", messageName(m), codec.Name()), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				for b.Loop() {
+					if err := codec.Unmarshal(data, reflect.New(t).Interface()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msg
+
+const (
+	// ProtocolVersion control protocol spoken by this build,
+	// 3 made RunId and the session key random 128-bit strings
+	ProtocolVersion uint32 = 3
+	// MinProtocolVersion oldest peer protocol still accepted, features newer
+	// than it are gated on capabilities, see CapSessionKey
+	MinProtocolVersion uint32 = LegacyProtocolVersion
+	// LegacyProtocolVersion peers that send no version, their session is
+	// keyed by an int64 seed and work conns sign with the token key
+	LegacyProtocolVersion uint32 = 1
+)
+
+// Capability optional protocol features, both sides advertise theirs at
+// login and only the shared ones are enabled
+type Capability uint64
+
+const (
+	CapEnvelope Capability = 1 << iota
+	CapCodecBinary
+	CapMux
+	CapCompressGzip
+	CapCompressSnappy
+	CapProxyTcp
+	CapProxyUdp
+	CapProxyHttp
+	CapProxyHttps
+	CapUpdateProxyIPs
+	// CapSessionKey RunId and the session key are random 128-bit strings,
+	// without it the session is keyed by an int64 seed and RunId is a number
+	CapSessionKey
+)
+
+// LocalCapabilities features implemented by this build, udp, http and
+// https proxies have no data plane yet and are not advertised
+const LocalCapabilities = CapEnvelope | CapCodecBinary |
+	CapCompressGzip | CapCompressSnappy |
+	CapProxyTcp |
+	CapUpdateProxyIPs | CapSessionKey
+
+var (
+	capNames = map[Capability]string{
+		CapEnvelope:       "envelope",
+		CapCodecBinary:    "binary",
+		CapMux:            "mux",
+		CapCompressGzip:   "gzip",
+		CapCompressSnappy: "snappy",
+		CapProxyTcp:       "tcp",
+		CapProxyUdp:       "udp",
+		CapProxyHttp:      "http",
+		CapProxyHttps:     "https",
+		CapUpdateProxyIPs: "update-proxy-ips",
+		CapSessionKey:     "session-key",
+	}
+)
+
+func (c Capability) Has(cap Capability) bool {
+	return c&cap == cap
+}
+
+func (c Capability) Names() []string {
+	names := make([]string, 0)
+	for i := 0; i < 64; i++ {
+		bit := Capability(1) << i
+		if c&bit == 0 {
+			continue
+		}
+		if name, ok := capNames[bit]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CapabilityByName compress and proxy type names map to their capability
+func CapabilityByName(name string) (Capability, bool) {
+	for c, n := range capNames {
+		if n == name {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// NegotiateVersion protocol both sides speak, 0 when the peer is too old
+func NegotiateVersion(peer uint32) uint32 {
+	if peer == 0 {
+		peer = LegacyProtocolVersion
+	}
+	if peer < MinProtocolVersion {
+		return 0
+	}
+	return min(peer, ProtocolVersion)
+}
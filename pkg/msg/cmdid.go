@@ -25,6 +25,14 @@ const (
 	scPingRsp
 	scAddWorkConnReq
 	csAddWorkConnRsp
+	csNewProxyReq
+	scNewProxyRsp
+	csCloseProxyReq
+	csLogoutReq
+	scKickNotify
+	scGoingAwayNotify
+	scStartWorkConn
+	csUpdateProxyIPsReq
 )
 
 func init() {
@@ -37,4 +45,12 @@ func init() {
 	RegisterMsg(scPingRsp, SCPingRsp{})
 	RegisterMsg(scAddWorkConnReq, SCAddWorkConnReq{})
 	RegisterMsg(csAddWorkConnRsp, CSAddWorkConnRsp{})
+	RegisterMsg(csNewProxyReq, CSNewProxyReq{})
+	RegisterMsg(scNewProxyRsp, SCNewProxyRsp{})
+	RegisterMsg(csCloseProxyReq, CSCloseProxyReq{})
+	RegisterMsg(csLogoutReq, CSLogoutReq{})
+	RegisterMsg(scKickNotify, SCKickNotify{})
+	RegisterMsg(scGoingAwayNotify, SCGoingAwayNotify{})
+	RegisterMsg(scStartWorkConn, SCStartWorkConn{})
+	RegisterMsg(csUpdateProxyIPsReq, CSUpdateProxyIPsReq{})
 }
@@ -0,0 +1,68 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msg
+
+import (
+	"encoding/json"
+)
+
+const (
+	CodecJson   = "json"
+	CodecBinary = "binary"
+)
+
+var (
+	JsonCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{}
+
+	codecs = map[string]Codec{
+		CodecJson:   JsonCodec,
+		CodecBinary: BinaryCodec,
+	}
+)
+
+// Codec message body encoding, login messages always use JsonCodec
+type Codec interface {
+	Name() string
+	Marshal(message Message) ([]byte, error)
+	Unmarshal(data []byte, message Message) error
+}
+
+func GetCodec(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// NegotiateCodec binary when both sides have it, json otherwise
+func NegotiateCodec(shared Capability) Codec {
+	if shared.Has(CapCodecBinary) {
+		return BinaryCodec
+	}
+	return JsonCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CodecJson
+}
+
+func (jsonCodec) Marshal(message Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Unmarshal(data []byte, message Message) error {
+	return json.Unmarshal(data, message)
+}
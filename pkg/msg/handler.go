@@ -15,60 +15,210 @@
 package msg
 
 import (
+	"context"
+	"errors"
 	"io"
 	"reflect"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gucooing/weiwei/pkg/net"
 )
 
+var (
+	ErrEnvelopeUnsupported = errors.New("peer does not support request envelopes")
+	ErrDispatcherClosed    = errors.New("dispatcher closed")
+	ErrSendQueueFull       = errors.New("dispatcher send queue full")
+)
+
+// QueuePolicy what Send does when the send queue is full
+type QueuePolicy string
+
+const (
+	// QueuePolicyBlock wait for room in the queue
+	QueuePolicyBlock QueuePolicy = "block"
+	// QueuePolicyDrop drop the message and return ErrSendQueueFull
+	QueuePolicyDrop QueuePolicy = "drop"
+	// QueuePolicyDisconnect close the dispatcher with ErrSendQueueFull
+	QueuePolicyDisconnect QueuePolicy = "disconnect"
+
+	defaultQueueSize = 100
+)
+
+type DispatcherOptions struct {
+	QueueSize   int
+	QueuePolicy QueuePolicy
+}
+
+// DispatcherStats counters since the dispatcher was created
+type DispatcherStats struct {
+	QueueDepth    int    `json:"queueDepth"`
+	QueueCap      int    `json:"queueCap"`
+	MaxQueueDepth int64  `json:"maxQueueDepth"`
+	Sent          uint64 `json:"sent"`
+	Received      uint64 `json:"received"`
+	Dropped       uint64 `json:"dropped"`
+	Unknown       uint64 `json:"unknown"`
+}
+
+type outMsg struct {
+	env Envelope
+	msg Message
+	// written closed once msg is on the wire, may be nil
+	written chan struct{}
+}
+
 type Dispatcher struct {
-	conn  net.Conn
-	close bool
+	conn     net.Conn
+	codec    Codec
+	envelope bool
+	policy   QueuePolicy
 
 	doneChan    chan struct{}
-	sendChan    chan Message // send
-	readChan    chan Message // read
+	closeOnce   sync.Once
+	closeErr    error
+	sendChan    chan outMsg // send
 	msgHandlers map[reflect.Type]func(Message)
+	reqHandlers map[reflect.Type]func(Message) Message
+	unknown     func(Message)
+
+	// pending Call waiting for a response by request id
+	reqSeq    uint64 // atomic
+	pendingMu sync.Mutex
+	pending   map[uint64]chan Message
+
+	// counters
+	maxQueueDepth int64  // atomic
+	sent          uint64 // atomic
+	received      uint64 // atomic
+	dropped       uint64 // atomic
+	unknownNum    uint64 // atomic
 }
 
 func NewDispatcher(conn net.Conn) *Dispatcher {
+	return NewDispatcherWithOptions(conn, nil)
+}
+
+func NewDispatcherWithOptions(conn net.Conn, opt *DispatcherOptions) *Dispatcher {
+	queueSize := defaultQueueSize
+	policy := QueuePolicyBlock
+	if opt != nil {
+		if opt.QueueSize > 0 {
+			queueSize = opt.QueueSize
+		}
+		if opt.QueuePolicy != "" {
+			policy = opt.QueuePolicy
+		}
+	}
 	d := &Dispatcher{
 		conn:        conn,
+		codec:       JsonCodec,
+		policy:      policy,
 		doneChan:    make(chan struct{}),
-		sendChan:    make(chan Message, 100),
-		readChan:    make(chan Message, 100),
+		sendChan:    make(chan outMsg, queueSize),
 		msgHandlers: make(map[reflect.Type]func(Message)),
+		reqHandlers: make(map[reflect.Type]func(Message) Message),
+		pending:     make(map[uint64]chan Message),
 	}
 	return d
 }
 
+// SetCodec must be called before Start
+func (d *Dispatcher) SetCodec(codec Codec) {
+	d.codec = codec
+}
+
+func (d *Dispatcher) Codec() Codec {
+	return d.codec
+}
+
+// SetEnvelope enables Call, only when the peer negotiated envelopes at login.
+// Must be called before Start
+func (d *Dispatcher) SetEnvelope(enable bool) {
+	d.envelope = enable
+}
+
+// SetUnknownHandler called for messages without a registered handler.
+// Must be called before Start
+func (d *Dispatcher) SetUnknownHandler(handler func(Message)) {
+	d.unknown = handler
+}
+
 func (d *Dispatcher) Start() {
 	go d.sendThread()
 	go d.readThread()
 }
 
+// Close closes the conn and the dispatcher, the first cause is kept
+func (d *Dispatcher) Close(cause error) {
+	d.closeOnce.Do(func() {
+		if cause == nil {
+			cause = ErrDispatcherClosed
+		}
+		d.closeErr = cause
+		close(d.doneChan)
+		d.conn.Close()
+	})
+}
+
+// Err why the dispatcher was closed, nil while running
+func (d *Dispatcher) Err() error {
+	select {
+	case <-d.doneChan:
+		return d.closeErr
+	default:
+		return nil
+	}
+}
+
 func (d *Dispatcher) sendThread() {
 	for {
 		select {
 		case <-d.doneChan:
 			return
-		case rawMsg := <-d.sendChan:
-			WriteMsg(d.conn, rawMsg)
+		case out := <-d.sendChan:
+			if _, err := WriteEnvelope(d.conn, out.env, out.msg, d.codec); err != nil {
+				d.Close(err)
+				return
+			}
+			atomic.AddUint64(&d.sent, 1)
+			if out.written != nil {
+				close(out.written)
+			}
 		}
 	}
 }
 
 func (d *Dispatcher) readThread() {
 	for {
-		rawMsg, err := ReadMsg(d.conn)
+		env, rawMsg, err := ReadEnvelope(d.conn, d.codec)
 		if err != nil {
-			close(d.doneChan)
+			d.Close(err)
 			return
 		}
-		if handler, ok := d.msgHandlers[reflect.TypeOf(rawMsg).Elem()]; ok {
+		atomic.AddUint64(&d.received, 1)
+		if env.Response {
+			d.pendingMu.Lock()
+			ch, ok := d.pending[env.ReqId]
+			delete(d.pending, env.ReqId)
+			d.pendingMu.Unlock()
+			if ok {
+				ch <- rawMsg
+			}
+			continue
+		}
+		msgType := reflect.TypeOf(rawMsg).Elem()
+		if handler, ok := d.reqHandlers[msgType]; ok {
+			if rsp := handler(rawMsg); rsp != nil {
+				d.send(context.Background(), Envelope{ReqId: env.ReqId, Response: env.ReqId != 0}, rsp)
+			}
+		} else if handler, ok := d.msgHandlers[msgType]; ok {
 			handler(rawMsg)
 		} else {
-			// TODO
+			atomic.AddUint64(&d.unknownNum, 1)
+			if d.unknown != nil {
+				d.unknown(rawMsg)
+			}
 		}
 	}
 }
@@ -77,19 +227,124 @@ func (d *Dispatcher) DoneChan() chan struct{} {
 	return d.doneChan
 }
 
-func (d *Dispatcher) SendChan() chan Message {
-	return d.sendChan
+func (d *Dispatcher) Send(msg Message) error {
+	return d.send(context.Background(), Envelope{}, msg)
 }
 
-func (d *Dispatcher) Send(msg Message) error {
+// SendAndClose sends msg after everything already queued and closes the
+// dispatcher with cause once it is written or ctx is done
+func (d *Dispatcher) SendAndClose(ctx context.Context, msg Message, cause error) error {
+	written := make(chan struct{})
+	err := d.sendOut(ctx, outMsg{msg: msg, written: written})
+	if err == nil {
+		select {
+		case <-written:
+		case <-d.doneChan:
+			err = d.closeErr
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	d.Close(cause)
+	return err
+}
+
+func (d *Dispatcher) send(ctx context.Context, env Envelope, msg Message) error {
+	return d.sendOut(ctx, outMsg{env: env, msg: msg})
+}
+
+func (d *Dispatcher) sendOut(ctx context.Context, out outMsg) error {
 	select {
 	case <-d.doneChan:
 		return io.EOF
-	case d.sendChan <- msg:
+	case d.sendChan <- out:
+		d.updateQueueDepth()
+		return nil
+	default:
+	}
+
+	switch d.policy {
+	case QueuePolicyDrop:
+		atomic.AddUint64(&d.dropped, 1)
+		return ErrSendQueueFull
+	case QueuePolicyDisconnect:
+		atomic.AddUint64(&d.dropped, 1)
+		d.Close(ErrSendQueueFull)
+		return ErrSendQueueFull
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.doneChan:
+		return io.EOF
+	case d.sendChan <- out:
+		d.updateQueueDepth()
 		return nil
 	}
 }
 
+func (d *Dispatcher) updateQueueDepth() {
+	depth := int64(len(d.sendChan))
+	for {
+		max := atomic.LoadInt64(&d.maxQueueDepth)
+		if depth <= max || atomic.CompareAndSwapInt64(&d.maxQueueDepth, max, depth) {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) Stats() DispatcherStats {
+	return DispatcherStats{
+		QueueDepth:    len(d.sendChan),
+		QueueCap:      cap(d.sendChan),
+		MaxQueueDepth: atomic.LoadInt64(&d.maxQueueDepth),
+		Sent:          atomic.LoadUint64(&d.sent),
+		Received:      atomic.LoadUint64(&d.received),
+		Dropped:       atomic.LoadUint64(&d.dropped),
+		Unknown:       atomic.LoadUint64(&d.unknownNum),
+	}
+}
+
+// Call sends req and waits for the response the peer handler returns.
+// Must not be called from a message handler, the read thread would block
+func (d *Dispatcher) Call(ctx context.Context, req Message) (Message, error) {
+	if !d.envelope {
+		return nil, ErrEnvelopeUnsupported
+	}
+	reqId := atomic.AddUint64(&d.reqSeq, 1)
+	ch := make(chan Message, 1)
+	d.pendingMu.Lock()
+	d.pending[reqId] = ch
+	d.pendingMu.Unlock()
+	defer func() {
+		d.pendingMu.Lock()
+		delete(d.pending, reqId)
+		d.pendingMu.Unlock()
+	}()
+
+	if err := d.send(ctx, Envelope{ReqId: reqId}, req); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrDispatcherClosed
+		}
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.doneChan:
+		return nil, ErrDispatcherClosed
+	case rsp := <-ch:
+		return rsp, nil
+	}
+}
+
 func (d *Dispatcher) RegisterMsg(rawMsg Message, handler func(Message)) {
 	d.msgHandlers[reflect.TypeOf(rawMsg).Elem()] = handler
 }
+
+// RegisterRequest handler returns the response, sent back with the request id
+// when the request came in an envelope, plain otherwise
+func (d *Dispatcher) RegisterRequest(rawMsg Message, handler func(Message) Message) {
+	d.reqHandlers[reflect.TypeOf(rawMsg).Elem()] = handler
+}
@@ -16,47 +16,100 @@ package msg
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 
 	"github.com/gucooing/weiwei/pkg/net"
 )
 
 var (
-	msgCmdSize = 2
+	msgCmdSize   = 2
+	msgReqIdSize = 8
 
 	ErrCmdSize = fmt.Errorf("msg cmd size err")
 )
 
+const (
+	// cmdFlagEnvelope the cmd id is followed by a request id
+	cmdFlagEnvelope uint16 = 0x8000
+	// cmdFlagResponse the envelope answers a request of the peer
+	cmdFlagResponse uint16 = 0x4000
+	cmdFlagMask            = cmdFlagEnvelope | cmdFlagResponse
+)
+
+// Envelope request id of a message, zero for plain messages
+type Envelope struct {
+	ReqId    uint64
+	Response bool
+}
+
+// ReadMsg reads a json message, used until a codec is negotiated
 func ReadMsg(conn net.Conn) (message Message, err error) {
-	n, buffer, err := conn.Read()
+	return ReadMsgWith(conn, JsonCodec)
+}
+
+func ReadMsgWith(conn net.Conn, codec Codec) (message Message, err error) {
+	_, message, err = ReadEnvelope(conn, codec)
+	return
+}
+
+func ReadEnvelope(conn net.Conn, codec Codec) (env Envelope, message Message, err error) {
+	_, buffer, err := conn.Read()
 	if err != nil {
-		return nil, err
+		return env, nil, err
 	}
-	if n <= msgCmdSize {
-		return nil, ErrCmdSize
+	if len(buffer) <= msgCmdSize {
+		return env, nil, ErrCmdSize
 	}
 	cmdId := binary.BigEndian.Uint16(buffer[0:msgCmdSize])
-	message, err = GetMessageByCmdId(cmdId)
+	buffer = buffer[msgCmdSize:]
+	if cmdId&cmdFlagEnvelope != 0 {
+		if len(buffer) <= msgReqIdSize {
+			return env, nil, ErrCmdSize
+		}
+		env.ReqId = binary.BigEndian.Uint64(buffer[:msgReqIdSize])
+		env.Response = cmdId&cmdFlagResponse != 0
+		buffer = buffer[msgReqIdSize:]
+	}
+	message, err = GetMessageByCmdId(cmdId &^ cmdFlagMask)
 	if err != nil {
-		return nil, err
+		return env, nil, err
 	}
-	err = json.Unmarshal(buffer[msgCmdSize:], message)
+	err = codec.Unmarshal(buffer, message)
 	return
 }
 
+// WriteMsg writes a json message, used until a codec is negotiated
 func WriteMsg(conn net.Conn, message Message) (n int, err error) {
+	return WriteMsgWith(conn, message, JsonCodec)
+}
+
+func WriteMsgWith(conn net.Conn, message Message, codec Codec) (n int, err error) {
+	return WriteEnvelope(conn, Envelope{}, message, codec)
+}
+
+func WriteEnvelope(conn net.Conn, env Envelope, message Message, codec Codec) (n int, err error) {
 	cmdId, err := GetCmdIdByMessage(message)
 	if err != nil {
 		return 0, err
 	}
-	data, err := json.Marshal(message)
+	data, err := codec.Marshal(message)
 	if err != nil {
 		return 0, err
 	}
-	buffer := make([]byte, msgCmdSize+len(data))
+	headSize := msgCmdSize
+	if env.ReqId != 0 {
+		cmdId |= cmdFlagEnvelope
+		if env.Response {
+			cmdId |= cmdFlagResponse
+		}
+		headSize += msgReqIdSize
+	}
+	buffer := make([]byte, headSize+len(data))
 	binary.BigEndian.PutUint16(buffer[:msgCmdSize], cmdId)
-	copy(buffer[msgCmdSize:], data)
+	if env.ReqId != 0 {
+		binary.BigEndian.PutUint64(buffer[msgCmdSize:headSize], env.ReqId)
+	}
+	copy(buffer[headSize:], data)
 	n, err = conn.Write(buffer)
 	if err != nil {
 		return 0, err
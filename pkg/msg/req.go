@@ -18,11 +18,60 @@ type CSLoginReq struct {
 	Version   string `json:"version,omitempty"`
 	Timestamp int64  `json:"timestamp,omitempty"`
 	LoginKey  string `json:"loginKey,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	User      string `json:"user,omitempty"`
+	// EnrollToken enrollment token id, the login key is signed with its secret
+	EnrollToken string `json:"enrollToken,omitempty"`
+	// ClientId enrolled weic, the login key is signed with its credential
+	ClientId string `json:"clientId,omitempty"`
+	// ProtocolVersion weic protocol, 0 for legacy weic
+	ProtocolVersion uint32 `json:"protocolVersion,omitempty"`
+	// Capabilities features weic wants to use
+	Capabilities Capability `json:"capabilities,omitempty"`
+	// Compress preferred control conn compression, needs the capability
+	Compress string `json:"compress,omitempty"`
+	// InstanceId stable weic identity across reconnects
+	InstanceId string `json:"instanceId,omitempty"`
+	// ResumeToken from the last SCLoginRsp, resumes that session
+	ResumeToken string `json:"resumeToken,omitempty"`
 }
 
 type CSPingReq struct {
 	ClientTimestamp int64 `json:"clientTimestamp,omitempty"`
+	// Rtt round trip of the last ping measured by weic, nanoseconds
+	Rtt int64 `json:"rtt,omitempty"`
 }
 
 type SCAddWorkConnReq struct {
 }
+
+type CSNewProxyReq struct {
+	ProxyName     string   `json:"proxyName,omitempty"`
+	ProxyType     string   `json:"proxyType,omitempty"`
+	RemotePort    int      `json:"remotePort,omitempty"`
+	CustomDomains []string `json:"customDomains,omitempty"`
+	// BandwidthLimit bytes per second each way weis enforces, 0 when weic does or there is none
+	BandwidthLimit int64 `json:"bandwidthLimit,omitempty"`
+	// QuotaLimit bytes per QuotaPeriod weis enforces, 0 is unlimited
+	QuotaLimit  int64  `json:"quotaLimit,omitempty"`
+	QuotaPeriod string `json:"quotaPeriod,omitempty"`
+	// AllowIPs and DenyIPs rules weis checks users against at accept
+	AllowIPs []string `json:"allowIPs,omitempty"`
+	DenyIPs  []string `json:"denyIPs,omitempty"`
+}
+
+// CSUpdateProxyIPsReq replaces the ip rules of a proxy after weic reloaded them
+type CSUpdateProxyIPsReq struct {
+	ProxyName string   `json:"proxyName,omitempty"`
+	AllowIPs  []string `json:"allowIPs,omitempty"`
+	DenyIPs   []string `json:"denyIPs,omitempty"`
+}
+
+type CSCloseProxyReq struct {
+	ProxyName string `json:"proxyName,omitempty"`
+}
+
+// CSLogoutReq weic is leaving, weis closes the control without waiting for a timeout
+type CSLogoutReq struct {
+	Reason string `json:"reason,omitempty"`
+}
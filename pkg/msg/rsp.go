@@ -14,10 +14,36 @@
 
 package msg
 
+import (
+	"encoding/json"
+	"strconv"
+)
+
 type SCLoginRsp struct {
 	Version string `json:"version,omitempty"`
-	Seed    int64  `json:"seed,omitempty"`
-	RunId   int64  `json:"runId,omitempty"`
+	// SessionKey random 128-bit key, hex encoded, keys the control crypt and work conn auth
+	SessionKey string `json:"sessionKey,omitempty"`
+	// RunId random 128-bit session id, hex encoded
+	RunId SessionId `json:"runId,omitempty"`
+	// ClientId and ClientSecret the credential issued on enrollment
+	ClientId     string `json:"clientId,omitempty"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// Codec control message codec, json when empty
+	Codec string `json:"codec,omitempty"`
+	// ProtocolVersion negotiated protocol
+	ProtocolVersion uint32 `json:"protocolVersion,omitempty"`
+	// Capabilities features enabled on both sides
+	Capabilities Capability `json:"capabilities,omitempty"`
+	// Compress control conn compression after this message, none when empty
+	Compress string `json:"compress,omitempty"`
+	// Error login refused, the conn is closed after this message
+	Error string `json:"error,omitempty"`
+	// ResumeToken resumes this session on the next login
+	ResumeToken string `json:"resumeToken,omitempty"`
+	// ResumedProxies proxies kept from the resumed session, weic does not add them again
+	ResumedProxies []string `json:"resumedProxies,omitempty"`
+	// Seed keys the session instead of SessionKey when CapSessionKey is not shared
+	Seed int64 `json:"seed,omitempty"`
 }
 
 type SCPingRsp struct {
@@ -26,7 +52,95 @@ type SCPingRsp struct {
 }
 
 type CSAddWorkConnRsp struct {
-	RunId     int64  `json:"runId,omitempty"`
-	Timestamp int64  `json:"timestamp,omitempty"`
-	LoginKey  string `json:"loginKey,omitempty"`
+	RunId     SessionId `json:"runId,omitempty"`
+	Timestamp int64     `json:"timestamp,omitempty"`
+	LoginKey  string    `json:"loginKey,omitempty"`
+	Nonce     string    `json:"nonce,omitempty"`
+}
+
+// SessionId RunId on the wire, a numeric id of a session without
+// CapSessionKey is a json number as protocol 2 peers expect
+type SessionId string
+
+func (s SessionId) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.ParseInt(string(s), 10, 64); err == nil {
+		return []byte(s), nil
+	}
+	return json.Marshal(string(s))
+}
+
+func (s *SessionId) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '"' {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*s = SessionId(strconv.FormatInt(n, 10))
+		return nil
+	}
+	return json.Unmarshal(data, (*string)(s))
+}
+
+type SCNewProxyRsp struct {
+	ProxyName  string `json:"proxyName,omitempty"`
+	RemotePort int    `json:"remotePort,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// KickCode why weis closed the control
+type KickCode uint32
+
+const (
+	KickUnknown KickCode = iota
+	KickAuthRevoked
+	KickDuplicateLogin
+	KickServerShutdown
+	KickQuotaExceeded
+	KickAdmin
+)
+
+var kickCodeNames = map[KickCode]string{
+	KickUnknown:        "unknown",
+	KickAuthRevoked:    "auth revoked",
+	KickDuplicateLogin: "duplicate login",
+	KickServerShutdown: "server shutdown",
+	KickQuotaExceeded:  "quota exceeded",
+	KickAdmin:          "kicked by admin",
+}
+
+func (k KickCode) String() string {
+	if name, ok := kickCodeNames[k]; ok {
+		return name
+	}
+	return kickCodeNames[KickUnknown]
+}
+
+// Fatal weic should not log in again after this kick
+func (k KickCode) Fatal() bool {
+	return k == KickAuthRevoked || k == KickDuplicateLogin
+}
+
+// SCKickNotify weis closes the control right after this message
+type SCKickNotify struct {
+	Code   KickCode `json:"code"`
+	Reason string   `json:"reason,omitempty"`
+	// ReconnectDelay seconds, 0 leaves it to the weic backoff
+	ReconnectDelay int64 `json:"reconnectDelay,omitempty"`
+}
+
+// SCGoingAwayNotify weis is shutting down, no new work is started on the
+// control and weic should log in again after ReconnectDelay seconds
+type SCGoingAwayNotify struct {
+	Reason         string `json:"reason,omitempty"`
+	ReconnectDelay int64  `json:"reconnectDelay,omitempty"`
+}
+
+// SCStartWorkConn sent on a work conn for a user conn, the work conn is a
+// byte stream to the proxy local service after it
+type SCStartWorkConn struct {
+	ProxyName string `json:"proxyName,omitempty"`
+	// SrcAddr user address
+	SrcAddr string `json:"srcAddr,omitempty"`
+	// DstAddr weis address the user connected to
+	DstAddr string `json:"dstAddr,omitempty"`
 }
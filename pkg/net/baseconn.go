@@ -15,31 +15,46 @@
 package net
 
 import (
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gucooing/weiwei/pkg/util/compress"
 	"github.com/gucooing/weiwei/pkg/util/crypt"
 )
 
+const (
+	// DefaultMaxFrameSize largest frame a conn reads unless set otherwise
+	DefaultMaxFrameSize = 1 << 20
+	// PreAuthMaxFrameSize largest frame read before the peer is authenticated
+	PreAuthMaxFrameSize = 64 << 10
+)
+
 type baseConn struct {
-	crypt     crypt.Crypt
-	compress  compress.Compress
-	bufPool   sync.Pool
-	createdAt time.Time
+	crypt        crypt.Crypt
+	compress     compress.Compress
+	maxFrameSize atomic.Int64
+	createdAt    time.Time
+	// plain decompressed frame returned by the last BaseRead, back to the
+	// pool on the next one
+	plain *[]byte
 }
 
 func newBaseConn() *baseConn {
 	b := &baseConn{
 		crypt:     crypt.CryptNone,
 		compress:  compress.CompressNone,
-		bufPool:   sync.Pool{},
 		createdAt: time.Now(),
 	}
+	b.maxFrameSize.Store(DefaultMaxFrameSize)
 
 	return b
 }
 
+// SetMaxFrameSize larger frames fail the read with ErrFrameTooLarge
+func (b *baseConn) SetMaxFrameSize(size int) {
+	b.maxFrameSize.Store(int64(size))
+}
+
 func (b *baseConn) SetCrypt(crypt crypt.Crypt) {
 	b.crypt = crypt
 }
@@ -52,8 +67,14 @@ func (b *baseConn) CreatedAt() time.Time {
 	return b.createdAt
 }
 
+// BaseRead decompresses and decrypts a frame, the result is only valid
+// until the next BaseRead
 func (b *baseConn) BaseRead(data []byte) (buffer []byte, err error) {
-	unZipBuffer, err := b.compress.Decompress(data)
+	if b.plain != nil {
+		b.putBuffer(b.plain)
+		b.plain = nil
+	}
+	unZipBuffer, err := b.decompress(data)
 	if err != nil {
 		return
 	}
@@ -64,6 +85,30 @@ func (b *baseConn) BaseRead(data []byte) (buffer []byte, err error) {
 	return
 }
 
+// decompress into a pooled buffer when the size is known up front, it is
+// bounded by the max frame size like the compressed frame
+func (b *baseConn) decompress(data []byte) ([]byte, error) {
+	sized, ok := b.compress.(compress.Sized)
+	if !ok {
+		return b.compress.Decompress(data)
+	}
+	n, err := sized.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > b.maxFrameSize.Load() {
+		return nil, ErrFrameTooLarge
+	}
+	bp := b.getBuffer(n)
+	out, err := sized.DecompressInto(*bp, data)
+	if err != nil {
+		b.putBuffer(bp)
+		return nil, err
+	}
+	b.plain = bp
+	return out, nil
+}
+
 func (b *baseConn) BaseWrite(data []byte) (buffer []byte, err error) {
 	enBuffer, err := b.crypt.Encryption(data)
 	if err != nil {
@@ -76,13 +121,10 @@ func (b *baseConn) BaseWrite(data []byte) (buffer []byte, err error) {
 	return
 }
 
-func (b *baseConn) getBuffer(size int) []byte {
-	if buf, ok := b.bufPool.Get().([]byte); ok && cap(buf) >= size {
-		return buf[:size]
-	}
-	return make([]byte, size)
+func (b *baseConn) getBuffer(size int) *[]byte {
+	return getBuf(size)
 }
 
-func (b *baseConn) putBuffer(buf []byte) {
-	b.bufPool.Put(buf)
+func (b *baseConn) putBuffer(buf *[]byte) {
+	putBuf(buf)
 }
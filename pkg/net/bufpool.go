@@ -0,0 +1,61 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minBufShift = 9  // 512 B
+	maxBufShift = 24 // 16 MiB
+)
+
+// bufPools one pool per power of two size, they hold *[]byte so Put does
+// not allocate
+var bufPools [maxBufShift - minBufShift + 1]sync.Pool
+
+func bufClass(size int) int {
+	if size <= 1<<minBufShift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minBufShift
+}
+
+// getBuf buffer of len size, sizes above the largest class are not pooled
+func getBuf(size int) *[]byte {
+	class := bufClass(size)
+	if class >= len(bufPools) {
+		b := make([]byte, size)
+		return &b
+	}
+	if bp, ok := bufPools[class].Get().(*[]byte); ok {
+		*bp = (*bp)[:size]
+		return bp
+	}
+	b := make([]byte, size, 1<<(class+minBufShift))
+	return &b
+}
+
+func putBuf(bp *[]byte) {
+	c := cap(*bp)
+	class := bufClass(c)
+	// only buffers made by getBuf, their cap is exactly the class size
+	if class >= len(bufPools) || c != 1<<(class+minBufShift) {
+		return
+	}
+	bufPools[class].Put(bp)
+}
@@ -23,6 +23,7 @@ import (
 )
 
 type Conn interface {
+	// Read one frame, b is only valid until the next Read
 	Read() (n int, b []byte, err error)
 	Write(b []byte) (n int, err error)
 	Close() error
@@ -32,4 +33,14 @@ type Conn interface {
 	SetCrypt(crypt crypt.Crypt)
 	SetCompress(compress compress.Compress)
 	CreatedAt() time.Time
+	// SetMaxFrameSize larger frames fail the read with ErrFrameTooLarge
+	SetMaxFrameSize(size int)
+	// Probe nil while the peer has not closed an idle conn
+	Probe() error
+
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	// CloseWrite half-close, the peer reads EOF after the frames already sent
+	CloseWrite() error
 }
@@ -0,0 +1,49 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Join copies between a and b until both directions are done. A direction
+// that ends half-closes its destination so the other one can finish, then
+// both are closed. in counts bytes from a to b, out from b to a
+func Join(a, b net.Conn) (in, out int64, err error) {
+	var wg sync.WaitGroup
+	var inErr, outErr error
+	pipe := func(dst, src net.Conn, n *int64, perr *error) {
+		defer wg.Done()
+		*n, *perr = io.Copy(dst, src)
+		if errors.Is(*perr, net.ErrClosed) {
+			*perr = nil
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); !ok || cw.CloseWrite() != nil {
+			// no half-close, the other direction would never end
+			dst.Close()
+			src.Close()
+		}
+	}
+	wg.Add(2)
+	go pipe(b, a, &in, &inErr)
+	go pipe(a, b, &out, &outErr)
+	wg.Wait()
+	a.Close()
+	b.Close()
+	return in, out, errors.Join(inErr, outErr)
+}
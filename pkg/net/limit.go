@@ -0,0 +1,122 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"context"
+	"net"
+
+	"github.com/gucooing/weiwei/pkg/util/limit"
+)
+
+// LimitConn waits on token buckets for what it reads and writes, every
+// limiter of a direction has to let the bytes pass
+type LimitConn struct {
+	net.Conn
+	read   []*limit.Limiter
+	write  []*limit.Limiter
+	burst  int
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewLimitConn nil limiters are skipped, conn is returned as is without any
+func NewLimitConn(conn net.Conn, read, write []*limit.Limiter) net.Conn {
+	read, write = compactLimiters(read), compactLimiters(write)
+	if len(read) == 0 && len(write) == 0 {
+		return conn
+	}
+	burst := 0
+	for _, l := range append(read[:len(read):len(read)], write...) {
+		if burst == 0 || l.Burst() < burst {
+			burst = l.Burst()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LimitConn{
+		Conn:   conn,
+		read:   read,
+		write:  write,
+		burst:  burst,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func compactLimiters(limiters []*limit.Limiter) []*limit.Limiter {
+	out := limiters[:0:0]
+	for _, l := range limiters {
+		if l != nil {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func (c *LimitConn) wait(limiters []*limit.Limiter, n int) error {
+	for _, l := range limiters {
+		if err := l.WaitN(c.ctx, n); err != nil {
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
+
+func (c *LimitConn) Read(p []byte) (int, error) {
+	if len(c.read) > 0 && len(p) > c.burst {
+		p = p[:c.burst]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 && len(c.read) > 0 {
+		// paid after the read, the next one waits
+		if werr := c.wait(c.read, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *LimitConn) Write(p []byte) (int, error) {
+	if len(c.write) == 0 {
+		return c.Conn.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), c.burst)]
+		if err := c.wait(c.write, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close also ends the waits
+func (c *LimitConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *LimitConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
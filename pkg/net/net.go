@@ -20,4 +20,6 @@ import (
 
 var (
 	ErrNetWorkNu = errors.New("network unknown")
+
+	errUnexpectedRead = errors.New("unexpected read from idle conn")
 )
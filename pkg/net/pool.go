@@ -17,11 +17,19 @@ package net
 import (
 	"context"
 	"errors"
+	"math"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
+const (
+	poolTick = time.Second
+	// prewarmAhead idle conns cover the user conns expected this far ahead
+	prewarmAhead = 2 * time.Second
+	// rateSmoothing weight of the last tick in the user conn rate
+	rateSmoothing = 0.3
+)
+
 var (
 	ErrClosed        = errors.New("pool is closed")
 	ErrPoolExhausted = errors.New("connection pool exhausted")
@@ -31,213 +39,299 @@ var (
 type Pooler interface {
 	AddConn(conn Conn) error
 	Get(ctx context.Context) (Conn, error)
+	Stats() PoolStats
 	Close() error
 }
 
 type Options struct {
+	// Dialer asks for one more conn, it arrives later through AddConn
 	Dialer func(ctx context.Context) error
 
-	PoolSize        int
-	DialTimeout     time.Duration
+	// MinIdle idle conns kept without demand
+	MinIdle int
+	// MaxIdle idle conns kept at most, prewarming never goes above it
+	MaxIdle int
+	// IdleTimeout idle conns are closed after it, 0 keeps them
+	IdleTimeout time.Duration
+	// ConnMaxLifetime conns older than it are not handed out, 0 no limit
 	ConnMaxLifetime time.Duration
+	// DialTimeout how long a requested conn and a waiting Get may take
+	DialTimeout time.Duration
 }
 
-type ConnPool struct {
-	cfg *Options
-
-	queue    chan struct{}
-	connsMu  sync.Mutex
-	conns    []Conn
-	poolSize int
-
-	_closed uint32 // atomic
-}
-
-func NewConnPool(opt *Options) *ConnPool {
-	p := &ConnPool{
-		cfg: opt,
-
-		queue:    make(chan struct{}, opt.PoolSize),
-		conns:    make([]Conn, 0, opt.PoolSize),
-		poolSize: 0,
-	}
-
-	p.connsMu.Lock()
-	p.checkMinIdleConns()
-	p.connsMu.Unlock()
-
-	return p
+// PoolStats counters since the pool was created
+type PoolStats struct {
+	Idle     int     `json:"idle"`
+	Pending  int     `json:"pending"`
+	Waiters  int     `json:"waiters"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	Timeouts uint64  `json:"timeouts"`
+	Stale    uint64  `json:"stale"`
+	Rate     float64 `json:"rate"`
 }
 
-func (p *ConnPool) closed() bool {
-	return atomic.LoadUint32(&p._closed) == 1
+type idleConn struct {
+	conn   Conn
+	idleAt time.Time
 }
 
-func (p *ConnPool) checkMinIdleConns() {
-	if p.cfg.PoolSize-p.poolSize <= 0 {
-		return
-	}
-
-	for i := 0; i < p.cfg.PoolSize-p.poolSize; i++ {
-		err := p._addConn()
-		if err != nil && !errors.Is(err, ErrClosed) {
+type ConnPool struct {
+	cfg *Options
 
-		}
-	}
+	mu      sync.Mutex
+	idle    []idleConn  // newest last
+	pending []time.Time // requested conns not arrived yet, oldest first
+	waiters []chan Conn // Get calls waiting for a conn, oldest first
+	gets    int         // Get calls this tick
+	rate    float64     // Get calls per second, smoothed
+	stats   PoolStats   // counters
+	closed  bool
+	done    chan struct{}
 }
 
-func (p *ConnPool) _addConn() error {
-	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.DialTimeout)
-	defer cancel()
-
-	err := p.cfg.Dialer(ctx)
-	if err != nil {
-		return err
+func NewConnPool(opt *Options) *ConnPool {
+	if opt.MaxIdle < opt.MinIdle {
+		opt.MaxIdle = opt.MinIdle
 	}
-
-	if p.closed() {
-		return ErrClosed
+	p := &ConnPool{
+		cfg:  opt,
+		idle: make([]idleConn, 0, opt.MaxIdle),
+		done: make(chan struct{}),
 	}
+	p.mu.Lock()
+	n := p.refill()
+	p.mu.Unlock()
+	p.dial(n)
 
-	return nil
+	go p.janitor()
+	return p
 }
 
+// AddConn a requested conn arrived, it goes to a waiting Get first
 func (p *ConnPool) AddConn(conn Conn) error {
-	if p.closed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
 		conn.Close()
 		return ErrClosed
 	}
-
-	p.connsMu.Lock()
-	defer p.connsMu.Unlock()
-	if p.poolSize >= p.cfg.PoolSize {
+	if len(p.pending) > 0 {
+		p.pending = p.pending[1:]
+	}
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		ch <- conn
+		return nil
+	}
+	if len(p.idle) >= p.cfg.MaxIdle {
 		conn.Close()
 		return ErrPoolExhausted
 	}
-
-	p.conns = append(p.conns, conn)
-	p.poolSize++
-	p.freeTurn()
+	p.idle = append(p.idle, idleConn{conn: conn, idleAt: time.Now()})
 	return nil
 }
 
+// Get newest healthy idle conn, or waits up to DialTimeout for a new one
 func (p *ConnPool) Get(ctx context.Context) (Conn, error) {
-	if p.closed() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
 		return nil, ErrClosed
 	}
-	if err := p.waitTurn(ctx); err != nil {
-		return nil, err
-	}
-
-	p.connsMu.Lock()
-	defer p.connsMu.Unlock()
-
-	for {
-		conn, err := p.popConn()
-		if err != nil {
-			return nil, err
+	p.gets++
+	for len(p.idle) > 0 {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		if p.isHealthyConn(ic.conn) {
+			p.mu.Lock()
+			p.stats.Hits++
+			n := p.refill()
+			p.mu.Unlock()
+			p.dial(n)
+			return ic.conn, nil
 		}
-
-		if conn == nil {
-			p._addConn()
-			return nil, ErrPoolExhausted
-		}
-
-		p.freeTurn()
-
-		if !p.isHealthyConn(conn) {
-			conn.Close()
+		ic.conn.Close()
+		p.mu.Lock()
+		p.stats.Stale++
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrClosed
 		}
-
-		return conn, err
 	}
-}
+	p.stats.Misses++
+	ch := make(chan Conn, 1)
+	p.waiters = append(p.waiters, ch)
+	n := p.refill()
+	p.mu.Unlock()
+	p.dial(n)
 
-func (p *ConnPool) waitTurn(ctx context.Context) error {
+	timer := time.NewTimer(p.cfg.DialTimeout)
+	defer timer.Stop()
+	var err error
 	select {
+	case conn, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return conn, nil
 	case <-ctx.Done():
-		return ctx.Err()
-	default:
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrPoolTimeout
 	}
 
+	p.mu.Lock()
+	p.removeWaiter(ch)
+	p.mu.Unlock()
+	// handed over while giving up
 	select {
-	case p.queue <- struct{}{}:
-		return nil
+	case conn, ok := <-ch:
+		if ok {
+			return conn, nil
+		}
 	default:
 	}
+	p.mu.Lock()
+	p.stats.Timeouts++
+	p.mu.Unlock()
+	return nil, err
+}
 
-	// add
-	err := p._addConn()
-	if err != nil {
-		return err
-	}
-
-	timer := time.NewTimer(p.cfg.DialTimeout)
-	defer timer.Stop()
-
-	select {
-	case <-ctx.Done():
-		if !timer.Stop() {
-			<-timer.C
+func (p *ConnPool) removeWaiter(ch chan Conn) {
+	for i, w := range p.waiters {
+		if w == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
 		}
-		return ctx.Err()
-	case p.queue <- struct{}{}:
-		return nil
-	case <-timer.C:
-		return ErrPoolTimeout
 	}
 }
 
-func (p *ConnPool) freeTurn() {
-	<-p.queue
-}
-
-func (p *ConnPool) popConn() (conn Conn, err error) {
-	if p.closed() {
-		return nil, ErrClosed
+// refill how many conns to request so idle conns follow the demand,
+// it must hold p.mu and call dial after unlocking
+func (p *ConnPool) refill() int {
+	if p.closed {
+		return 0
 	}
+	want := int(math.Ceil(p.rate * prewarmAhead.Seconds()))
+	want = min(max(want, p.cfg.MinIdle), p.cfg.MaxIdle)
+	need := want + len(p.waiters) - len(p.idle) - len(p.pending)
+	if need <= 0 {
+		return 0
+	}
+	now := time.Now()
+	for i := 0; i < need; i++ {
+		p.pending = append(p.pending, now)
+	}
+	return need
+}
 
-	n := len(p.conns)
-	if n == 0 {
-		return nil, nil
+func (p *ConnPool) dial(n int) {
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), p.cfg.DialTimeout)
+		err := p.cfg.Dialer(ctx)
+		cancel()
+		if err != nil {
+			// the rest are not requested either
+			p.mu.Lock()
+			p.pending = p.pending[:max(len(p.pending)-(n-i), 0)]
+			p.mu.Unlock()
+			return
+		}
 	}
+}
 
-	index := n - 1
-	cn := p.conns[index]
+// janitor updates the demand, drops idle timed out conns and requests
+// that never arrived, then refills
+func (p *ConnPool) janitor() {
+	ticker := time.NewTicker(poolTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
 
-	p.conns = p.conns[:index]
-	p.poolSize--
+		now := time.Now()
+		var stale []Conn
+		p.mu.Lock()
+		p.rate = p.rate*(1-rateSmoothing) + float64(p.gets)/poolTick.Seconds()*rateSmoothing
+		p.gets = 0
+		idle := p.idle[:0]
+		for _, ic := range p.idle {
+			if p.expired(ic, now) {
+				stale = append(stale, ic.conn)
+				continue
+			}
+			idle = append(idle, ic)
+		}
+		clear(p.idle[len(idle):])
+		p.idle = idle
+		p.stats.Stale += uint64(len(stale))
+		for len(p.pending) > 0 && now.Sub(p.pending[0]) > p.cfg.DialTimeout {
+			p.pending = p.pending[1:]
+		}
+		n := p.refill()
+		p.mu.Unlock()
 
-	p.checkMinIdleConns()
+		for _, conn := range stale {
+			conn.Close()
+		}
+		p.dial(n)
+	}
+}
 
-	return cn, nil
+func (p *ConnPool) expired(ic idleConn, now time.Time) bool {
+	if p.cfg.IdleTimeout > 0 && now.Sub(ic.idleAt) >= p.cfg.IdleTimeout {
+		return true
+	}
+	return p.cfg.ConnMaxLifetime > 0 && now.Sub(ic.conn.CreatedAt()) >= p.cfg.ConnMaxLifetime
 }
 
+// isHealthyConn lifetime and an active probe of the socket
 func (p *ConnPool) isHealthyConn(cn Conn) bool {
-	now := time.Now()
-
-	if p.cfg.ConnMaxLifetime > 0 && now.Sub(cn.CreatedAt()) >= p.cfg.ConnMaxLifetime {
+	if p.cfg.ConnMaxLifetime > 0 && time.Since(cn.CreatedAt()) >= p.cfg.ConnMaxLifetime {
 		return false
 	}
+	return cn.Probe() == nil
+}
 
-	return true
+func (p *ConnPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Idle = len(p.idle)
+	s.Pending = len(p.pending)
+	s.Waiters = len(p.waiters)
+	s.Rate = p.rate
+	return s
 }
 
 func (p *ConnPool) Close() error {
-	if !atomic.CompareAndSwapUint32(&p._closed, 0, 1) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
 		return ErrClosed
 	}
+	p.closed = true
+	close(p.done)
+	idle := p.idle
+	p.idle = nil
+	for _, ch := range p.waiters {
+		close(ch)
+	}
+	p.waiters = nil
+	p.pending = nil
+	p.mu.Unlock()
 
 	var firstErr error
-	p.connsMu.Lock()
-	for _, conn := range p.conns {
-		if err := conn.Close(); err != nil {
+	for _, ic := range idle {
+		if err := ic.conn.Close(); err != nil && firstErr == nil {
 			firstErr = err
 		}
 	}
-	p.conns = nil
-	p.poolSize = 0
-	p.connsMu.Unlock()
-
 	return firstErr
 }
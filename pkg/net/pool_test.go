@@ -0,0 +1,231 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gucooing/weiwei/pkg/util/compress"
+	"github.com/gucooing/weiwei/pkg/util/crypt"
+)
+
+// fakeConn a work conn whose probe fails once it is closed or dead
+type fakeConn struct {
+	createdAt time.Time
+	dead      atomic.Bool
+	closed    atomic.Bool
+	taken     atomic.Bool
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{createdAt: time.Now()}
+}
+
+func (c *fakeConn) Read() (int, []byte, error)       { return 0, nil, errors.New("fake conn") }
+func (c *fakeConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c *fakeConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *fakeConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *fakeConn) SetCrypt(crypt.Crypt)             {}
+func (c *fakeConn) SetCompress(compress.Compress)    {}
+func (c *fakeConn) CreatedAt() time.Time             { return c.createdAt }
+func (c *fakeConn) SetMaxFrameSize(int)              {}
+func (c *fakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *fakeConn) CloseWrite() error                { return nil }
+
+func (c *fakeConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func (c *fakeConn) Probe() error {
+	if c.closed.Load() || c.dead.Load() {
+		return errors.New("fake conn closed")
+	}
+	return nil
+}
+
+func TestPoolGetBlocksUntilClose(t *testing.T) {
+	p := NewConnPool(&Options{
+		Dialer:      func(ctx context.Context) error { return nil },
+		MaxIdle:     1,
+		DialTimeout: time.Minute,
+	})
+	res := make(chan error, 1)
+	go func() {
+		_, err := p.Get(context.Background())
+		res <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Waiters == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Get is not waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-res:
+		t.Fatalf("Get returned before Close: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.Close()
+	select {
+	case err := <-res:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("Get err:%v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get still blocked after Close")
+	}
+	if _, err := p.Get(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Get after Close err:%v", err)
+	}
+	conn := newFakeConn()
+	if err := p.AddConn(conn); !errors.Is(err, ErrClosed) || !conn.closed.Load() {
+		t.Fatalf("AddConn after Close err:%v closed:%v", err, conn.closed.Load())
+	}
+}
+
+func TestPoolProbe(t *testing.T) {
+	p := NewConnPool(&Options{
+		Dialer:      func(ctx context.Context) error { return nil },
+		MaxIdle:     2,
+		DialTimeout: time.Second,
+	})
+	defer p.Close()
+	alive, dead := newFakeConn(), newFakeConn()
+	p.AddConn(alive)
+	p.AddConn(dead)
+	dead.dead.Store(true)
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get err:%v", err)
+	}
+	if conn != alive {
+		t.Fatal("Get handed out the dead conn")
+	}
+	if !dead.closed.Load() {
+		t.Fatal("dead conn was not closed")
+	}
+	if s := p.Stats(); s.Stale != 1 || s.Hits != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+// TestPoolConcurrent Get, AddConn, the liveness probe and Close race, every
+// conn ends up either handed out by Get or closed by the pool
+func TestPoolConcurrent(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns []*fakeConn
+		n     atomic.Int64
+		p     *ConnPool
+		ready = make(chan struct{})
+	)
+	add := func() {
+		conn := newFakeConn()
+		// every fifth conn is dead, idle ones are dropped by the probe
+		if n.Add(1)%5 == 0 {
+			conn.dead.Store(true)
+		}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		p.AddConn(conn)
+	}
+	p = NewConnPool(&Options{
+		Dialer: func(ctx context.Context) error {
+			go func() {
+				<-ready
+				add()
+			}()
+			return nil
+		},
+		MinIdle:     2,
+		MaxIdle:     8,
+		IdleTimeout: 10 * time.Millisecond,
+		DialTimeout: 20 * time.Millisecond,
+	})
+	close(ready)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := p.Get(context.Background())
+				if err != nil {
+					if errors.Is(err, ErrClosed) {
+						return
+					}
+					continue
+				}
+				fc := conn.(*fakeConn)
+				if fc.closed.Load() {
+					t.Error("Get handed out a conn the pool closed")
+				}
+				fc.taken.Store(true)
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				add()
+				p.Stats()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	p.Close()
+	close(stop)
+	wg.Wait()
+	// dials already in flight
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, conn := range conns {
+		if !conn.taken.Load() && !conn.closed.Load() {
+			t.Fatalf("conn %d of %d leaked, neither handed out nor closed", i, len(conns))
+		}
+	}
+	if len(conns) == 0 {
+		t.Fatal("no conns went through the pool")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// streamFrameSize largest frame a framed Stream writes
+	streamFrameSize = 16 << 10
+)
+
+// Stream a framed Conn as a byte stream, it implements net.Conn so it can be
+// handed to io.Copy, tls.Server or http.Serve. Frames that are neither
+// encrypted nor compressed are skipped and the socket is used raw
+type Stream struct {
+	conn Conn
+
+	// raw mode
+	rawR io.Reader
+	rawW net.Conn
+
+	// framed mode, rest of the last frame not read yet
+	readMu   sync.Mutex
+	leftover []byte
+	writeMu  sync.Mutex
+	writeBuf []byte
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+// NewStream conn must not be read or written directly afterwards
+func NewStream(conn Conn) *Stream {
+	s := &Stream{conn: conn}
+	if tc, ok := conn.(*TCPConn); ok && tc.plain() && tc.frame == nil && tc.hdrGot == 0 {
+		s.rawR = tc.buf
+		s.rawW = tc.Conn
+	}
+	return s
+}
+
+// Raw whether the stream skips framing
+func (s *Stream) Raw() bool {
+	return s.rawW != nil
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	if s.rawR != nil {
+		return s.rawR.Read(p)
+	}
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	for len(s.leftover) == 0 {
+		_, bin, err := s.conn.Read()
+		if err != nil {
+			return 0, err
+		}
+		s.leftover = bin
+	}
+	n := copy(p, s.leftover)
+	s.leftover = s.leftover[n:]
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	if s.rawW != nil {
+		return s.rawW.Write(p)
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+streamFrameSize)]
+		// crypt works in place, p must not change
+		s.writeBuf = append(s.writeBuf[:0], chunk...)
+		if _, err := s.conn.Write(s.writeBuf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (s *Stream) Close() error {
+	return s.conn.Close()
+}
+
+// CloseWrite the peer reads EOF once everything written is read
+func (s *Stream) CloseWrite() error {
+	return s.conn.CloseWrite()
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	return s.conn.SetDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
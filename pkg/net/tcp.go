@@ -21,6 +21,9 @@ import (
 	"io"
 	"math"
 	"net"
+
+	"github.com/gucooing/weiwei/pkg/util/compress"
+	"github.com/gucooing/weiwei/pkg/util/crypt"
 )
 
 type TCPListener struct {
@@ -49,6 +52,14 @@ type TCPConn struct {
 	*baseConn
 	net.Conn
 	buf *bufio.Reader
+
+	// frame being read, kept across a Read interrupted by a deadline
+	hdr      [4]byte
+	hdrGot   int
+	frame    *[]byte
+	frameGot int
+	// last frame returned by Read, back to the pool on the next Read
+	lastFrame *[]byte
 }
 
 func (l *TCPListener) Accept() (Conn, error) {
@@ -67,28 +78,81 @@ func (l *TCPListener) Accept() (Conn, error) {
 
 var (
 	tcpLenSize = 4
+
+	ErrFrameTooLarge = errors.New("frame too large")
 )
 
+// Read one frame, bin is only valid until the next Read. The length is
+// checked against the max frame size before anything is allocated. A Read
+// that fails on a deadline keeps the part of the frame already read and
+// the next Read goes on with it
 func (c *TCPConn) Read() (n int, bin []byte, err error) {
-	lenBytes := make([]byte, tcpLenSize)
-	if _, err = io.ReadFull(c.buf, lenBytes); err != nil {
-		return 0, nil, err
+	if c.lastFrame != nil {
+		c.putBuffer(c.lastFrame)
+		c.lastFrame = nil
 	}
-	headLen := binary.BigEndian.Uint32(lenBytes)
-
-	buf := make([]byte, int(headLen))
-	if _, err = io.ReadFull(c.buf, buf); err != nil {
-		return 0, nil, err
+	if c.frame == nil {
+		for c.hdrGot < tcpLenSize {
+			m, err := c.buf.Read(c.hdr[c.hdrGot:])
+			c.hdrGot += m
+			if err != nil {
+				if err == io.EOF && c.hdrGot > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, nil, err
+			}
+		}
+		headLen := int64(binary.BigEndian.Uint32(c.hdr[:]))
+		if headLen > c.maxFrameSize.Load() {
+			return 0, nil, ErrFrameTooLarge
+		}
+		c.frame = c.getBuffer(int(headLen))
+		c.frameGot = 0
+	}
+	frame := *c.frame
+	for c.frameGot < len(frame) {
+		m, err := c.buf.Read(frame[c.frameGot:])
+		c.frameGot += m
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, nil, err
+		}
 	}
-	bin, err = c.BaseRead(buf)
+	c.lastFrame = c.frame
+	c.frame = nil
+	c.hdrGot = 0
+
+	bin, err = c.BaseRead(frame)
 	if err != nil {
 		return
 	}
-	n = tcpLenSize + int(headLen)
+	n = tcpLenSize + len(frame)
 	return
 }
 
+func (c *TCPConn) Probe() error {
+	if c.buf.Buffered() > 0 {
+		return errUnexpectedRead
+	}
+	return connCheck(c.Conn)
+}
+
+func (c *TCPConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// plain frames are neither encrypted nor compressed, the stream can skip them
+func (c *TCPConn) plain() bool {
+	return c.crypt == crypt.CryptNone && c.compress == compress.CompressNone
+}
+
 func (c *TCPConn) Close() error {
+	// lastFrame stays out of the pool, a reader may still hold it
 	if c.Conn != nil {
 		c.Conn.Close()
 	}
@@ -117,11 +181,12 @@ func (c *TCPConn) Write(b []byte) (n int, err error) {
 	headLen := len(bin)
 
 	if headLen > math.MaxUint32 {
-		return 0, errors.New("data too large")
+		return 0, ErrFrameTooLarge
 	}
 
-	buf := c.getBuffer(tcpLenSize + headLen)
-	defer c.putBuffer(buf)
+	bp := c.getBuffer(tcpLenSize + headLen)
+	defer c.putBuffer(bp)
+	buf := *bp
 
 	binary.BigEndian.PutUint32(buf[:tcpLenSize], uint32(headLen))
 	copy(buf[tcpLenSize:], bin)
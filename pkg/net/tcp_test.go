@@ -0,0 +1,272 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gucooing/weiwei/pkg/util/compress"
+)
+
+var benchFrameSizes = []int{512, 16 << 10, 256 << 10}
+
+// loopReader repeats the same frames forever
+type loopReader struct {
+	data []byte
+	off  int
+}
+
+func (r *loopReader) Read(b []byte) (int, error) {
+	n := copy(b, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// discardConn drops every write
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (discardConn) Close() error                { return nil }
+
+func frameStream(size int) []byte {
+	b := make([]byte, tcpLenSize+size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	return b
+}
+
+func newBenchConn(size int) *TCPConn {
+	c := &TCPConn{
+		baseConn: newBaseConn(),
+		Conn:     discardConn{},
+		buf:      bufio.NewReader(&loopReader{data: frameStream(size)}),
+	}
+	c.SetMaxFrameSize(size)
+	return c
+}
+
+// readFrameAlloc reads a frame the way TCPConn did before the buffer pool,
+// a new slice per frame
+func readFrameAlloc(c *TCPConn) ([]byte, error) {
+	if _, err := io.ReadFull(c.buf, c.hdr[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(c.hdr[:]))
+	if _, err := io.ReadFull(c.buf, frame); err != nil {
+		return nil, err
+	}
+	return c.BaseRead(frame)
+}
+
+// writeFrameAlloc writes a frame the way TCPConn did before the buffer pool
+func writeFrameAlloc(c *TCPConn, b []byte) (int, error) {
+	bin, err := c.BaseWrite(b)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, tcpLenSize+len(bin))
+	binary.BigEndian.PutUint32(buf, uint32(len(bin)))
+	copy(buf[tcpLenSize:], bin)
+	return c.Conn.Write(buf)
+}
+
+func BenchmarkFrameRead(b *testing.B) {
+	for _, size := range benchFrameSizes {
+		b.Run(fmt.Sprintf("alloc/%d", size), func(b *testing.B) {
+			c := newBenchConn(size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for b.Loop() {
+				if _, err := readFrameAlloc(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("pooled/%d", size), func(b *testing.B) {
+			c := newBenchConn(size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for b.Loop() {
+				if _, _, err := c.Read(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFrameWrite(b *testing.B) {
+	for _, size := range benchFrameSizes {
+		data := make([]byte, size)
+		b.Run(fmt.Sprintf("alloc/%d", size), func(b *testing.B) {
+			c := newBenchConn(size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for b.Loop() {
+				if _, err := writeFrameAlloc(c, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("pooled/%d", size), func(b *testing.B) {
+			c := newBenchConn(size)
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for b.Loop() {
+				if _, err := c.Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func frameOf(payload []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+func newReadConn(data []byte) *TCPConn {
+	return &TCPConn{
+		baseConn: newBaseConn(),
+		Conn:     discardConn{},
+		buf:      bufio.NewReader(bytes.NewReader(data)),
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	c := &TCPConn{
+		baseConn: newBaseConn(),
+		Conn:     discardConn{},
+		// a 4 GiB length and no body
+		buf: bufio.NewReader(&loopReader{data: []byte{0xff, 0xff, 0xff, 0xff}}),
+	}
+	if _, _, err := c.Read(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("err:%v, want ErrFrameTooLarge", err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := c.Read(); !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("err:%v, want ErrFrameTooLarge", err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("oversized frame allocated %v times", allocs)
+	}
+}
+
+func TestPreAuthMaxFrameSize(t *testing.T) {
+	c := newReadConn(frameOf(make([]byte, PreAuthMaxFrameSize+1)))
+	c.SetMaxFrameSize(PreAuthMaxFrameSize)
+	if _, _, err := c.Read(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("frame over the pre-auth limit err:%v", err)
+	}
+
+	c = newReadConn(frameOf(make([]byte, PreAuthMaxFrameSize)))
+	c.SetMaxFrameSize(PreAuthMaxFrameSize)
+	if _, bin, err := c.Read(); err != nil || len(bin) != PreAuthMaxFrameSize {
+		t.Fatalf("frame at the pre-auth limit len:%d err:%v", len(bin), err)
+	}
+}
+
+// TestReadResume a Read that hits the deadline mid frame keeps what it read
+func TestReadResume(t *testing.T) {
+	for _, cut := range []int{2, tcpLenSize + 3} {
+		t.Run(fmt.Sprint(cut), func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			c := &TCPConn{baseConn: newBaseConn(), Conn: a, buf: bufio.NewReader(a)}
+			payload := []byte("a frame split by a read deadline")
+			frame := frameOf(payload)
+
+			go b.Write(frame[:cut])
+			c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if _, _, err := c.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("err:%v, want a deadline", err)
+			}
+			go b.Write(frame[cut:])
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			_, bin, err := c.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bin, payload) {
+				t.Fatalf("resumed frame %q", bin)
+			}
+		})
+	}
+}
+
+func TestReadDecompress(t *testing.T) {
+	payload := bytes.Repeat([]byte("weiwei "), 1000)
+	for _, comp := range []compress.Compress{compress.CompressGzip, compress.CompressSnappy} {
+		t.Run(fmt.Sprintf("%T", comp), func(t *testing.T) {
+			packed, err := comp.Compress(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := newReadConn(frameOf(packed))
+			c.SetCompress(comp)
+			if _, bin, err := c.Read(); err != nil || !bytes.Equal(bin, payload) {
+				t.Fatalf("decompressed len:%d err:%v", len(bin), err)
+			}
+
+			// it decompresses to more than the max frame size
+			c = newReadConn(frameOf(packed))
+			c.SetCompress(comp)
+			c.SetMaxFrameSize(len(payload) - 1)
+			if _, _, err := c.Read(); !errors.Is(err, ErrFrameTooLarge) {
+				t.Fatalf("decompression over the limit err:%v", err)
+			}
+		})
+	}
+
+	// a gzip trailer that claims less than the data holds
+	packed, _ := compress.CompressGzip.Compress(payload)
+	binary.LittleEndian.PutUint32(packed[len(packed)-4:], 10)
+	c := newReadConn(frameOf(packed))
+	c.SetCompress(compress.CompressGzip)
+	if _, _, err := c.Read(); err == nil {
+		t.Fatal("gzip with a short size trailer was read")
+	}
+}
+
+func TestReadDecompressPooled(t *testing.T) {
+	packed, _ := compress.CompressSnappy.Compress(bytes.Repeat([]byte("weiwei "), 1000))
+	c := &TCPConn{
+		baseConn: newBaseConn(),
+		Conn:     discardConn{},
+		buf:      bufio.NewReader(&loopReader{data: frameOf(packed)}),
+	}
+	c.SetCompress(compress.CompressSnappy)
+	c.Read()
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, _, err := c.Read(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("snappy frame read allocated %v times", allocs)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+type HTTPPlugin struct {
+	cfg    *v1.HTTPPluginOptions
+	url    string
+	client *http.Client
+}
+
+func NewHTTPPlugin(cfg *v1.HTTPPluginOptions) *HTTPPlugin {
+	addr := cfg.Addr
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	p := &HTTPPlugin{
+		cfg:    cfg,
+		url:    strings.TrimSuffix(addr, "/") + "/" + strings.TrimPrefix(cfg.Path, "/"),
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+	}
+	return p
+}
+
+func (p *HTTPPlugin) Name() string {
+	return p.cfg.Name
+}
+
+func (p *HTTPPlugin) IsSupport(op string) bool {
+	return slices.Contains(p.cfg.Ops, op)
+}
+
+// Handle content is decoded into the returned Response.Content when the plugin changes it
+func (p *HTTPPlugin) Handle(ctx context.Context, op string, content any) (*Response, error) {
+	body, err := json.Marshal(&Request{
+		Version: APIVersion,
+		Op:      op,
+		Content: content,
+	})
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("version", APIVersion)
+	v.Set("op", op)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"?"+v.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("plugin:%s op:%s status:%s", p.cfg.Name, op, rsp.Status)
+	}
+	res := &Response{
+		Content: content,
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gookit/slog"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+var (
+	ErrRejected = errors.New("rejected by plugin")
+)
+
+// notifyTimeout bounds a notify only op over all of its plugins
+const notifyTimeout = 10 * time.Second
+
+// Manager runs the configured plugins of every op in order,
+// each plugin sees the content changed by the previous one
+type Manager struct {
+	loginPlugins       []*HTTPPlugin
+	newProxyPlugins    []*HTTPPlugin
+	closeProxyPlugins  []*HTTPPlugin
+	newWorkConnPlugins []*HTTPPlugin
+	newUserConnPlugins []*HTTPPlugin
+	quotaPlugins       []*HTTPPlugin
+}
+
+func NewManager(cfgs []*v1.HTTPPluginOptions) *Manager {
+	m := new(Manager)
+	for _, cfg := range cfgs {
+		p := NewHTTPPlugin(cfg)
+		if p.IsSupport(OpLogin) {
+			m.loginPlugins = append(m.loginPlugins, p)
+		}
+		if p.IsSupport(OpNewProxy) {
+			m.newProxyPlugins = append(m.newProxyPlugins, p)
+		}
+		if p.IsSupport(OpCloseProxy) {
+			m.closeProxyPlugins = append(m.closeProxyPlugins, p)
+		}
+		if p.IsSupport(OpNewWorkConn) {
+			m.newWorkConnPlugins = append(m.newWorkConnPlugins, p)
+		}
+		if p.IsSupport(OpNewUserConn) {
+			m.newUserConnPlugins = append(m.newUserConnPlugins, p)
+		}
+		if p.IsSupport(OpQuota) {
+			m.quotaPlugins = append(m.quotaPlugins, p)
+		}
+	}
+	return m
+}
+
+func (m *Manager) Login(content *LoginContent) (*LoginContent, error) {
+	return handle(context.Background(), m.loginPlugins, OpLogin, content)
+}
+
+func (m *Manager) NewProxy(content *NewProxyContent) (*NewProxyContent, error) {
+	return handle(context.Background(), m.newProxyPlugins, OpNewProxy, content)
+}
+
+// CloseProxy notify only, runs in the background and rejections are ignored
+func (m *Manager) CloseProxy(content *CloseProxyContent) {
+	if len(m.closeProxyPlugins) == 0 {
+		return
+	}
+	content = deepCopy(content)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if _, err := handle(ctx, m.closeProxyPlugins, OpCloseProxy, content); err != nil {
+			slog.Warnf("plugin op:%s proxy:%s err:%v", OpCloseProxy, content.ProxyName, err)
+		}
+	}()
+}
+
+func (m *Manager) NewWorkConn(content *NewWorkConnContent) (*NewWorkConnContent, error) {
+	return handle(context.Background(), m.newWorkConnPlugins, OpNewWorkConn, content)
+}
+
+func (m *Manager) NewUserConn(content *NewUserConnContent) (*NewUserConnContent, error) {
+	return handle(context.Background(), m.newUserConnPlugins, OpNewUserConn, content)
+}
+
+// Quota notify only, runs in the background and rejections are ignored
+func (m *Manager) Quota(content *QuotaContent) {
+	if len(m.quotaPlugins) == 0 {
+		return
+	}
+	content = deepCopy(content)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if _, err := handle(ctx, m.quotaPlugins, OpQuota, content); err != nil {
+			slog.Warnf("plugin op:%s user:%s proxy:%s err:%v", OpQuota, content.User, content.Proxy, err)
+		}
+	}()
+}
+
+func handle[T any](ctx context.Context, plugins []*HTTPPlugin, op string, content *T) (*T, error) {
+	for _, p := range plugins {
+		// decode into a copy so a failed plugin leaves the content untouched
+		next := deepCopy(content)
+		res, err := p.Handle(ctx, op, next)
+		if err != nil {
+			return nil, fmt.Errorf("plugin:%s %w", p.Name(), err)
+		}
+		if res.Reject {
+			return nil, fmt.Errorf("%w plugin:%s reason:%s", ErrRejected, p.Name(), res.RejectReason)
+		}
+		if !res.Unchange {
+			content = next
+		}
+	}
+	return content, nil
+}
+
+// deepCopy copies content through its json form, the only form plugins see,
+// so no nested slice or map is shared with the caller
+func deepCopy[T any](content *T) *T {
+	next := new(T)
+	b, err := json.Marshal(content)
+	if err == nil {
+		err = json.Unmarshal(b, next)
+	}
+	if err != nil {
+		// contents are plain json structs, a shallow copy is the fallback
+		*next = *content
+	}
+	return next
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"time"
+
+	"github.com/gucooing/weiwei/pkg/msg"
+)
+
+const (
+	APIVersion = "0.1.0"
+
+	OpLogin       = "Login"
+	OpNewProxy    = "NewProxy"
+	OpCloseProxy  = "CloseProxy"
+	OpNewWorkConn = "NewWorkConn"
+	OpNewUserConn = "NewUserConn"
+	OpQuota       = "Quota"
+)
+
+// quota events
+const (
+	QuotaWarning   = "warning"
+	QuotaExhausted = "exhausted"
+	QuotaResumed   = "resumed"
+)
+
+type Request struct {
+	Version string `json:"version"`
+	Op      string `json:"op"`
+	Content any    `json:"content"`
+}
+
+type Response struct {
+	Reject       bool   `json:"reject"`
+	RejectReason string `json:"rejectReason"`
+	Unchange     bool   `json:"unchange"`
+	Content      any    `json:"content"`
+}
+
+// UserInfo the weic an operation belongs to
+type UserInfo struct {
+	User  string `json:"user"`
+	RunId string `json:"runId"`
+}
+
+type LoginContent struct {
+	msg.CSLoginReq
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+type NewProxyContent struct {
+	User UserInfo `json:"user"`
+	msg.CSNewProxyReq
+}
+
+type CloseProxyContent struct {
+	User UserInfo `json:"user"`
+	msg.CSCloseProxyReq
+}
+
+type NewWorkConnContent struct {
+	User UserInfo `json:"user"`
+	msg.CSAddWorkConnRsp
+}
+
+// QuotaContent a quota crossed a warning threshold, was used up or allows
+// traffic again, Proxy is empty for the quota of the whole user
+type QuotaContent struct {
+	User        string    `json:"user"`
+	Client      string    `json:"client,omitempty"`
+	Proxy       string    `json:"proxy,omitempty"`
+	Event       string    `json:"event"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"periodStart"`
+	Limit       int64     `json:"limit"`
+	Used        int64     `json:"used"`
+	Percent     int       `json:"percent"`
+}
+
+type NewUserConnContent struct {
+	User       UserInfo `json:"user"`
+	ProxyName  string   `json:"proxyName"`
+	ProxyType  string   `json:"proxyType"`
+	RemoteAddr string   `json:"remoteAddr"`
+}
@@ -0,0 +1,96 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxyproto builds the HAProxy PROXY protocol header that tells a
+// local service the address of the user behind the tunnel. Only tcp is
+// covered, it is the only proxy type weis serves
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// v2Signature starts every v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamUnspec = 0x00
+	v2FamInet   = 0x10
+	v2FamInet6  = 0x20
+
+	v2TransStream = 0x01
+)
+
+// addrs src and dst of the user conn, false when either is not an ip address
+func addrs(src, dst string) (s, d netip.AddrPort, ok bool) {
+	s, err := netip.ParseAddrPort(src)
+	if err != nil {
+		return s, d, false
+	}
+	d, err = netip.ParseAddrPort(dst)
+	if err != nil {
+		return s, d, false
+	}
+	s = netip.AddrPortFrom(s.Addr().Unmap(), s.Port())
+	d = netip.AddrPortFrom(d.Addr().Unmap(), d.Port())
+	// both sides of a header are the same family
+	if s.Addr().Is4() != d.Addr().Is4() {
+		s = netip.AddrPortFrom(netip.AddrFrom16(s.Addr().As16()), s.Port())
+		d = netip.AddrPortFrom(netip.AddrFrom16(d.Addr().As16()), d.Port())
+	}
+	return s, d, true
+}
+
+// HeaderV1 text header of a tcp conn, src and dst are host:port, UNKNOWN
+// when they are not ip addresses
+func HeaderV1(src, dst string) []byte {
+	s, d, ok := addrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if !s.Addr().Is4() {
+		proto = "TCP6"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n",
+		proto, s.Addr(), d.Addr(), s.Port(), d.Port())
+}
+
+// HeaderV2 binary header of a tcp conn, src and dst are host:port, a LOCAL
+// header when they are not ip addresses
+func HeaderV2(src, dst string) []byte {
+	buf := make([]byte, 0, 16+36)
+	buf = append(buf, v2Signature...)
+	s, d, ok := addrs(src, dst)
+	if !ok {
+		buf = append(buf, v2CmdLocal, v2FamUnspec)
+		return binary.BigEndian.AppendUint16(buf, 0)
+	}
+	if s.Addr().Is4() {
+		buf = append(buf, v2CmdProxy, v2FamInet|v2TransStream)
+		buf = binary.BigEndian.AppendUint16(buf, 12)
+	} else {
+		buf = append(buf, v2CmdProxy, v2FamInet6|v2TransStream)
+		buf = binary.BigEndian.AppendUint16(buf, 36)
+	}
+	buf = append(buf, s.Addr().AsSlice()...)
+	buf = append(buf, d.Addr().AsSlice()...)
+	buf = binary.BigEndian.AppendUint16(buf, s.Port())
+	return binary.BigEndian.AppendUint16(buf, d.Port())
+}
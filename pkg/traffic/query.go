@@ -0,0 +1,179 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package traffic
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GroupByUser   = "user"
+	GroupByClient = "client"
+	GroupByProxy  = "proxy"
+)
+
+var ErrUnknownGroupBy = errors.New("unknown groupBy, user client or proxy")
+
+// Query Period rollups starting in [From, To), zero times are open ends.
+// Empty filters match everything. GroupBy keeps only the named key fields
+// and adds up the rest, no GroupBy returns every key
+type Query struct {
+	Period  Period
+	From    time.Time
+	To      time.Time
+	User    string
+	Client  string
+	Proxy   string
+	GroupBy []string
+}
+
+func (q *Query) match(b bucket) bool {
+	if b.period != q.Period {
+		return false
+	}
+	start := time.Unix(b.start, 0)
+	if !q.From.IsZero() && start.Before(q.Period.Truncate(q.From)) {
+		return false
+	}
+	if !q.To.IsZero() && !start.Before(q.To) {
+		return false
+	}
+	return (q.User == "" || b.key.User == q.User) &&
+		(q.Client == "" || b.key.Client == q.Client) &&
+		(q.Proxy == "" || b.key.Proxy == q.Proxy)
+}
+
+// ParseGroupBy comma separated key fields
+func ParseGroupBy(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	for i, f := range fields {
+		f = strings.TrimSpace(f)
+		switch f {
+		case GroupByUser, GroupByClient, GroupByProxy:
+		default:
+			return nil, ErrUnknownGroupBy
+		}
+		fields[i] = f
+	}
+	return fields, nil
+}
+
+// ParseTime RFC 3339, a date or a date and hour in UTC
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15", "2006-01-02", "2006-01"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("bad time " + s + ", use RFC 3339 or YYYY-MM-DD")
+}
+
+func (s *Store) Query(q *Query) []*Record {
+	s.mu.Lock()
+	records := s.records(q.match)
+	s.mu.Unlock()
+	if len(q.GroupBy) == 0 {
+		return records
+	}
+
+	grouped := make(map[bucket]*Record)
+	out := make([]*Record, 0)
+	for _, r := range records {
+		key := Key{}
+		for _, f := range q.GroupBy {
+			switch f {
+			case GroupByUser:
+				key.User = r.User
+			case GroupByClient:
+				key.Client = r.Client
+			case GroupByProxy:
+				key.Proxy = r.Proxy
+			}
+		}
+		b := bucket{period: r.Period, start: r.Start.Unix(), key: key}
+		g, ok := grouped[b]
+		if !ok {
+			g = &Record{Period: r.Period, Start: r.Start, Key: key}
+			grouped[b] = g
+			out = append(out, g)
+		}
+		g.Usage.add(r.Usage)
+	}
+	sortRecords(out)
+	return out
+}
+
+// Sum usage of the matching rollups
+func (s *Store) Sum(q *Query) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sum Usage
+	for b, u := range s.buckets {
+		if q.match(b) {
+			sum.add(*u)
+		}
+	}
+	return sum
+}
+
+var csvHeader = []string{"period", "start", "user", "client", "proxy", "bytes_in", "bytes_out", "conns"}
+
+func WriteCSV(w io.Writer, records []*Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := cw.Write([]string{
+			string(r.Period),
+			r.Start.Format(time.RFC3339),
+			r.User,
+			r.Client,
+			r.Proxy,
+			strconv.FormatInt(r.BytesIn, 10),
+			strconv.FormatInt(r.BytesOut, 10),
+			strconv.FormatInt(r.Conns, 10),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// UsageSince adds up the daily rollups from the day of from whose key matches
+func (s *Store) UsageSince(from time.Time, match func(key Key) bool) Usage {
+	start := PeriodDay.Truncate(from).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sum Usage
+	for b, u := range s.buckets {
+		if b.period == PeriodDay && b.start >= start && match(b.key) {
+			sum.add(*u)
+		}
+	}
+	return sum
+}
@@ -0,0 +1,236 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package traffic keeps bytes and conns per user, client and proxy in
+// hourly and daily rollups, persisted to a JSON data file.
+package traffic
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Period string
+
+const (
+	PeriodHour Period = "hour"
+	PeriodDay  Period = "day"
+)
+
+var ErrUnknownPeriod = errors.New("unknown period, hour or day")
+
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(s); p {
+	case PeriodHour, PeriodDay:
+		return p, nil
+	case "":
+		return PeriodDay, nil
+	}
+	return "", ErrUnknownPeriod
+}
+
+// Truncate start of the period t is in, periods are in UTC
+func (p Period) Truncate(t time.Time) time.Time {
+	t = t.UTC()
+	if p == PeriodHour {
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Key who the traffic is billed to, Client is the enrolled client id or
+// the weic instance id so it survives reconnects
+type Key struct {
+	User   string `json:"user"`
+	Client string `json:"client"`
+	Proxy  string `json:"proxy"`
+}
+
+type Usage struct {
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	Conns    int64 `json:"conns"`
+}
+
+func (u *Usage) add(o Usage) {
+	u.BytesIn += o.BytesIn
+	u.BytesOut += o.BytesOut
+	u.Conns += o.Conns
+}
+
+// Total bytes both ways
+func (u Usage) Total() int64 {
+	return u.BytesIn + u.BytesOut
+}
+
+type Record struct {
+	Period Period    `json:"period"`
+	Start  time.Time `json:"start"`
+	Key
+	Usage
+}
+
+type bucket struct {
+	period Period
+	start  int64
+	key    Key
+}
+
+type data struct {
+	Records []*Record `json:"records"`
+}
+
+// Store rollups in memory, written to the data file on Flush
+type Store struct {
+	mu              sync.Mutex
+	path            string
+	buckets         map[bucket]*Usage
+	dirty           bool
+	hourlyRetention time.Duration
+	dailyRetention  time.Duration
+}
+
+func NewStore(path string, hourlyRetention, dailyRetention time.Duration) *Store {
+	s := &Store{
+		path:            path,
+		buckets:         make(map[bucket]*Usage),
+		hourlyRetention: hourlyRetention,
+		dailyRetention:  dailyRetention,
+	}
+	return s
+}
+
+// Load reads the data file, a missing file is an empty store
+func (s *Store) Load() error {
+	buff, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d := new(data)
+	if err := json.Unmarshal(buff, d); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range d.Records {
+		b := bucket{period: r.Period, start: r.Start.Unix(), key: r.Key}
+		u, ok := s.buckets[b]
+		if !ok {
+			u = new(Usage)
+			s.buckets[b] = u
+		}
+		u.add(r.Usage)
+	}
+	return nil
+}
+
+// Add counts usage at time at in both the hourly and the daily rollup
+func (s *Store) Add(key Key, usage Usage, at time.Time) {
+	if usage == (Usage{}) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range []Period{PeriodHour, PeriodDay} {
+		b := bucket{period: p, start: p.Truncate(at).Unix(), key: key}
+		u, ok := s.buckets[b]
+		if !ok {
+			u = new(Usage)
+			s.buckets[b] = u
+		}
+		u.add(usage)
+	}
+	s.dirty = true
+}
+
+// Flush drops rollups past retention and writes the data file when changed
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	now := time.Now()
+	for b := range s.buckets {
+		retention := s.dailyRetention
+		if b.period == PeriodHour {
+			retention = s.hourlyRetention
+		}
+		if retention > 0 && now.Sub(time.Unix(b.start, 0)) > retention {
+			delete(s.buckets, b)
+			s.dirty = true
+		}
+	}
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	d := &data{Records: s.records(func(bucket) bool { return true })}
+	s.dirty = false
+	s.mu.Unlock()
+
+	buff, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buff, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// records sorted copies of the matching buckets, mu must be held
+func (s *Store) records(match func(b bucket) bool) []*Record {
+	records := make([]*Record, 0, len(s.buckets))
+	for b, u := range s.buckets {
+		if !match(b) {
+			continue
+		}
+		records = append(records, &Record{
+			Period: b.period,
+			Start:  time.Unix(b.start, 0).UTC(),
+			Key:    b.key,
+			Usage:  *u,
+		})
+	}
+	sortRecords(records)
+	return records
+}
+
+func sortRecords(records []*Record) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Period != b.Period {
+			return a.Period < b.Period
+		}
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		return a.Proxy < b.Proxy
+	})
+}
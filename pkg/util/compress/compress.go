@@ -24,6 +24,7 @@ var (
 	CompressGzip   = &Gzip{}
 
 	ErrCompressTypeNu = errors.New(`compress type nu`)
+	ErrDecodedLen     = errors.New("decompressed size does not match the header")
 )
 
 type Compress interface {
@@ -31,6 +32,16 @@ type Compress interface {
 	Decompress(src []byte) ([]byte, error)
 }
 
+// Sized a Compress whose output size is known before decompressing, so it
+// can be checked and decompressed into a buffer of the caller
+type Sized interface {
+	// DecodedLen size src decompresses to
+	DecodedLen(src []byte) (int, error)
+	// DecompressInto dst has len DecodedLen, src that decompresses to any
+	// other size fails with ErrDecodedLen
+	DecompressInto(dst, src []byte) ([]byte, error)
+}
+
 type CompressType string
 
 const (
@@ -17,9 +17,21 @@ package compress
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"io"
+	"sync"
 )
 
+// gzipReader reused by DecompressInto, a gzip.Reader holds a large window
+type gzipReader struct {
+	src bytes.Reader
+	z   gzip.Reader
+}
+
+var gzipReaders = sync.Pool{
+	New: func() any { return new(gzipReader) },
+}
+
 type Gzip struct{}
 
 func (g Gzip) Compress(src []byte) ([]byte, error) {
@@ -42,3 +54,34 @@ func (g Gzip) Decompress(src []byte) ([]byte, error) {
 	defer z.Close()
 	return io.ReadAll(z)
 }
+
+// DecodedLen from the ISIZE trailer, DecompressInto checks it against the data
+func (g Gzip) DecodedLen(src []byte) (int, error) {
+	if len(src) < 18 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(binary.LittleEndian.Uint32(src[len(src)-4:])), nil
+}
+
+func (g Gzip) DecompressInto(dst, src []byte) ([]byte, error) {
+	r := gzipReaders.Get().(*gzipReader)
+	defer gzipReaders.Put(r)
+	r.src.Reset(src)
+	if err := r.z.Reset(&r.src); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(&r.z, dst); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, ErrDecodedLen
+		}
+		return nil, err
+	}
+	// more data than the trailer said, or a bad checksum
+	var one [1]byte
+	if n, err := r.z.Read(one[:]); n != 0 {
+		return nil, ErrDecodedLen
+	} else if err != io.EOF {
+		return nil, err
+	}
+	return dst, nil
+}
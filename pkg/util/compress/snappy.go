@@ -28,3 +28,18 @@ func (*Snappy) Compress(src []byte) ([]byte, error) {
 func (*Snappy) Decompress(src []byte) ([]byte, error) {
 	return snappy.Decode(nil, src)
 }
+
+func (*Snappy) DecodedLen(src []byte) (int, error) {
+	return snappy.DecodedLen(src)
+}
+
+func (*Snappy) DecompressInto(dst, src []byte) ([]byte, error) {
+	out, err := snappy.Decode(dst, src)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != len(dst) {
+		return nil, ErrDecodedLen
+	}
+	return out, nil
+}
@@ -15,6 +15,7 @@
 package crypt
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"math/rand"
@@ -31,14 +32,18 @@ type XOR struct {
 	XorKey []byte
 }
 
+// newCryptXor conf is an int64 seed or a []byte key
 func newCryptXor(conf interface{}) (Crypt, error) {
 	x := new(XOR)
-	seed, ok := conf.(int64)
-	if !ok {
+	switch c := conf.(type) {
+	case int64:
+		x.Seed = c
+		x.XorKey = SeedNewXorKey(c)
+	case []byte:
+		x.XorKey = KeyNewXorKey(c)
+	default:
 		return x, errors.New("conf err")
 	}
-	x.Seed = seed
-	x.XorKey = SeedNewXorKey(seed)
 
 	return x, nil
 }
@@ -52,6 +57,20 @@ func SeedNewXorKey(seed int64) []byte {
 	return xorKey
 }
 
+// KeyNewXorKey expands key with SHA-256 in counter mode
+func KeyNewXorKey(key []byte) []byte {
+	xorKey := make([]byte, 0, xorKeySize)
+	var ctr [4]byte
+	for i := uint32(0); len(xorKey) < xorKeySize; i++ {
+		binary.BigEndian.PutUint32(ctr[:], i)
+		h := sha256.New()
+		h.Write(key)
+		h.Write(ctr[:])
+		xorKey = h.Sum(xorKey)
+	}
+	return xorKey[:xorKeySize]
+}
+
 func (x *XOR) Encryption(data []byte) (encrypted []byte, err error) {
 	util.Xor(data, x.XorKey)
 	return data, nil
@@ -0,0 +1,82 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package limit token buckets for bandwidth limits.
+package limit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// minBurst keeps reads and writes from being split too small at low rates
+const minBurst = 4 << 10
+
+// Limiter token bucket in bytes, shared by every conn it limits. Tokens may
+// go negative, the next caller then waits for the debt to be paid off so
+// conns sharing a limiter take turns
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter bytesPerSec must be positive, the burst is one second of it
+func NewLimiter(bytesPerSec int64) *Limiter {
+	burst := float64(max(bytesPerSec, minBurst))
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Burst largest n a single WaitN should ask for
+func (l *Limiter) Burst() int {
+	return int(l.burst)
+}
+
+// reserve takes n tokens and returns how long to wait before using them
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN waits until n bytes may pass, the tokens stay taken when ctx ends first
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -15,8 +15,10 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"strconv"
-	"sync/atomic"
 )
 
 func EmptyDefault[T comparable](k T, v T) T {
@@ -33,15 +35,26 @@ func Xor(data []byte, key []byte) {
 	}
 }
 
-var (
-	runId = int64(0)
-)
+// NewSessionId random 128-bit id, hex encoded
+func NewSessionId() string {
+	return NewNonce(16)
+}
 
-func NewRunId() int64 {
-	return atomic.AddInt64(&runId, 1)
+// NewSeed random positive int64 from crypto/rand
+func NewSeed() int64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1)
 }
 
 func S2I64(msg string) int64 {
 	ms, _ := strconv.ParseInt(msg, 10, 64)
 	return ms
 }
+
+// NewNonce random hex string of n bytes
+func NewNonce(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
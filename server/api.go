@@ -0,0 +1,440 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	gonet "net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/enroll"
+	"github.com/gucooing/weiwei/pkg/msg"
+	"github.com/gucooing/weiwei/pkg/net"
+	"github.com/gucooing/weiwei/pkg/traffic"
+)
+
+const (
+	apiShutdownTimeout = 5 * time.Second
+)
+
+const (
+	ProxyStatusOnline = "online"
+	ProxyStatusParked = "parked"
+	// ProxyStatusSuspended listener closed by the quota
+	ProxyStatusSuspended = "suspended"
+)
+
+type ClientInfo struct {
+	RunId      string    `json:"runId"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Version    string    `json:"version"`
+	LoginAt    time.Time `json:"loginAt"`
+	LastPing   time.Time `json:"lastPing"`
+	// PingRtt last ping round trip reported by weic, milliseconds
+	PingRtt  float64 `json:"pingRtt"`
+	ProxyNum int     `json:"proxyNum"`
+}
+
+type ClientDetail struct {
+	ClientInfo
+	ProtocolVersion uint32              `json:"protocolVersion"`
+	Capabilities    []string            `json:"capabilities"`
+	GoingAway       bool                `json:"goingAway"`
+	Proxies         []ProxyInfo         `json:"proxies"`
+	Dispatcher      msg.DispatcherStats `json:"dispatcher"`
+	WorkPool        net.PoolStats       `json:"workPool"`
+}
+
+type ProxyInfo struct {
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	RemotePort    int       `json:"remotePort,omitempty"`
+	CustomDomains []string  `json:"customDomains,omitempty"`
+	Status        string    `json:"status"`
+	RunId         string    `json:"runId"`
+	User          string    `json:"user,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	// Conns user conns open now, TotalConns since register
+	Conns      int64 `json:"conns"`
+	TotalConns int64 `json:"totalConns"`
+	// BytesIn from users, BytesOut to users
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	// IPRejections user conns rejected by each allowIPs and denyIPs rule
+	IPRejections map[string]int64 `json:"ipRejections,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// ApiServer admin HTTP API
+type ApiServer struct {
+	svr  *Service
+	cfg  *v1.WebServerConfig
+	http *http.Server
+	ln   gonet.Listener
+}
+
+func NewApiServer(svr *Service, cfg *v1.WebServerConfig) (*ApiServer, error) {
+	ln, err := gonet.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	a := &ApiServer{
+		svr: svr,
+		cfg: cfg,
+		ln:  ln,
+	}
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/clients", a.listClients)
+	api.HandleFunc("GET /api/clients/{runId}", a.getClient)
+	api.HandleFunc("DELETE /api/clients/{runId}", a.kickClient)
+	api.HandleFunc("DELETE /api/clients/{runId}/proxies/{name}", a.closeProxy)
+	api.HandleFunc("GET /api/proxies", a.listProxies)
+	api.HandleFunc("GET /api/traffic", a.queryTraffic)
+	api.HandleFunc("GET /api/quotas", a.listQuotas)
+	api.HandleFunc("POST /api/quotas/reset", a.resetQuota)
+	api.HandleFunc("POST /api/quotas/limit", a.raiseQuota)
+	api.HandleFunc("DELETE /api/credentials/{clientId}", a.revokeCredential)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", a.healthz)
+	mux.HandleFunc("GET /readyz", a.readyz)
+	mux.Handle("/api/", a.auth(api))
+	mux.Handle("GET /metrics", a.auth(svr.metrics.registry.Handler()))
+	// the dashboard holds no data, it asks for credentials when the api refuses it
+	mux.Handle("/", dashboardHandler())
+	a.http = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return a, nil
+}
+
+func (a *ApiServer) Run() {
+	slog.Infof("web server listen %s", a.ln.Addr())
+	if err := a.http.Serve(a.ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Errorf("web server err:%v", err)
+	}
+}
+
+func (a *ApiServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+	defer cancel()
+	return a.http.Shutdown(ctx)
+}
+
+// auth basic auth or bearer token, compared in constant time. Mutations with
+// basic auth also need the X-Requested-With header
+func (a *ApiServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearer, ok := a.authorized(r); ok {
+			// browsers send basic auth on cross-site forms too, a custom header
+			// can only be set by a same-origin script
+			if !bearer && mutating(r.Method) && r.Header.Get("X-Requested-With") == "" {
+				writeJson(w, http.StatusForbidden, &apiError{Error: "X-Requested-With header required"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the dashboard shows its own sign in form
+		if a.cfg.User != "" && r.Header.Get("X-Requested-With") == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="weis"`)
+		}
+		writeJson(w, http.StatusUnauthorized, &apiError{Error: "unauthorized"})
+	})
+}
+
+// authorized reports whether r is authorized and whether it used the bearer token
+func (a *ApiServer) authorized(r *http.Request) (bearer, ok bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return true, a.cfg.Token != "" && secureEqual(token, a.cfg.Token)
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		return false, a.cfg.User != "" &&
+			secureEqual(user, a.cfg.User) && secureEqual(password, a.cfg.Password)
+	}
+	return false, false
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a *ApiServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz fails once weis starts shutting down so no new weic is routed here
+func (a *ApiServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if a.svr.closing.Load() {
+		writeJson(w, http.StatusServiceUnavailable, map[string]string{"status": "closing"})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (a *ApiServer) listClients(w http.ResponseWriter, r *http.Request) {
+	controls := a.svr.controlManager.Controls()
+	clients := make([]ClientInfo, 0, len(controls))
+	for _, ctl := range controls {
+		clients = append(clients, ctl.info())
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].LoginAt.Before(clients[j].LoginAt)
+	})
+	writeJson(w, http.StatusOK, clients)
+}
+
+func (a *ApiServer) getClient(w http.ResponseWriter, r *http.Request) {
+	ctl, ok := a.svr.controlManager.GetControl(r.PathValue("runId"))
+	if !ok {
+		writeJson(w, http.StatusNotFound, &apiError{Error: ErrUnknownClient.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, ctl.detail())
+}
+
+func (a *ApiServer) kickClient(w http.ResponseWriter, r *http.Request) {
+	runId := r.PathValue("runId")
+	ctl, ok := a.svr.controlManager.GetControl(runId)
+	if !ok {
+		writeJson(w, http.StatusNotFound, &apiError{Error: ErrUnknownClient.Error()})
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "kicked from web server"
+	}
+	ctl.Kick(msg.KickAdmin, reason, config.Server.ReconnectDelay)
+	a.svr.controlManager.DelControl(runId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// closeProxy closes the proxy on weis only, weic registers it again on its next login
+func (a *ApiServer) closeProxy(w http.ResponseWriter, r *http.Request) {
+	ctl, ok := a.svr.controlManager.GetControl(r.PathValue("runId"))
+	if !ok {
+		writeJson(w, http.StatusNotFound, &apiError{Error: ErrUnknownClient.Error()})
+		return
+	}
+	name := r.PathValue("name")
+	if err := ctl.closeProxy(name); err != nil {
+		writeJson(w, http.StatusNotFound, &apiError{Error: err.Error()})
+		return
+	}
+	slog.Infof("runId:%v close proxy:%s from web server", ctl.runId, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *ApiServer) listProxies(w http.ResponseWriter, r *http.Request) {
+	proxies := make([]ProxyInfo, 0)
+	for _, ctl := range a.svr.controlManager.Controls() {
+		proxies = append(proxies, ctl.proxyInfos(ProxyStatusOnline)...)
+	}
+	for _, ctl := range a.svr.controlManager.Parked() {
+		proxies = append(proxies, ctl.proxyInfos(ProxyStatusParked)...)
+	}
+	sort.Slice(proxies, func(i, j int) bool {
+		if proxies[i].RunId != proxies[j].RunId {
+			return proxies[i].RunId < proxies[j].RunId
+		}
+		return proxies[i].Name < proxies[j].Name
+	})
+	writeJson(w, http.StatusOK, proxies)
+}
+
+// queryTraffic rollups as json, or csv with format=csv
+func (a *ApiServer) queryTraffic(w http.ResponseWriter, r *http.Request) {
+	q, err := trafficQuery(r.URL.Query())
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return
+	}
+	a.svr.accountProxies()
+	records := a.svr.traffic.Query(q)
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJson(w, http.StatusOK, records)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="traffic.csv"`)
+		if err := traffic.WriteCSV(w, records); err != nil {
+			slog.Debugf("web server write err:%v", err)
+		}
+	default:
+		writeJson(w, http.StatusBadRequest, &apiError{Error: "unknown format, json or csv"})
+	}
+}
+
+func (a *ApiServer) listQuotas(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, a.svr.quotas.List())
+}
+
+// resetQuota counts the quota of user, or of proxy of the user, from zero until the period ends
+func (a *ApiServer) resetQuota(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	if err := a.svr.quotas.Reset(v.Get("user"), v.Get("client"), v.Get("proxy")); err != nil {
+		writeJson(w, http.StatusNotFound, &apiError{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// raiseQuota sets the quota limit until the period ends, limit is a size like 20GB
+func (a *ApiServer) raiseQuota(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	limit, err := v1.ByteQuantity(v.Get("limit")).Bytes()
+	if err == nil && limit <= 0 {
+		err = errors.New("limit must be positive")
+	}
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return
+	}
+	if err := a.svr.quotas.Raise(v.Get("user"), v.Get("client"), v.Get("proxy"), limit); err != nil {
+		writeJson(w, http.StatusNotFound, &apiError{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeCredential revokes an enrolled client credential and kicks the weic using it
+func (a *ApiServer) revokeCredential(w http.ResponseWriter, r *http.Request) {
+	if err := a.svr.revokeClient(r.PathValue("clientId")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, enroll.ErrUnknownCredential) {
+			status = http.StatusNotFound
+		}
+		writeJson(w, status, &apiError{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func trafficQuery(v url.Values) (*traffic.Query, error) {
+	period, err := traffic.ParsePeriod(v.Get("period"))
+	if err != nil {
+		return nil, err
+	}
+	from, err := traffic.ParseTime(v.Get("from"))
+	if err != nil {
+		return nil, err
+	}
+	to, err := traffic.ParseTime(v.Get("to"))
+	if err != nil {
+		return nil, err
+	}
+	groupBy, err := traffic.ParseGroupBy(v.Get("groupBy"))
+	if err != nil {
+		return nil, err
+	}
+	return &traffic.Query{
+		Period:  period,
+		From:    from,
+		To:      to,
+		User:    v.Get("user"),
+		Client:  v.Get("client"),
+		Proxy:   v.Get("proxy"),
+		GroupBy: groupBy,
+	}, nil
+}
+
+func writeJson(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debugf("web server write err:%v", err)
+	}
+}
+
+func (c *Control) info() ClientInfo {
+	c.proxiesMu.Lock()
+	proxyNum := len(c.proxies)
+	c.proxiesMu.Unlock()
+	return ClientInfo{
+		RunId:      c.runId,
+		User:       c.user.Name(),
+		RemoteAddr: c.conn.RemoteAddr().String(),
+		Version:    c.version,
+		LoginAt:    c.loginAt,
+		LastPing:   c.lasePing.Load().(time.Time),
+		PingRtt:    float64(c.pingRtt.Load()) / float64(time.Millisecond),
+		ProxyNum:   proxyNum,
+	}
+}
+
+func (c *Control) detail() *ClientDetail {
+	return &ClientDetail{
+		ClientInfo:      c.info(),
+		ProtocolVersion: c.protocolVersion,
+		Capabilities:    c.caps.Names(),
+		GoingAway:       c.goingAway.Load(),
+		Proxies:         c.proxyInfos(ProxyStatusOnline),
+		Dispatcher:      c.dispatcher.Stats(),
+		WorkPool:        c.connPool.Stats(),
+	}
+}
+
+func (c *Control) proxyInfos(status string) []ProxyInfo {
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	infos := make([]ProxyInfo, 0, len(c.proxies))
+	for _, pxy := range c.proxies {
+		status := status
+		if pxy.isSuspended() {
+			status = ProxyStatusSuspended
+		}
+		infos = append(infos, ProxyInfo{
+			Name:          pxy.name,
+			Type:          string(pxy.typ),
+			RemotePort:    pxy.remotePort,
+			CustomDomains: pxy.customDomains,
+			Status:        status,
+			RunId:         c.runId,
+			User:          c.user.Name(),
+			CreatedAt:     pxy.createdAt,
+			Conns:         pxy.conns.Load(),
+			TotalConns:    pxy.totalConns.Load(),
+			BytesIn:       pxy.bytesIn.Load(),
+			BytesOut:      pxy.bytesOut.Load(),
+			IPRejections:  pxy.ipFilter.Hits(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
@@ -0,0 +1,61 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+func TestApiAuthMutation(t *testing.T) {
+	a := &ApiServer{cfg: &v1.WebServerConfig{User: "admin", Password: "pass", Token: "token"}}
+	h := a.auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name   string
+		method string
+		basic  bool
+		xhr    bool
+		status int
+	}{
+		{"basic get", http.MethodGet, true, false, http.StatusNoContent},
+		{"basic post", http.MethodPost, true, false, http.StatusForbidden},
+		{"basic delete", http.MethodDelete, true, false, http.StatusForbidden},
+		{"basic post xhr", http.MethodPost, true, true, http.StatusNoContent},
+		{"bearer post", http.MethodPost, false, false, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/quotas/reset?user=a", nil)
+			if tt.basic {
+				r.SetBasicAuth("admin", "pass")
+			} else {
+				r.Header.Set("Authorization", "Bearer token")
+			}
+			if tt.xhr {
+				r.Header.Set("X-Requested-With", "XMLHttpRequest")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status:%d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
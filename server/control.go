@@ -17,7 +17,7 @@ package server
 import (
 	"context"
 	"errors"
-	"math/rand"
+	"fmt"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -27,58 +27,147 @@ import (
 
 	"github.com/gucooing/weiwei/pkg/auth"
 	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
 	"github.com/gucooing/weiwei/pkg/msg"
 	"github.com/gucooing/weiwei/pkg/net"
+	"github.com/gucooing/weiwei/pkg/plugin"
 	"github.com/gucooing/weiwei/pkg/util"
 	"github.com/gucooing/weiwei/pkg/util/backoff"
+	"github.com/gucooing/weiwei/pkg/util/crypt"
+)
+
+const (
+	kickWriteTimeout = 3 * time.Second
 )
 
 var (
 	ErrRepeatControl  = errors.New("repeat control")
 	ErrNewControlAuth = errors.New("new control auth")
+	ErrGoingAway      = errors.New("weis is going away")
+	ErrWeicLogout     = errors.New("weic logout")
 )
 
 type ControlManager struct {
 	mu       sync.Mutex
-	contrils map[int64]*Control
+	contrils map[string]*Control
+	// sessions online controls by session key
+	sessions map[string]*Control
+	// parked dropped controls waiting to be resumed by session key
+	parked map[string]*Control
+	// closed set by Close, later logins are kicked
+	closed bool
 }
 
 func NewControlManager() *ControlManager {
 	cm := &ControlManager{
-		contrils: make(map[int64]*Control),
+		contrils: make(map[string]*Control),
+		sessions: make(map[string]*Control),
+		parked:   make(map[string]*Control),
 	}
 	return cm
 }
 
-func (cm *ControlManager) AddControl(runId int64, control *Control) error {
+// AddControl resumeToken resumes the session of the same instance
+func (cm *ControlManager) AddControl(runId string, control *Control, resumeToken string) error {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
+	if cm.closed {
+		cm.mu.Unlock()
+		return ErrGoingAway
+	}
 	if _, ok := cm.contrils[runId]; ok {
+		cm.mu.Unlock()
 		return ErrRepeatControl
 	}
+	stale, err := cm.takeSession(control, resumeToken)
+	if err == nil {
+		cm.contrils[runId] = control
+		if control.instanceKey != "" {
+			cm.sessions[control.instanceKey] = control
+		}
+	}
+	cm.mu.Unlock()
 
-	cm.contrils[runId] = control
-	return nil
+	if stale != nil {
+		stale.closeProxies()
+	}
+	return err
 }
 
-func (cm *ControlManager) GetControl(runId int64) (*Control, bool) {
+func (cm *ControlManager) GetControl(runId string) (*Control, bool) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	cry, ok := cm.contrils[runId]
 	return cry, ok
 }
 
-func (cm *ControlManager) DelControl(runId int64) {
+// Controls online controls
+func (cm *ControlManager) Controls() []*Control {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	controls := make([]*Control, 0, len(cm.contrils))
+	for _, control := range cm.contrils {
+		controls = append(controls, control)
+	}
+	return controls
+}
+
+// Parked dropped controls whose proxies wait to be resumed
+func (cm *ControlManager) Parked() []*Control {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	controls := make([]*Control, 0, len(cm.parked))
+	for _, control := range cm.parked {
+		controls = append(controls, control)
+	}
+	return controls
+}
+
+func (cm *ControlManager) DelControl(runId string) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	if cry, ok := cm.contrils[runId]; ok {
 		cry.Close()
+		if !cry.superseded {
+			cry.user.releaseClient()
+		}
+		if cm.sessions[cry.instanceKey] == cry {
+			delete(cm.sessions, cry.instanceKey)
+		}
 		delete(cm.contrils, runId)
 	}
 }
 
+// Close tells every weic weis is going away, waits up to ShutdownTimeout
+// for in-flight work conns and kicks them before closing the sockets
 func (cm *ControlManager) Close() error {
+	cm.mu.Lock()
+	cm.closed = true
+	controls := make([]*Control, 0, len(cm.contrils))
+	for _, control := range cm.contrils {
+		controls = append(controls, control)
+	}
+	cm.mu.Unlock()
+
+	reason := "weis shutdown"
+	for _, control := range controls {
+		control.goAway(reason, config.Server.ReconnectDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(config.Server.ShutdownTimeout)*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, control := range controls {
+		wg.Add(1)
+		go func(control *Control) {
+			defer wg.Done()
+			if err := control.drain(ctx); err != nil {
+				slog.Warnf("runId:%v work conns not drained: %v", control.runId, err)
+			}
+			control.Kick(msg.KickServerShutdown, reason, config.Server.ReconnectDelay)
+		}(control)
+	}
+	wg.Wait()
+
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	var lastErr error
@@ -88,60 +177,118 @@ func (cm *ControlManager) Close() error {
 			lastErr = err
 		}
 	}
-	cm.contrils = nil
+	for _, control := range cm.parked {
+		control.parkTimer.Stop()
+		control.closeProxies()
+	}
+	clear(cm.parked)
 
 	return lastErr
 }
 
 type Control struct {
+	// svr owner service
+	svr *Service
 	// conn client net conn
 	conn net.Conn
 	// runId client id
-	runId int64
-	// seed
+	runId string
+	// sessionKey random 128-bit key, hex encoded, keys the control crypt and work conn auth
+	sessionKey string
+	// seed keys the session instead of sessionKey when weic lacks msg.CapSessionKey
 	seed int64
 	// dispatcher msg handler
 	dispatcher *msg.Dispatcher
 	// lasePing lase ping time time.Time
 	lasePing atomic.Value
+	// pingRtt round trip reported by weic, nanoseconds
+	pingRtt atomic.Int64
 	// doneChan
 	doneChan chan struct{}
 	// net conn pool
 	connPool net.Pooler
 	// work verifier
 	workVerifier auth.Verifier
+	// user login user, nil for the shared token
+	user *User
+	// clientId enrolled client id or weic instance id, runId when weic sent neither
+	clientId string
+	// credentialId enrolled client id, empty unless weic logged in with a credential
+	credentialId string
+	// version weic build version
+	version string
+	// loginAt login time
+	loginAt time.Time
+	// protocolVersion negotiated protocol
+	protocolVersion uint32
+	// caps features shared with weic
+	caps msg.Capability
+	// proxies registered proxies by name
+	proxiesMu sync.Mutex
+	proxies   map[string]*Proxy
+	// workConns work conns handed out and not closed yet
+	workConns sync.WaitGroup
+	// goingAway no new work conns once set
+	goingAway atomic.Bool
+	// instanceKey user and instance id, empty when weic sent no instance id
+	instanceKey string
+	// resumeToken resumes this session on the next login
+	resumeToken string
+	// resumedProxies proxies adopted from the resumed session
+	resumedProxies []string
+	// noResume proxies are closed with the control, set on logout and kick
+	noResume atomic.Bool
+	// superseded a newer login of the instance took the client slot, guarded by ControlManager.mu
+	superseded bool
+	// parkTimer closes the proxies when the session is not resumed, guarded by ControlManager.mu
+	parkTimer *time.Timer
 }
 
-func NewControl(conn net.Conn) (*Control, error) {
+func NewControl(svr *Service, conn net.Conn, user *User) (*Control, error) {
 	c := &Control{
-		conn:       conn,
-		runId:      util.NewRunId(),
-		dispatcher: msg.NewDispatcher(conn),
-		lasePing:   atomic.Value{},
-		doneChan:   make(chan struct{}),
+		svr:   svr,
+		conn:  conn,
+		runId: util.NewSessionId(),
+		dispatcher: msg.NewDispatcherWithOptions(conn, &msg.DispatcherOptions{
+			QueueSize:   config.Server.Dispatcher.QueueSize,
+			QueuePolicy: msg.QueuePolicy(config.Server.Dispatcher.QueuePolicy),
+		}),
+		lasePing: atomic.Value{},
+		loginAt:  time.Now(),
+		doneChan: make(chan struct{}),
+		user:     user,
+		proxies:  make(map[string]*Proxy),
 	}
-	c.seed = rand.Int63n(time.Now().UnixNano() ^ c.runId)
+	c.sessionKey = util.NewNonce(16)
 	c.lasePing.Store(time.Now())
 
 	// dispatcher
 	c.dispatcher.RegisterMsg(&msg.CSPingReq{}, c.handlerPing)
+	c.dispatcher.RegisterRequest(&msg.CSNewProxyReq{}, c.handlerNewProxy)
+	c.dispatcher.RegisterMsg(&msg.CSCloseProxyReq{}, c.handlerCloseProxy)
+	c.dispatcher.RegisterMsg(&msg.CSUpdateProxyIPsReq{}, c.handlerUpdateProxyIPs)
+	c.dispatcher.RegisterMsg(&msg.CSLogoutReq{}, c.handlerLogout)
+	c.dispatcher.SetUnknownHandler(c.handlerUnknown)
 
 	// pool
+	pc := config.Server.WorkPool
 	c.connPool = net.NewConnPool(&net.Options{
 		Dialer:          c.reqAddWorkConn,
-		PoolSize:        10,
-		DialTimeout:     5 * time.Second,
-		ConnMaxLifetime: 24 * time.Hour,
+		MinIdle:         pc.MinIdle,
+		MaxIdle:         pc.MaxIdle,
+		IdleTimeout:     time.Duration(pc.IdleTimeout) * time.Second,
+		ConnMaxLifetime: time.Duration(pc.MaxLifetime) * time.Second,
+		DialTimeout:     time.Duration(pc.DialTimeout) * time.Second,
 	})
 
-	wwl, err := auth.NewToken(strconv.FormatInt(c.seed, 10))
+	wwl, err := auth.NewHmac(c.sessionKey)
 	if err != nil {
 		return nil, ErrNewControlAuth
 	}
 	c.workVerifier = wwl
 
-	slog.Infof("addr:%s runId:%v new weic",
-		c.conn.RemoteAddr().String(), c.runId)
+	slog.Infof("addr:%s runId:%v user:%s new weic",
+		c.conn.RemoteAddr().String(), c.runId, c.user.Name())
 	return c, nil
 }
 
@@ -151,7 +298,11 @@ func (c *Control) Start() {
 
 	// close
 	<-c.dispatcher.DoneChan()
+	slog.Debugf("runId:%v dispatcher closed: %v", c.runId, c.dispatcher.Err())
 	close(c.doneChan)
+	if !c.svr.controlManager.park(c) {
+		c.closeProxies()
+	}
 }
 
 func (c *Control) keepController() {
@@ -183,10 +334,175 @@ func (c *Control) Close() error {
 		c.conn.RemoteAddr().String(), c.runId)
 
 	err := c.conn.Close()
+	c.connPool.Close()
 
 	return err
 }
 
+// Kick tells weic why before closing the control
+func (c *Control) Kick(code msg.KickCode, reason string, reconnectDelay int64) {
+	slog.Infof("runId:%v user:%s kick %s: %s", c.runId, c.user.Name(), code, reason)
+	c.noResume.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), kickWriteTimeout)
+	defer cancel()
+	c.dispatcher.SendAndClose(ctx, &msg.SCKickNotify{
+		Code:           code,
+		Reason:         reason,
+		ReconnectDelay: reconnectDelay,
+	}, fmt.Errorf("kick %s: %s", code, reason))
+}
+
+func (c *Control) goAway(reason string, reconnectDelay int64) {
+	c.goingAway.Store(true)
+	err := c.dispatcher.Send(&msg.SCGoingAwayNotify{
+		Reason:         reason,
+		ReconnectDelay: reconnectDelay,
+	})
+	if err != nil {
+		slog.Debugf("runId:%v going away notify err:%v", c.runId, err)
+	}
+}
+
+// drain waits for the work conns handed out by GetWorkConn
+func (c *Control) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.workConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetWorkConn work conn for one user conn, tracked until done is called
+func (c *Control) GetWorkConn(ctx context.Context) (conn net.Conn, done func(), err error) {
+	if c.goingAway.Load() {
+		c.svr.metrics.workConnErrors.Inc()
+		return nil, nil, ErrGoingAway
+	}
+	start := time.Now()
+	conn, err = c.connPool.Get(ctx)
+	if err != nil {
+		c.svr.metrics.workConnErrors.Inc()
+		return nil, nil, err
+	}
+	c.svr.metrics.workConnWait.Observe(time.Since(start).Seconds())
+	c.workConns.Add(1)
+	return conn, sync.OnceFunc(c.workConns.Done), nil
+}
+
+func (c *Control) userInfo() plugin.UserInfo {
+	return plugin.UserInfo{
+		User:  c.user.Name(),
+		RunId: c.runId,
+	}
+}
+
+func (c *Control) addProxy(req *msg.CSNewProxyReq) (*Proxy, error) {
+	content, err := c.svr.pluginManager.NewProxy(&plugin.NewProxyContent{
+		User:          c.userInfo(),
+		CSNewProxyReq: *req,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req = &content.CSNewProxyReq
+
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	if _, ok := c.proxies[req.ProxyName]; ok {
+		return nil, ErrRepeatProxy
+	}
+	if err := c.user.CheckProxy(req); err != nil {
+		return nil, err
+	}
+	quotaPeriod := util.EmptyDefault(v1.QuotaPeriod(req.QuotaPeriod), v1.QuotaPeriodMonth)
+	if req.QuotaLimit > 0 && !quotaPeriod.Valid() {
+		return nil, fmt.Errorf("bad quota period %q", req.QuotaPeriod)
+	}
+	if err := c.user.acquireProxy(); err != nil {
+		return nil, err
+	}
+	pxy, err := NewProxy(c, req)
+	if err != nil {
+		c.user.releaseProxy()
+		return nil, err
+	}
+	c.proxies[pxy.name] = pxy
+	if req.QuotaLimit > 0 {
+		key := c.quotaKey(pxy.name)
+		pxy.quota = &key
+		c.svr.quotas.restrict(key, pxy, req.QuotaLimit, quotaPeriod)
+	}
+	c.svr.quotas.applyProxy(c, pxy)
+	return pxy, nil
+}
+
+func (c *Control) closeProxy(name string) error {
+	c.proxiesMu.Lock()
+	pxy, ok := c.proxies[name]
+	delete(c.proxies, name)
+	c.proxiesMu.Unlock()
+	if !ok {
+		return ErrUnknownProxy
+	}
+	c.closeProxyNotify(pxy)
+	return pxy.Close()
+}
+
+func (c *Control) closeProxyNotify(pxy *Proxy) {
+	c.svr.pluginManager.CloseProxy(&plugin.CloseProxyContent{
+		User: c.userInfo(),
+		CSCloseProxyReq: msg.CSCloseProxyReq{
+			ProxyName: pxy.name,
+		},
+	})
+}
+
+func (c *Control) closeProxies() {
+	c.proxiesMu.Lock()
+	proxies := c.proxies
+	c.proxies = make(map[string]*Proxy)
+	c.proxiesMu.Unlock()
+	for _, pxy := range proxies {
+		c.closeProxyNotify(pxy)
+		pxy.Close()
+	}
+}
+
+// useSeedSession keys a session without msg.CapSessionKey with a random
+// seed and a random numeric runId. Work conns of a legacy peer sign with
+// the token key of the seed, protocol 2 ones with hmac
+func (c *Control) useSeedSession(version uint32) error {
+	c.seed = util.NewSeed()
+	c.runId = strconv.FormatInt(util.NewSeed(), 10)
+	c.sessionKey = ""
+	var wwl auth.Verifier
+	var err error
+	if version == msg.LegacyProtocolVersion {
+		wwl, err = auth.NewToken(strconv.FormatInt(c.seed, 10))
+	} else {
+		wwl, err = auth.NewHmacV2(strconv.FormatInt(c.seed, 10))
+	}
+	if err != nil {
+		return ErrNewControlAuth
+	}
+	c.workVerifier = wwl
+	return nil
+}
+
+// sessionCrypt control conn crypt after the login response
+func (c *Control) sessionCrypt() (crypt.Crypt, error) {
+	if c.sessionKey == "" {
+		return crypt.NewCrypt(crypt.CryptTypeXor, c.seed)
+	}
+	return crypt.NewCrypt(crypt.CryptTypeXor, []byte(c.sessionKey))
+}
+
 func (c *Control) reqAddWorkConn(ctx context.Context) error {
 	err := c.dispatcher.Send(&msg.SCAddWorkConnReq{})
 	if err != nil {
@@ -197,11 +513,20 @@ func (c *Control) reqAddWorkConn(ctx context.Context) error {
 
 func (c *Control) addWorkConn(conn net.Conn, req *msg.CSAddWorkConnRsp) error {
 	// auth
-	if err := c.workVerifier.VerifyLogin(req.Timestamp, req.LoginKey); err != nil {
+	if err := c.workVerifier.VerifyLogin(req.Timestamp, string(req.RunId), req.Nonce, req.LoginKey); err != nil {
+		return err
+	}
+	conn.SetMaxFrameSize(config.Server.MaxFrameSize)
+	if _, err := c.svr.pluginManager.NewWorkConn(&plugin.NewWorkConnContent{
+		User:             c.userInfo(),
+		CSAddWorkConnRsp: *req,
+	}); err != nil {
+		conn.Close()
 		return err
 	}
 
 	// add
+	conn.SetDeadline(time.Time{})
 	err := c.connPool.AddConn(conn)
 	if err != nil {
 		slog.Errorf("runId:%v addWorkConn err:%v", c.runId, err)
@@ -0,0 +1,281 @@
+// weis dashboard, polls the admin api and keeps the traffic history in the page
+"use strict";
+
+const pollInterval = 2000;
+const historySize = 150; // 5 minutes of samples
+const authKey = "weis.auth";
+
+const state = {
+  auth: sessionStorage.getItem(authKey) || "",
+  expanded: new Set(),
+  last: null, // {at, bytes: Map(key -> {in, out})}
+  history: [], // {in, out} bytes per second
+};
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k.startsWith("on")) {
+      e.addEventListener(k.slice(2), v);
+    } else {
+      e.setAttribute(k, v);
+    }
+  }
+  for (const c of children) {
+    e.append(c instanceof Node ? c : String(c));
+  }
+  return e;
+}
+
+async function api(method, path) {
+  const headers = { "X-Requested-With": "XMLHttpRequest" };
+  if (state.auth) {
+    headers.Authorization = state.auth;
+  }
+  const rsp = await fetch(path, { method, headers });
+  if (rsp.status === 401) {
+    throw new AuthError();
+  }
+  if (!rsp.ok) {
+    const body = await rsp.json().catch(() => ({}));
+    throw new Error(body.error || rsp.statusText);
+  }
+  return rsp.status === 204 ? null : rsp.json();
+}
+
+class AuthError extends Error {}
+
+function formatBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n.toFixed(0) : n.toFixed(1)) + " " + units[i];
+}
+
+function formatAgo(t) {
+  const s = Math.max(0, Math.round((Date.now() - new Date(t)) / 1000));
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.floor(s / 60) + "m ago";
+  if (s < 86400) return Math.floor(s / 3600) + "h ago";
+  return Math.floor(s / 86400) + "d ago";
+}
+
+// sample turns proxy byte counters into rates, proxies that went away count as 0
+function sample(proxies) {
+  const now = Date.now();
+  const bytes = new Map();
+  for (const p of proxies) {
+    bytes.set(p.runId + "/" + p.name, { in: p.bytesIn, out: p.bytesOut });
+  }
+  let rate = { in: 0, out: 0 };
+  if (state.last) {
+    const secs = (now - state.last.at) / 1000;
+    for (const [key, cur] of bytes) {
+      const prev = state.last.bytes.get(key) || { in: 0, out: 0 };
+      rate.in += Math.max(0, cur.in - prev.in) / secs;
+      rate.out += Math.max(0, cur.out - prev.out) / secs;
+    }
+    state.history.push(rate);
+    if (state.history.length > historySize) {
+      state.history.shift();
+    }
+  }
+  state.last = { at: now, bytes };
+  return rate;
+}
+
+function drawChart() {
+  const canvas = $("chart");
+  const ratio = window.devicePixelRatio || 1;
+  const w = canvas.clientWidth;
+  const h = canvas.clientHeight;
+  canvas.width = w * ratio;
+  canvas.height = h * ratio;
+  const ctx = canvas.getContext("2d");
+  ctx.scale(ratio, ratio);
+  ctx.clearRect(0, 0, w, h);
+
+  const pad = { left: 80, right: 10, top: 10, bottom: 10 };
+  const max = Math.max(1024, ...state.history.map((r) => Math.max(r.in, r.out)));
+  const x = (i) => pad.left + (i / (historySize - 1)) * (w - pad.left - pad.right);
+  const y = (v) => h - pad.bottom - (v / max) * (h - pad.top - pad.bottom);
+
+  const style = getComputedStyle(document.documentElement);
+  ctx.font = "11px system-ui, sans-serif";
+  ctx.fillStyle = style.getPropertyValue("--muted");
+  ctx.strokeStyle = style.getPropertyValue("--border");
+  ctx.lineWidth = 1;
+  for (let i = 0; i <= 4; i++) {
+    const v = (max / 4) * i;
+    ctx.beginPath();
+    ctx.moveTo(pad.left, y(v));
+    ctx.lineTo(w - pad.right, y(v));
+    ctx.stroke();
+    ctx.fillText(formatBytes(v) + "/s", 4, y(v) + 4);
+  }
+
+  const offset = historySize - state.history.length;
+  for (const dir of ["in", "out"]) {
+    ctx.strokeStyle = style.getPropertyValue("--" + dir);
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    state.history.forEach((r, i) => {
+      if (i === 0) {
+        ctx.moveTo(x(offset + i), y(r[dir]));
+      } else {
+        ctx.lineTo(x(offset + i), y(r[dir]));
+      }
+    });
+    ctx.stroke();
+  }
+}
+
+async function kickClient(runId) {
+  if (!confirm("Kick client " + runId + "?")) return;
+  try {
+    await api("DELETE", "api/clients/" + encodeURIComponent(runId));
+  } catch (e) {
+    alert("kick failed: " + e.message);
+  }
+  refresh();
+}
+
+async function closeProxy(runId, name) {
+  if (!confirm("Close proxy " + name + "? The client registers it again on its next login.")) return;
+  try {
+    await api("DELETE", "api/clients/" + encodeURIComponent(runId) + "/proxies/" + encodeURIComponent(name));
+  } catch (e) {
+    alert("close failed: " + e.message);
+  }
+  refresh();
+}
+
+function proxyTable(proxies) {
+  const rows = proxies.map((p) =>
+    el("tr", null,
+      el("td", null, p.name),
+      el("td", null, p.type),
+      el("td", { class: "num" }, p.remotePort || (p.customDomains || []).join(", ")),
+      el("td", { class: "status-" + p.status }, p.status),
+      el("td", { class: "num" }, p.conns + " / " + p.totalConns),
+      el("td", { class: "num" }, formatBytes(p.bytesIn)),
+      el("td", { class: "num" }, formatBytes(p.bytesOut)),
+      el("td", null, p.status !== "parked"
+        ? el("button", { class: "danger", onclick: () => closeProxy(p.runId, p.name) }, "close")
+        : ""),
+    ));
+  return el("table", null,
+    el("thead", null,
+      el("tr", null,
+        ...["Proxy", "Type", "Remote", "Status", "Conns (open / total)", "In", "Out", ""].map((t) => el("th", null, t)))),
+    el("tbody", null, ...rows));
+}
+
+function renderClients(clients, proxies) {
+  const byRunId = new Map();
+  for (const p of proxies) {
+    if (!byRunId.has(p.runId)) byRunId.set(p.runId, []);
+    byRunId.get(p.runId).push(p);
+  }
+  const rows = [];
+  for (const c of clients) {
+    const toggle = () => {
+      if (state.expanded.has(c.runId)) {
+        state.expanded.delete(c.runId);
+      } else {
+        state.expanded.add(c.runId);
+      }
+      renderClients(clients, proxies);
+    };
+    rows.push(el("tr", { class: "client", onclick: toggle },
+      el("td", { title: c.runId }, c.runId.slice(0, 8)),
+      el("td", null, c.user || "-"),
+      el("td", null, c.remoteAddr),
+      el("td", null, c.version),
+      el("td", { title: c.loginAt }, formatAgo(c.loginAt)),
+      el("td", { title: c.lastPing }, formatAgo(c.lastPing)),
+      el("td", { class: "num" }, c.pingRtt ? c.pingRtt.toFixed(1) + " ms" : "-"),
+      el("td", { class: "num" }, c.proxyNum),
+      el("td", null, el("button", {
+        class: "danger",
+        onclick: (e) => {
+          e.stopPropagation();
+          kickClient(c.runId);
+        },
+      }, "kick")),
+    ));
+    if (state.expanded.has(c.runId)) {
+      rows.push(el("tr", { class: "proxies" },
+        el("td", { colspan: 9 }, proxyTable(byRunId.get(c.runId) || []))));
+    }
+  }
+  // parked sessions have no online client row
+  const online = new Set(clients.map((c) => c.runId));
+  const parked = proxies.filter((p) => !online.has(p.runId));
+  if (parked.length) {
+    rows.push(el("tr", { class: "proxies" },
+      el("td", { colspan: 9 }, el("h2", null, "Parked sessions"), proxyTable(parked))));
+  }
+  $("clients").replaceChildren(...rows);
+}
+
+async function refresh() {
+  let clients, proxies;
+  try {
+    [clients, proxies] = await Promise.all([api("GET", "api/clients"), api("GET", "api/proxies")]);
+  } catch (e) {
+    if (e instanceof AuthError) {
+      showLogin(state.auth ? "sign in failed" : "");
+    } else {
+      $("status").textContent = "error: " + e.message;
+    }
+    return;
+  }
+  $("login").hidden = true;
+  $("main").hidden = false;
+  $("logout").hidden = !state.auth;
+  $("status").textContent = "updated " + new Date().toLocaleTimeString();
+
+  const rate = sample(proxies);
+  $("c-clients").textContent = clients.length;
+  $("c-proxies").textContent = proxies.length;
+  $("c-conns").textContent = proxies.reduce((n, p) => n + p.conns, 0);
+  $("c-in").textContent = formatBytes(rate.in) + "/s";
+  $("c-out").textContent = formatBytes(rate.out) + "/s";
+  renderClients(clients, proxies);
+  drawChart();
+}
+
+function showLogin(message) {
+  $("main").hidden = true;
+  $("login").hidden = false;
+  $("logout").hidden = true;
+  $("login-error").textContent = message;
+}
+
+$("login-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const form = new FormData(e.target);
+  const token = form.get("token");
+  state.auth = token
+    ? "Bearer " + token
+    : "Basic " + btoa(form.get("user") + ":" + form.get("password"));
+  sessionStorage.setItem(authKey, state.auth);
+  refresh();
+});
+
+$("logout").addEventListener("click", () => {
+  state.auth = "";
+  sessionStorage.removeItem(authKey);
+  showLogin("");
+});
+
+window.addEventListener("resize", drawChart);
+
+refresh();
+setInterval(refresh, pollInterval);
@@ -0,0 +1,145 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/auth"
+	"github.com/gucooing/weiwei/pkg/enroll"
+	"github.com/gucooing/weiwei/pkg/msg"
+	"github.com/gucooing/weiwei/pkg/net"
+)
+
+// revokedCheckInterval how often revokes made outside weis are picked up
+const revokedCheckInterval = 5 * time.Second
+
+// enrollLogin redeems a one-time enrollment token,
+// the returned secret is sealed with the enrollment key
+func (svr *Service) enrollLogin(conn net.Conn, loginReq *msg.CSLoginReq) (*User, *enroll.Credential, string, error) {
+	cred, enrollKey, err := svr.enrollStore.Redeem(loginReq.EnrollToken, conn.RemoteAddr().String(),
+		func(enrollKey string) error {
+			verifier, err := auth.NewHmac(enrollKey)
+			if err != nil {
+				return err
+			}
+			return verifier.VerifyLogin(loginReq.Timestamp, "", loginReq.Nonce, loginReq.LoginKey)
+		})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	user, err := svr.enrollUser(cred)
+	if err != nil {
+		svr.rollbackEnroll(loginReq.EnrollToken, cred)
+		return nil, nil, "", err
+	}
+	sealed, err := enroll.SealSecret(enrollKey, loginReq.Nonce, cred.Secret)
+	if err != nil {
+		svr.rollbackEnroll(loginReq.EnrollToken, cred)
+		return nil, nil, "", err
+	}
+	slog.Infof("addr:%s enrolled clientId:%s user:%s",
+		conn.RemoteAddr().String(), cred.ClientId, cred.User)
+	return user, cred, sealed, nil
+}
+
+// rollbackEnroll the weic never got the credential, its token stays usable
+func (svr *Service) rollbackEnroll(tokenId string, cred *enroll.Credential) {
+	if err := svr.enrollStore.Rollback(tokenId, cred.ClientId); err != nil {
+		slog.Errorf("enroll token:%s rollback clientId:%s err:%v", tokenId, cred.ClientId, err)
+		return
+	}
+	slog.Infof("enroll token:%s login failed, clientId:%s rolled back", tokenId, cred.ClientId)
+}
+
+// revokeClient revokes the credential and kicks the weic using it
+func (svr *Service) revokeClient(clientId string) error {
+	if err := svr.enrollStore.Revoke(clientId); err != nil {
+		return err
+	}
+	svr.kickCredential(clientId)
+	return nil
+}
+
+func (svr *Service) kickCredential(clientId string) {
+	for _, ctl := range svr.controlManager.Controls() {
+		if ctl.credentialId != clientId {
+			continue
+		}
+		ctl.Kick(msg.KickAuthRevoked, "client credential revoked", 0)
+		svr.controlManager.DelControl(ctl.runId)
+	}
+}
+
+// revokedLoop kicks the weic whose credential the weis enroll command revoked
+func (svr *Service) revokedLoop() {
+	ticker := time.NewTicker(revokedCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svr.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		online := make(map[string]struct{})
+		for _, ctl := range svr.controlManager.Controls() {
+			if ctl.credentialId != "" {
+				online[ctl.credentialId] = struct{}{}
+			}
+		}
+		if len(online) == 0 {
+			continue
+		}
+		_, creds, err := svr.enrollStore.List()
+		if err != nil {
+			slog.Warnf("enroll store load err:%v", err)
+			continue
+		}
+		for _, cred := range creds {
+			if _, ok := online[cred.ClientId]; ok && !cred.RevokedAt.IsZero() {
+				svr.kickCredential(cred.ClientId)
+			}
+		}
+	}
+}
+
+func (svr *Service) verifyCredential(loginReq *msg.CSLoginReq) (*User, error) {
+	cred, err := svr.enrollStore.GetCredential(loginReq.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := auth.NewHmac(cred.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.VerifyLogin(loginReq.Timestamp, "", loginReq.Nonce, loginReq.LoginKey); err != nil {
+		return nil, err
+	}
+	return svr.enrollUser(cred)
+}
+
+// enrollUser credentials without a user share the token limits
+func (svr *Service) enrollUser(cred *enroll.Credential) (*User, error) {
+	if cred.User == "" {
+		return nil, nil
+	}
+	user, ok := svr.userManager.GetUser(cred.User)
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return user, nil
+}
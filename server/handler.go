@@ -28,7 +28,7 @@ func (c *Control) handlerPing(rawMsg msg.Message) {
 	clientTime := time.Unix(0, req.ClientTimestamp)
 	serverTime := time.Now()
 
-	_, err := msg.WriteMsg(c.conn, &msg.SCPingRsp{
+	err := c.dispatcher.Send(&msg.SCPingRsp{
 		ClientTimestamp: req.ClientTimestamp,
 		ServerTimestamp: serverTime.UnixNano(),
 	})
@@ -37,5 +37,66 @@ func (c *Control) handlerPing(rawMsg msg.Message) {
 		return
 	}
 	c.lasePing.Store(time.Now())
+	c.pingRtt.Store(req.Rtt)
+	if req.Rtt > 0 {
+		c.svr.metrics.pingRtt.Observe(time.Duration(req.Rtt).Seconds())
+	}
 	slog.Tracef("runId:%v weic ping:%s", c.runId, serverTime.Sub(clientTime).String())
 }
+
+func (c *Control) handlerNewProxy(rawMsg msg.Message) msg.Message {
+	req := rawMsg.(*msg.CSNewProxyReq)
+
+	rsp := &msg.SCNewProxyRsp{
+		ProxyName: req.ProxyName,
+	}
+	pxy, err := c.addProxy(req)
+	if err != nil {
+		slog.Warnf("runId:%v user:%s new proxy:%s err:%v", c.runId, c.user.Name(), req.ProxyName, err)
+		rsp.Error = err.Error()
+	} else {
+		rsp.RemotePort = pxy.remotePort
+		slog.Infof("runId:%v user:%s new proxy:%s type:%s", c.runId, c.user.Name(), pxy.name, pxy.typ)
+	}
+	return rsp
+}
+
+func (c *Control) handlerCloseProxy(rawMsg msg.Message) {
+	req := rawMsg.(*msg.CSCloseProxyReq)
+
+	if err := c.closeProxy(req.ProxyName); err != nil {
+		slog.Warnf("runId:%v close proxy:%s err:%v", c.runId, req.ProxyName, err)
+		return
+	}
+	slog.Infof("runId:%v close proxy:%s", c.runId, req.ProxyName)
+}
+
+func (c *Control) handlerUpdateProxyIPs(rawMsg msg.Message) {
+	req := rawMsg.(*msg.CSUpdateProxyIPsReq)
+
+	c.proxiesMu.Lock()
+	pxy, ok := c.proxies[req.ProxyName]
+	c.proxiesMu.Unlock()
+	if !ok {
+		slog.Warnf("runId:%v update ip rules of proxy:%s err:%v", c.runId, req.ProxyName, ErrUnknownProxy)
+		return
+	}
+	if err := pxy.ipFilter.Update(req.AllowIPs, req.DenyIPs); err != nil {
+		slog.Warnf("runId:%v update ip rules of proxy:%s err:%v", c.runId, req.ProxyName, err)
+		return
+	}
+	slog.Infof("runId:%v proxy:%s ip rules updated allow:%d deny:%d",
+		c.runId, req.ProxyName, len(req.AllowIPs), len(req.DenyIPs))
+}
+
+func (c *Control) handlerLogout(rawMsg msg.Message) {
+	req := rawMsg.(*msg.CSLogoutReq)
+
+	slog.Infof("runId:%v user:%s weic logout: %s", c.runId, c.user.Name(), req.Reason)
+	c.noResume.Store(true)
+	c.dispatcher.Close(ErrWeicLogout)
+}
+
+func (c *Control) handlerUnknown(rawMsg msg.Message) {
+	slog.Warnf("runId:%v weic unknown msg:%T", c.runId, rawMsg)
+}
@@ -0,0 +1,198 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+
+	"github.com/gucooing/weiwei/pkg/metrics"
+	"github.com/gucooing/weiwei/pkg/plugin"
+)
+
+// Metric names are stable, dashboards and alerts depend on them:
+//
+//	weis_controls_active                       gauge     online weic controls
+//	weis_sessions_parked                       gauge     dropped sessions waiting to be resumed
+//	weis_logins_total{result,reason}           counter   logins, result success or failure, reason empty on success
+//	weis_work_pool_idle_conns                  gauge     idle work conns over all pools
+//	weis_work_pool_pending_conns               gauge     work conns requested from weic and not arrived yet
+//	weis_work_pool_waiters                     gauge     user conns waiting for a work conn
+//	weis_work_conn_wait_seconds                histogram time a user conn waited for a work conn
+//	weis_work_conn_errors_total                counter   user conns that got no work conn
+//	weis_proxies{type}                         gauge     registered proxies
+//	weis_proxy_bytes_total{user,proxy,direction} counter bytes from users (in) and to users (out)
+//	weis_proxy_conns{user,proxy}               gauge     user conns open now
+//	weis_proxy_conns_total{user,proxy}         counter   user conns accepted
+//	weis_dispatcher_queue_depth                gauge     control messages queued for sending over all controls
+//	weis_ping_rtt_seconds                      histogram ping round trip reported by weic
+//	weis_preauth_conns                         gauge     conns that have not authenticated yet
+//	weis_preauth_rejected_total{reason}        counter   conns refused at accept, reason banned, max_conns,
+//	                                                     max_conns_per_ip or conn_rate
+//	weis_preauth_timeouts_total                counter   conns that did not authenticate within loginTimeout
+//	weis_ip_bans_total{reason}                 counter   addresses banned, reason conn_rate or login_failures
+//	weis_ip_banned                             gauge     addresses banned now
+//	weis_ip_rejections_total{user,proxy,rule}  counter   user conns rejected by an ip rule, user and
+//	                                                     proxy empty for the server denyIPs
+//
+// Proxy counters start again when a proxy is registered again.
+
+const (
+	loginResultSuccess = "success"
+	loginResultFailure = "failure"
+)
+
+type serverMetrics struct {
+	registry       *metrics.Registry
+	logins         *metrics.CounterVec
+	workConnWait   *metrics.Histogram
+	workConnErrors *metrics.Counter
+	pingRtt        *metrics.Histogram
+	// preAuthRejected conns refused at accept by reason, preAuthTimeouts
+	// conns that did not authenticate within loginTimeout
+	preAuthRejected *metrics.CounterVec
+	preAuthTimeouts *metrics.Counter
+	ipBans          *metrics.CounterVec
+}
+
+func newServerMetrics(svr *Service) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		logins: r.NewCounterVec("weis_logins_total",
+			"weic logins by result and failure reason.", "result", "reason"),
+		workConnWait: r.NewHistogram("weis_work_conn_wait_seconds",
+			"Time a user conn waited for a work conn.", nil),
+		workConnErrors: r.NewCounter("weis_work_conn_errors_total",
+			"User conns that got no work conn."),
+		pingRtt: r.NewHistogram("weis_ping_rtt_seconds",
+			"Ping round trip reported by weic.", nil),
+		preAuthRejected: r.NewCounterVec("weis_preauth_rejected_total",
+			"Conns refused at accept before they authenticated.", "reason"),
+		preAuthTimeouts: r.NewCounter("weis_preauth_timeouts_total",
+			"Conns that did not authenticate within the login timeout."),
+		ipBans: r.NewCounterVec("weis_ip_bans_total",
+			"Addresses banned on the weis listener.", "reason"),
+	}
+
+	r.NewGaugeFunc("weis_controls_active", "Online weic controls.", func() float64 {
+		return float64(len(svr.controlManager.Controls()))
+	})
+	r.NewGaugeFunc("weis_sessions_parked", "Dropped sessions waiting to be resumed.", func() float64 {
+		return float64(len(svr.controlManager.Parked()))
+	})
+	r.NewGaugeFunc("weis_preauth_conns", "Conns that have not authenticated yet.", func() float64 {
+		conns, _ := svr.preAuth.stats()
+		return float64(conns)
+	})
+	r.NewGaugeFunc("weis_ip_banned", "Addresses banned now.", func() float64 {
+		_, banned := svr.preAuth.stats()
+		return float64(banned)
+	})
+	poolGauge := func(name, help string, value func(c *Control) int) {
+		r.NewGaugeFunc(name, help, func() float64 {
+			var n int
+			for _, c := range svr.controlManager.Controls() {
+				n += value(c)
+			}
+			return float64(n)
+		})
+	}
+	poolGauge("weis_work_pool_idle_conns", "Idle work conns over all pools.",
+		func(c *Control) int { return c.connPool.Stats().Idle })
+	poolGauge("weis_work_pool_pending_conns", "Work conns requested from weic and not arrived yet.",
+		func(c *Control) int { return c.connPool.Stats().Pending })
+	poolGauge("weis_work_pool_waiters", "User conns waiting for a work conn.",
+		func(c *Control) int { return c.connPool.Stats().Waiters })
+	poolGauge("weis_dispatcher_queue_depth", "Control messages queued for sending over all controls.",
+		func(c *Control) int { return c.dispatcher.Stats().QueueDepth })
+
+	eachProxy := func(fn func(user string, pxy *Proxy)) {
+		for _, ctls := range [][]*Control{svr.controlManager.Controls(), svr.controlManager.Parked()} {
+			for _, c := range ctls {
+				c.proxiesMu.Lock()
+				for _, pxy := range c.proxies {
+					fn(c.user.Name(), pxy)
+				}
+				c.proxiesMu.Unlock()
+			}
+		}
+	}
+	r.NewFunc("weis_proxies", "Registered proxies.", metrics.TypeGauge, []string{"type"},
+		func(emit func(float64, ...string)) {
+			eachProxy(func(user string, pxy *Proxy) {
+				emit(1, string(pxy.typ))
+			})
+		})
+	r.NewFunc("weis_proxy_bytes_total", "Bytes from users (in) and to users (out).",
+		metrics.TypeCounter, []string{"user", "proxy", "direction"},
+		func(emit func(float64, ...string)) {
+			eachProxy(func(user string, pxy *Proxy) {
+				emit(float64(pxy.bytesIn.Load()), user, pxy.name, "in")
+				emit(float64(pxy.bytesOut.Load()), user, pxy.name, "out")
+			})
+		})
+	r.NewFunc("weis_proxy_conns", "User conns open now.",
+		metrics.TypeGauge, []string{"user", "proxy"},
+		func(emit func(float64, ...string)) {
+			eachProxy(func(user string, pxy *Proxy) {
+				emit(float64(pxy.conns.Load()), user, pxy.name)
+			})
+		})
+	r.NewFunc("weis_proxy_conns_total", "User conns accepted.",
+		metrics.TypeCounter, []string{"user", "proxy"},
+		func(emit func(float64, ...string)) {
+			eachProxy(func(user string, pxy *Proxy) {
+				emit(float64(pxy.totalConns.Load()), user, pxy.name)
+			})
+		})
+	r.NewFunc("weis_ip_rejections_total", "User conns rejected by an ip rule.",
+		metrics.TypeCounter, []string{"user", "proxy", "rule"},
+		func(emit func(float64, ...string)) {
+			for rule, n := range svr.denyFilter.Hits() {
+				emit(float64(n), "", "", rule)
+			}
+			eachProxy(func(user string, pxy *Proxy) {
+				for rule, n := range pxy.ipFilter.Hits() {
+					emit(float64(n), user, pxy.name, rule)
+				}
+			})
+		})
+	return m
+}
+
+func (m *serverMetrics) login(err error) {
+	if err == nil {
+		m.logins.WithLabelValues(loginResultSuccess, "").Inc()
+		return
+	}
+	m.logins.WithLabelValues(loginResultFailure, loginFailureReason(err)).Inc()
+}
+
+// loginFailureReason bounded label values for login errors
+func loginFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrProtocol):
+		return "protocol"
+	case errors.Is(err, ErrDuplicateLogin):
+		return "duplicate"
+	case errors.Is(err, ErrUserMaxClients):
+		return "max_clients"
+	case errors.Is(err, plugin.ErrRejected):
+		return "plugin"
+	case isAuthFailure(err):
+		return "auth"
+	}
+	return "error"
+}
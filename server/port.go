@@ -0,0 +1,256 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+const (
+	// portAllocAttempts ports tried at most for one allocation, others may
+	// be held by processes weis does not know about
+	portAllocAttempts = 64
+)
+
+var (
+	ErrNoFreePort = errors.New("no free remote port in the allowed ranges")
+)
+
+// portRecord port allocated to a proxy, kept while it is offline
+type portRecord struct {
+	Port     int       `json:"port"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// PortManager checks remote ports against the allowed ranges and allocates
+// them for remotePort 0. An allocation sticks to the owner and proxy name,
+// the proxy gets the same port after reconnecting or a restart, until it
+// has been offline longer than the lease
+type PortManager struct {
+	mu     sync.Mutex
+	path   string
+	ranges []v1.PortRange
+	lease  time.Duration
+	// sticky allocations by portKey
+	sticky map[string]*portRecord
+	// used ports of registered proxies, to their portKey
+	used map[int]string
+}
+
+func NewPortManager(path string, ranges []v1.PortRange, lease time.Duration) (*PortManager, error) {
+	pm := &PortManager{
+		path:   path,
+		ranges: ranges,
+		lease:  lease,
+		sticky: make(map[string]*portRecord),
+		used:   make(map[int]string),
+	}
+	buff, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buff, &pm.sticky); err != nil {
+		return nil, err
+	}
+	if pm.prune(time.Now()) {
+		if err := pm.save(); err != nil {
+			slog.Warnf("save ports file %s err:%v", path, err)
+		}
+	}
+	return pm, nil
+}
+
+// portOwner who the sticky ports of c belong to, only from what weis
+// authenticated: the enrolled credential, or the user with the instance id.
+// Empty when weic has neither, its ports do not stick
+func (c *Control) portOwner() string {
+	switch {
+	case c.credentialId != "":
+		return "cred:" + c.credentialId
+	case c.instanceKey != "":
+		return "user:" + c.instanceKey
+	}
+	return ""
+}
+
+func portKey(owner, proxyName string) string {
+	return owner + "/" + proxyName
+}
+
+func inRanges(ranges []v1.PortRange, port int) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed port is in the server ranges and in userRanges, empty ones allow all
+func (pm *PortManager) allowed(port int, userRanges []v1.PortRange) bool {
+	return (len(pm.ranges) == 0 || inRanges(pm.ranges, port)) &&
+		(len(userRanges) == 0 || inRanges(userRanges, port))
+}
+
+// candidates ports to try for key in order: its sticky port, free ports of
+// the ranges, then ports allocated to offline proxies, least recently used first
+func (pm *PortManager) candidates(key string, userRanges []v1.PortRange) []int {
+	ports := make([]int, 0, portAllocAttempts)
+	if rec, ok := pm.sticky[key]; ok {
+		if _, busy := pm.used[rec.Port]; !busy && pm.allowed(rec.Port, userRanges) {
+			ports = append(ports, rec.Port)
+		}
+	}
+	ranges := userRanges
+	if len(ranges) == 0 {
+		ranges = pm.ranges
+	}
+	if len(ranges) == 0 {
+		// any port the system picks
+		return append(ports, 0)
+	}
+	reserved := make(map[int]bool, len(pm.sticky))
+	for _, rec := range pm.sticky {
+		reserved[rec.Port] = true
+	}
+	for _, r := range ranges {
+		end := max(r.End, r.Start)
+		for port := r.Start; port <= end && len(ports) < portAllocAttempts; port++ {
+			if _, busy := pm.used[port]; !busy && !reserved[port] && pm.allowed(port, userRanges) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	offline := make([]*portRecord, 0)
+	for k, rec := range pm.sticky {
+		if _, busy := pm.used[rec.Port]; k != key && !busy && pm.allowed(rec.Port, userRanges) {
+			offline = append(offline, rec)
+		}
+	}
+	sort.Slice(offline, func(i, j int) bool { return offline[i].LastUsed.Before(offline[j].LastUsed) })
+	for _, rec := range offline {
+		ports = append(ports, rec.Port)
+	}
+	return ports
+}
+
+// Acquire listens on port for the proxy key, remotePort 0 allocates one that
+// is kept for key when sticky. listen returns the port it bound
+func (pm *PortManager) Acquire(key string, sticky bool, port int, userRanges []v1.PortRange,
+	listen func(port int) (int, error)) (int, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if port != 0 {
+		if !pm.allowed(port, userRanges) {
+			return 0, ErrRemotePortNotAllowed
+		}
+		bound, err := listen(port)
+		if err != nil {
+			return 0, err
+		}
+		pm.used[bound] = key
+		return bound, nil
+	}
+
+	var lastErr error
+	pm.prune(time.Now())
+	candidates := pm.candidates(key, userRanges)
+	for i, candidate := range candidates {
+		if i >= portAllocAttempts {
+			break
+		}
+		bound, err := listen(candidate)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		pm.used[bound] = key
+		// an offline proxy loses the port, it gets a new one when it is back
+		for k, rec := range pm.sticky {
+			if k != key && rec.Port == bound {
+				delete(pm.sticky, k)
+			}
+		}
+		if sticky {
+			pm.sticky[key] = &portRecord{Port: bound, LastUsed: time.Now()}
+		}
+		if err := pm.save(); err != nil {
+			slog.Warnf("save ports file %s err:%v", pm.path, err)
+		}
+		return bound, nil
+	}
+	if lastErr != nil {
+		return 0, fmt.Errorf("%w: %w", ErrNoFreePort, lastErr)
+	}
+	return 0, ErrNoFreePort
+}
+
+// Release the port of a closed proxy, an allocation stays reserved for it
+func (pm *PortManager) Release(key string, port int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.used[port] != key {
+		return
+	}
+	delete(pm.used, port)
+	if rec, ok := pm.sticky[key]; ok && rec.Port == port {
+		rec.LastUsed = time.Now()
+	}
+}
+
+// prune drops allocations of proxies offline longer than the lease, pm.mu
+// must be held. Whether any was dropped
+func (pm *PortManager) prune(now time.Time) bool {
+	pruned := false
+	for k, rec := range pm.sticky {
+		if pm.used[rec.Port] == k || now.Sub(rec.LastUsed) < pm.lease {
+			continue
+		}
+		delete(pm.sticky, k)
+		pruned = true
+		slog.Debugf("port:%d of %s lease expired", rec.Port, k)
+	}
+	return pruned
+}
+
+// save pm.mu must be held
+func (pm *PortManager) save() error {
+	buff, err := json.MarshalIndent(pm.sticky, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pm.path), 0o700); err != nil {
+		return err
+	}
+	tmp := pm.path + ".tmp"
+	if err := os.WriteFile(tmp, buff, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pm.path)
+}
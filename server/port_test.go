@@ -0,0 +1,82 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+func TestPortOwner(t *testing.T) {
+	user := &User{cfg: &v1.User{Name: "alice"}}
+	c := &Control{clientId: "spoofed", instanceKey: instanceKey(user, "laptop")}
+	if owner := c.portOwner(); owner != "user:alice/laptop" {
+		t.Fatalf("owner %q", owner)
+	}
+	c.credentialId = "cred-1"
+	if owner := c.portOwner(); owner != "cred:cred-1" {
+		t.Fatalf("owner %q", owner)
+	}
+	// a client id weic picked itself owns nothing
+	if owner := (&Control{clientId: "spoofed"}).portOwner(); owner != "" {
+		t.Fatalf("owner %q, want none", owner)
+	}
+}
+
+func TestPortLease(t *testing.T) {
+	ranges := []v1.PortRange{{Start: 20000, End: 20010}}
+	pm, err := NewPortManager(filepath.Join(t.TempDir(), "ports.json"), ranges, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := func(port int) (int, error) { return port, nil }
+
+	a, err := pm.Acquire("user:u/a/web", true, 0, nil, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pm.Acquire("run:1/web", false, 0, nil, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pm.sticky["run:1/web"]; ok {
+		t.Fatal("port of weic without an owner is sticky")
+	}
+	pm.Release("user:u/a/web", a)
+	pm.Release("run:1/web", b)
+
+	again, err := pm.Acquire("user:u/a/web", true, 0, nil, listen)
+	if err != nil || again != a {
+		t.Fatalf("port %d err:%v, want sticky %d", again, err, a)
+	}
+	pm.Release("user:u/a/web", again)
+
+	// an online proxy keeps its port however old the allocation is
+	c, _ := pm.Acquire("user:u/c/web", true, 0, nil, listen)
+	pm.sticky["user:u/c/web"].LastUsed = time.Now().Add(-2 * time.Hour)
+	pm.sticky["user:u/a/web"].LastUsed = time.Now().Add(-2 * time.Hour)
+	if !pm.prune(time.Now()) {
+		t.Fatal("expired lease not pruned")
+	}
+	if _, ok := pm.sticky["user:u/a/web"]; ok {
+		t.Fatal("offline allocation kept after its lease")
+	}
+	if rec, ok := pm.sticky["user:u/c/web"]; !ok || rec.Port != c {
+		t.Fatal("online allocation pruned")
+	}
+}
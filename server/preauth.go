@@ -0,0 +1,222 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	gonet "net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/auth"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/enroll"
+)
+
+const (
+	// preAuthWindow conn rate and login failures are counted per window
+	preAuthWindow = time.Minute
+	// preAuthTrust an address that authenticated skips the conn rate this long
+	preAuthTrust = 10 * time.Minute
+)
+
+// Reasons a conn is refused before it is read, the rejected metric label
+const (
+	preAuthBanned        = "banned"
+	preAuthMaxConns      = "max_conns"
+	preAuthMaxConnsPerIP = "max_conns_per_ip"
+	preAuthConnRate      = "conn_rate"
+	preAuthLoginFailures = "login_failures"
+)
+
+// preAuthGuard limits conns on the weis listener until they authenticate
+type preAuthGuard struct {
+	cfg     *v1.PreAuthConfig
+	metrics *serverMetrics
+
+	mu    sync.Mutex
+	conns int
+	ips   map[netip.Addr]*preAuthIP
+}
+
+type preAuthIP struct {
+	// conns unauthenticated now
+	conns int
+	// windowStart of connCount and failures
+	windowStart time.Time
+	connCount   int
+	failures    int
+	bannedUntil time.Time
+	// trustedUntil the last authentication plus preAuthTrust
+	trustedUntil time.Time
+}
+
+func newPreAuthGuard(cfg *v1.PreAuthConfig, metrics *serverMetrics) *preAuthGuard {
+	return &preAuthGuard{
+		cfg:     cfg,
+		metrics: metrics,
+		ips:     make(map[netip.Addr]*preAuthIP),
+	}
+}
+
+// remoteIP zero for addresses that are not tcp, they share one state
+func remoteIP(addr gonet.Addr) netip.Addr {
+	if tcpAddr, ok := addr.(*gonet.TCPAddr); ok {
+		return tcpAddr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+func (g *preAuthGuard) state(ip netip.Addr, now time.Time) *preAuthIP {
+	st, ok := g.ips[ip]
+	if !ok {
+		st = &preAuthIP{windowStart: now}
+		g.ips[ip] = st
+	}
+	if now.Sub(st.windowStart) >= preAuthWindow {
+		st.windowStart = now
+		st.connCount = 0
+		st.failures = 0
+	}
+	return st
+}
+
+func (g *preAuthGuard) ban(ip netip.Addr, st *preAuthIP, now time.Time, reason string) {
+	st.bannedUntil = now.Add(time.Duration(g.cfg.BanDuration) * time.Second)
+	g.metrics.ipBans.WithLabelValues(reason).Inc()
+	slog.Warnf("addr:%s banned for %ds: %s", ip, g.cfg.BanDuration, reason)
+}
+
+// admit counts a new conn from ip, a false ok with the reason refuses it
+// before anything is read. Admitted conns must be released
+func (g *preAuthGuard) admit(ip netip.Addr) (reason string, ok bool) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.state(ip, now)
+	if now.After(st.trustedUntil) && now.After(st.bannedUntil) {
+		st.connCount++
+		if st.connCount > g.cfg.MaxConnRate {
+			g.ban(ip, st, now, preAuthConnRate)
+			reason = preAuthConnRate
+		}
+	}
+	switch {
+	case reason != "":
+	case now.Before(st.bannedUntil):
+		reason = preAuthBanned
+	case g.conns >= g.cfg.MaxConns:
+		reason = preAuthMaxConns
+	case st.conns >= g.cfg.MaxConnsPerIP:
+		reason = preAuthMaxConnsPerIP
+	}
+	if reason != "" {
+		g.metrics.preAuthRejected.WithLabelValues(reason).Inc()
+		return reason, false
+	}
+	g.conns++
+	st.conns++
+	return "", true
+}
+
+// release an admitted conn once it authenticated, err nil, or failed
+func (g *preAuthGuard) release(ip netip.Addr, err error) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.conns--
+	st := g.state(ip, now)
+	st.conns--
+	switch {
+	case err == nil:
+		st.trustedUntil = now.Add(preAuthTrust)
+	case errors.Is(err, ErrWeicLoginTime):
+		g.metrics.preAuthTimeouts.Inc()
+		fallthrough
+	case isAuthFailure(err):
+		st.failures++
+		if st.failures > g.cfg.MaxLoginFailures && now.After(st.bannedUntil) {
+			g.ban(ip, st, now, preAuthLoginFailures)
+		}
+	}
+}
+
+// isAuthFailure errors of a bad login key, credential or work conn, and of
+// conns that never authenticated
+func isAuthFailure(err error) bool {
+	switch {
+	case errors.Is(err, ErrUnknownUser),
+		errors.Is(err, ErrUnknownClient),
+		errors.Is(err, ErrWeicLoginTime),
+		errors.Is(err, auth.ErrInvalidAuthKey),
+		errors.Is(err, auth.ErrLoginExpired),
+		errors.Is(err, auth.ErrLoginReplayed),
+		errors.Is(err, auth.ErrInvalidJwt),
+		errors.Is(err, auth.ErrJwtExpired),
+		errors.Is(err, auth.ErrJwtIssuer),
+		errors.Is(err, auth.ErrJwtAudience),
+		errors.Is(err, auth.ErrJwtUnknownKey),
+		errors.Is(err, auth.ErrJwtAlg),
+		errors.Is(err, enroll.ErrInvalidToken),
+		errors.Is(err, enroll.ErrTokenUsed),
+		errors.Is(err, enroll.ErrTokenExpired),
+		errors.Is(err, enroll.ErrUnknownCredential),
+		errors.Is(err, enroll.ErrRevoked):
+		return true
+	}
+	return false
+}
+
+// stats unauthenticated conns and banned addresses now
+func (g *preAuthGuard) stats() (conns, banned int) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, st := range g.ips {
+		if now.Before(st.bannedUntil) {
+			banned++
+		}
+	}
+	return g.conns, banned
+}
+
+// prune forgets addresses with nothing left to remember
+func (g *preAuthGuard) prune() {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for ip, st := range g.ips {
+		if st.conns == 0 && now.After(st.bannedUntil) && now.After(st.trustedUntil) &&
+			now.Sub(st.windowStart) >= preAuthWindow {
+			delete(g.ips, ip)
+		}
+	}
+}
+
+func (svr *Service) preAuthLoop() {
+	ticker := time.NewTicker(preAuthWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svr.ctx.Done():
+			return
+		case <-ticker.C:
+			svr.preAuth.prune()
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gonet "net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/ipfilter"
+	"github.com/gucooing/weiwei/pkg/msg"
+	"github.com/gucooing/weiwei/pkg/net"
+	"github.com/gucooing/weiwei/pkg/plugin"
+	"github.com/gucooing/weiwei/pkg/traffic"
+	"github.com/gucooing/weiwei/pkg/util/limit"
+)
+
+var (
+	ErrRepeatProxy  = errors.New("repeat proxy")
+	ErrUnknownProxy = errors.New("unknown proxy")
+)
+
+type Proxy struct {
+	// name proxy name, unique per control
+	name string
+	// typ proxy type
+	typ v1.ProxyType
+	// remotePort weis listen port
+	remotePort int
+	// portKey remotePort owner in the PortManager, empty without a listener
+	portKey string
+	// customDomains http host names
+	customDomains []string
+	// ctl owner control, a resumed session moves the proxy to the new one
+	ctlMu sync.RWMutex
+	ctl   *Control
+	// createdAt register time
+	createdAt time.Time
+	// listener user conns, nil for types without a data plane yet and while suspended
+	lnMu     sync.Mutex
+	listener gonet.Listener
+	// suspended listener closed until the quota allows traffic again, guarded by lnMu
+	suspended bool
+	// closed no listener is opened again, guarded by lnMu
+	closed bool
+	// conns user conns open now, totalConns since register
+	conns      atomic.Int64
+	totalConns atomic.Int64
+	// bytesIn from users, bytesOut to users
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// limitIn and limitOut bandwidthLimit enforced by weis, nil without one
+	limitIn  *limit.Limiter
+	limitOut *limit.Limiter
+	// ipFilter allowIPs and denyIPs of the proxy, weic may replace them
+	ipFilter *ipfilter.Filter
+	// acctUsage counters already added to the traffic store
+	acctMu    sync.Mutex
+	acctUsage traffic.Usage
+	// quota weic asked for, nil without one
+	quota *quotaKey
+}
+
+func NewProxy(ctl *Control, req *msg.CSNewProxyReq) (*Proxy, error) {
+	p := &Proxy{
+		name:          req.ProxyName,
+		typ:           v1.ProxyType(req.ProxyType),
+		remotePort:    req.RemotePort,
+		customDomains: req.CustomDomains,
+		ctl:           ctl,
+		createdAt:     time.Now(),
+	}
+	filter, err := ipfilter.New(req.AllowIPs, req.DenyIPs)
+	if err != nil {
+		return nil, err
+	}
+	p.ipFilter = filter
+	if req.BandwidthLimit > 0 {
+		p.limitIn = limit.NewLimiter(req.BandwidthLimit)
+		p.limitOut = limit.NewLimiter(req.BandwidthLimit)
+	}
+	if p.typ == v1.ProxyTypeTcp {
+		owner := ctl.portOwner()
+		sticky := owner != ""
+		if !sticky {
+			owner = "run:" + ctl.runId
+		}
+		p.portKey = portKey(owner, p.name)
+		_, err := ctl.svr.ports.Acquire(p.portKey, sticky, req.RemotePort, ctl.user.allowPorts(),
+			func(port int) (int, error) {
+				p.remotePort = port
+				if err := p.listen(); err != nil {
+					return 0, err
+				}
+				return p.remotePort, nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// listen opens the user listener, only tcp has a data plane so other types
+// get no listener. lnMu must be held or the proxy not shared yet
+func (p *Proxy) listen() error {
+	if p.typ != v1.ProxyTypeTcp {
+		return nil
+	}
+	addr := gonet.JoinHostPort(config.Server.ProxyBindAddr, strconv.Itoa(p.remotePort))
+	ln, err := gonet.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("proxy listen %s: %w", addr, err)
+	}
+	p.listener = ln
+	if p.remotePort == 0 {
+		p.remotePort = ln.Addr().(*gonet.TCPAddr).Port
+	}
+	go p.acceptLoop(ln)
+	return nil
+}
+
+// suspend closes the listener, user conns already joined keep going
+func (p *Proxy) suspend() {
+	p.lnMu.Lock()
+	defer p.lnMu.Unlock()
+	if p.suspended || p.closed {
+		return
+	}
+	p.suspended = true
+	if p.listener != nil {
+		p.listener.Close()
+		p.listener = nil
+	}
+}
+
+// resume listens on the same port again
+func (p *Proxy) resume() error {
+	p.lnMu.Lock()
+	defer p.lnMu.Unlock()
+	if !p.suspended || p.closed {
+		return nil
+	}
+	if err := p.listen(); err != nil {
+		return err
+	}
+	p.suspended = false
+	return nil
+}
+
+func (p *Proxy) isSuspended() bool {
+	p.lnMu.Lock()
+	defer p.lnMu.Unlock()
+	return p.suspended
+}
+
+func (p *Proxy) control() *Control {
+	p.ctlMu.RLock()
+	defer p.ctlMu.RUnlock()
+	return p.ctl
+}
+
+func (p *Proxy) setControl(ctl *Control) {
+	p.ctlMu.Lock()
+	p.ctl = ctl
+	p.ctlMu.Unlock()
+}
+
+func (p *Proxy) acceptLoop(ln gonet.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, gonet.ErrClosed) {
+				slog.Warnf("proxy:%s accept err:%v", p.name, err)
+			}
+			return
+		}
+		if !p.allowUser(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go p.handleUserConn(conn)
+	}
+}
+
+// allowUser checks the user address against the server and proxy ip rules
+// before a work conn is taken for it
+func (p *Proxy) allowUser(addr gonet.Addr) bool {
+	tcpAddr, ok := addr.(*gonet.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := tcpAddr.AddrPort().Addr()
+	if rule, ok := p.control().svr.denyFilter.Check(ip); !ok {
+		slog.Debugf("proxy:%s user conn %s rejected by server rule %s", p.name, addr, rule)
+		return false
+	}
+	if rule, ok := p.ipFilter.Check(ip); !ok {
+		slog.Debugf("proxy:%s user conn %s rejected by rule %s", p.name, addr, rule)
+		return false
+	}
+	return true
+}
+
+// handleUserConn joins a user conn with a work conn of the owner weic
+func (p *Proxy) handleUserConn(userConn gonet.Conn) {
+	defer userConn.Close()
+	p.conns.Add(1)
+	defer p.conns.Add(-1)
+	p.totalConns.Add(1)
+	ctl := p.control()
+	if _, err := ctl.svr.pluginManager.NewUserConn(&plugin.NewUserConnContent{
+		User:       ctl.userInfo(),
+		ProxyName:  p.name,
+		ProxyType:  string(p.typ),
+		RemoteAddr: userConn.RemoteAddr().String(),
+	}); err != nil {
+		slog.Infof("proxy:%s user conn %s rejected: %v", p.name, userConn.RemoteAddr(), err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(config.Server.WorkPool.DialTimeout)*time.Second)
+	workConn, done, err := ctl.GetWorkConn(ctx)
+	cancel()
+	if err != nil {
+		slog.Warnf("proxy:%s runId:%v get work conn err:%v", p.name, ctl.runId, err)
+		return
+	}
+	defer done()
+	defer workConn.Close()
+
+	if _, err := msg.WriteMsg(workConn, &msg.SCStartWorkConn{
+		ProxyName: p.name,
+		SrcAddr:   userConn.RemoteAddr().String(),
+		DstAddr:   userConn.LocalAddr().String(),
+	}); err != nil {
+		slog.Warnf("proxy:%s runId:%v start work conn err:%v", p.name, ctl.runId, err)
+		return
+	}
+	// reading the work conn is what goes out to the user
+	userIn, userOut := ctl.user.limiters()
+	stream := net.NewLimitConn(net.NewStream(workConn),
+		[]*limit.Limiter{p.limitOut, userOut}, []*limit.Limiter{p.limitIn, userIn})
+	in, out, err := net.Join(net.NewTrafficConn(userConn, &p.bytesIn, &p.bytesOut), stream)
+	slog.Debugf("proxy:%s user conn %s closed in:%d out:%d err:%v",
+		p.name, userConn.RemoteAddr(), in, out, err)
+	p.account()
+}
+
+func (p *Proxy) Close() error {
+	p.account()
+	p.lnMu.Lock()
+	defer p.lnMu.Unlock()
+	if !p.closed {
+		ctl := p.control()
+		if p.portKey != "" {
+			ctl.svr.ports.Release(p.portKey, p.remotePort)
+		}
+		ctl.user.releaseProxy()
+		if p.quota != nil {
+			ctl.svr.quotas.unrestrict(*p.quota, p)
+		}
+	}
+	p.closed = true
+	if p.listener != nil {
+		return p.listener.Close()
+	}
+	return nil
+}
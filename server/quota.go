@@ -0,0 +1,476 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/plugin"
+	"github.com/gucooing/weiwei/pkg/traffic"
+)
+
+const (
+	quotaCheckInterval = 10 * time.Second
+)
+
+var (
+	ErrUnknownQuota = errors.New("unknown quota")
+)
+
+var defaultQuotaWarnAt = []int{80, 90}
+
+// quotaKey proxy is empty for the quota over all proxies of the user, client
+// is set on quotas asked for by weics without a user, they share no account
+type quotaKey struct {
+	user   string
+	client string
+	proxy  string
+}
+
+// quotaKey of the proxy quota of c
+func (c *Control) quotaKey(proxy string) quotaKey {
+	key := quotaKey{user: c.user.Name(), proxy: proxy}
+	if c.user == nil {
+		key.client = c.clientId
+	}
+	return key
+}
+
+// quota a byte limit per period, a reset or raise lasts until the period ends
+type quota struct {
+	// limit the lowest of base and requests
+	limit int64
+	// base configured limit, 0 for quotas only weic asked for
+	base     int64
+	requests map[*Proxy]int64
+	period   v1.QuotaPeriod
+	warnAt   []int
+
+	quotaState
+}
+
+// quotaState what is kept in the quota file across restarts
+type quotaState struct {
+	User        string    `json:"user"`
+	Client      string    `json:"client,omitempty"`
+	Proxy       string    `json:"proxy,omitempty"`
+	PeriodStart time.Time `json:"periodStart"`
+	// Baseline usage of the period before the last reset
+	Baseline int64 `json:"baseline,omitempty"`
+	// Raised limit for this period, 0 keeps the configured one
+	Raised int64 `json:"raised,omitempty"`
+	// Warned highest warnAt percent reported in this period
+	Warned    int  `json:"warned,omitempty"`
+	Exhausted bool `json:"exhausted,omitempty"`
+}
+
+type QuotaInfo struct {
+	User        string    `json:"user"`
+	Client      string    `json:"client,omitempty"`
+	Proxy       string    `json:"proxy,omitempty"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"periodStart"`
+	PeriodEnd   time.Time `json:"periodEnd"`
+	Limit       int64     `json:"limit"`
+	Used        int64     `json:"used"`
+	Exhausted   bool      `json:"exhausted"`
+}
+
+func (q *quota) effectiveLimit() int64 {
+	if q.Raised > 0 {
+		return q.Raised
+	}
+	return q.limit
+}
+
+type QuotaManager struct {
+	mu     sync.Mutex
+	svr    *Service
+	path   string
+	quotas map[quotaKey]*quota
+	// saved states of quotas not declared again since the restart
+	saved map[quotaKey]quotaState
+}
+
+func NewQuotaManager(svr *Service, path string) (*QuotaManager, error) {
+	qm := &QuotaManager{
+		svr:    svr,
+		path:   path,
+		quotas: make(map[quotaKey]*quota),
+		saved:  make(map[quotaKey]quotaState),
+	}
+	if err := qm.load(); err != nil {
+		return nil, err
+	}
+	for _, u := range config.Server.Auth.Users {
+		if u.Quota == nil {
+			continue
+		}
+		limit, _ := u.Quota.Limit.Bytes()
+		qm.declare(quotaKey{user: u.Name}, limit, u.Quota.Period, u.Quota.WarnAt)
+	}
+	for _, u := range config.Server.Auth.Users {
+		for name, q := range u.ProxyQuotas {
+			limit, _ := q.Limit.Bytes()
+			qm.declare(quotaKey{user: u.Name, proxy: name}, limit, q.Period, q.WarnAt)
+		}
+	}
+	return qm, nil
+}
+
+func (qm *QuotaManager) load() error {
+	buff, err := os.ReadFile(qm.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var states []quotaState
+	if err := json.Unmarshal(buff, &states); err != nil {
+		return err
+	}
+	for _, s := range states {
+		qm.saved[quotaKey{user: s.User, client: s.Client, proxy: s.Proxy}] = s
+	}
+	return nil
+}
+
+func (qm *QuotaManager) save() error {
+	qm.mu.Lock()
+	states := make([]quotaState, 0, len(qm.quotas)+len(qm.saved))
+	for _, q := range qm.quotas {
+		states = append(states, q.quotaState)
+	}
+	for _, s := range qm.saved {
+		states = append(states, s)
+	}
+	qm.mu.Unlock()
+
+	buff, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(qm.path), 0o700); err != nil {
+		return err
+	}
+	tmp := qm.path + ".tmp"
+	if err := os.WriteFile(tmp, buff, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, qm.path)
+}
+
+// declare adds the quota or updates its limit, the state of the current
+// period saved before a restart is picked up again
+func (qm *QuotaManager) declare(key quotaKey, limit int64, period v1.QuotaPeriod, warnAt []int) {
+	if warnAt == nil {
+		warnAt = defaultQuotaWarnAt
+	}
+	warnAt = slices.Sorted(slices.Values(warnAt))
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	q, ok := qm.quotas[key]
+	if !ok {
+		q = qm.add(key, period, warnAt)
+	}
+	q.base, q.period, q.warnAt = limit, period, warnAt
+	q.update()
+}
+
+// restrict a quota asked for by weic for pxy, it lowers the limit of a
+// quota already declared but never raises it or changes its period. The
+// limit is back to the lowest of the others once pxy is unrestricted
+func (qm *QuotaManager) restrict(key quotaKey, pxy *Proxy, limit int64, period v1.QuotaPeriod) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	q, ok := qm.quotas[key]
+	if !ok {
+		q = qm.add(key, period, defaultQuotaWarnAt)
+	}
+	q.requests[pxy] = limit
+	q.update()
+}
+
+// unrestrict drops the request of pxy, a quota nothing asks for any more is
+// removed and its state kept for when it is asked for again
+func (qm *QuotaManager) unrestrict(key quotaKey, pxy *Proxy) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	q, ok := qm.quotas[key]
+	if !ok {
+		return
+	}
+	delete(q.requests, pxy)
+	if q.base == 0 && len(q.requests) == 0 {
+		delete(qm.quotas, key)
+		qm.saved[key] = q.quotaState
+		return
+	}
+	q.update()
+}
+
+// update sets limit from base and requests
+func (q *quota) update() {
+	q.limit = q.base
+	for _, limit := range q.requests {
+		if q.limit == 0 || limit < q.limit {
+			q.limit = limit
+		}
+	}
+}
+
+// add must hold qm.mu
+func (qm *QuotaManager) add(key quotaKey, period v1.QuotaPeriod, warnAt []int) *quota {
+	q := &quota{
+		requests: make(map[*Proxy]int64),
+		period:   period,
+		warnAt:   warnAt,
+		quotaState: quotaState{
+			User:        key.user,
+			Client:      key.client,
+			Proxy:       key.proxy,
+			PeriodStart: period.Start(time.Now()),
+		},
+	}
+	if s, ok := qm.saved[key]; ok {
+		delete(qm.saved, key)
+		if s.PeriodStart.Equal(q.PeriodStart) {
+			q.quotaState = s
+		}
+	}
+	qm.quotas[key] = q
+	return q
+}
+
+// exhausted whether the quota of the user or of the proxy is used up
+func (qm *QuotaManager) exhausted(c *Control, proxy string) bool {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	for _, key := range []quotaKey{{user: c.user.Name()}, c.quotaKey(proxy)} {
+		if q, ok := qm.quotas[key]; ok && q.Exhausted {
+			return true
+		}
+	}
+	return false
+}
+
+// used bytes of the quota in its current period
+func (qm *QuotaManager) used(key quotaKey, q *quota) int64 {
+	usage := qm.svr.traffic.UsageSince(q.PeriodStart, func(k traffic.Key) bool {
+		return k.User == key.user && (key.client == "" || k.Client == key.client) &&
+			(key.proxy == "" || k.Proxy == key.proxy)
+	})
+	return usage.Total() - q.Baseline
+}
+
+func (svr *Service) quotaLoop() {
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svr.ctx.Done():
+			return
+		case <-ticker.C:
+			svr.quotas.check()
+		}
+	}
+}
+
+// check rolls quotas into a new period, reports thresholds and suspends or
+// resumes the proxies
+func (qm *QuotaManager) check() {
+	qm.svr.accountProxies()
+	now := time.Now()
+	var events []*plugin.QuotaContent
+	changed := false
+
+	qm.mu.Lock()
+	for key, q := range qm.quotas {
+		if !now.Before(q.period.Next(q.PeriodStart)) {
+			q.PeriodStart = q.period.Start(now)
+			q.Baseline, q.Raised, q.Warned = 0, 0, 0
+			changed = true
+		}
+		used := qm.used(key, q)
+		limit := q.effectiveLimit()
+		percent := int(used * 100 / limit)
+		event := func(name string) {
+			events = append(events, &plugin.QuotaContent{
+				User:        key.user,
+				Client:      key.client,
+				Proxy:       key.proxy,
+				Event:       name,
+				Period:      string(q.period),
+				PeriodStart: q.PeriodStart,
+				Limit:       limit,
+				Used:        used,
+				Percent:     percent,
+			})
+			changed = true
+		}
+		for i := len(q.warnAt) - 1; i >= 0; i-- {
+			if w := q.warnAt[i]; percent >= w {
+				if w > q.Warned && used < limit {
+					q.Warned = w
+					event(plugin.QuotaWarning)
+				}
+				break
+			}
+		}
+		switch {
+		case used >= limit && !q.Exhausted:
+			q.Exhausted = true
+			q.Warned = 100
+			event(plugin.QuotaExhausted)
+		case used < limit && q.Exhausted:
+			q.Exhausted = false
+			q.Warned = 0
+			event(plugin.QuotaResumed)
+		}
+	}
+	qm.mu.Unlock()
+
+	for _, e := range events {
+		switch e.Event {
+		case plugin.QuotaResumed:
+			slog.Infof("quota user:%s client:%s proxy:%s resumed %d/%d bytes",
+				e.User, e.Client, e.Proxy, e.Used, e.Limit)
+		case plugin.QuotaExhausted:
+			slog.Warnf("quota user:%s client:%s proxy:%s exhausted %d/%d bytes, proxies suspended",
+				e.User, e.Client, e.Proxy, e.Used, e.Limit)
+		default:
+			slog.Warnf("quota user:%s client:%s proxy:%s %d%% used %d/%d bytes",
+				e.User, e.Client, e.Proxy, e.Percent, e.Used, e.Limit)
+		}
+		qm.svr.pluginManager.Quota(e)
+	}
+	qm.apply()
+	if changed {
+		if err := qm.save(); err != nil {
+			slog.Errorf("quota save err:%v", err)
+		}
+	}
+}
+
+// apply suspends the proxies whose quota is used up and resumes the others
+func (qm *QuotaManager) apply() {
+	for _, ctls := range [][]*Control{qm.svr.controlManager.Controls(), qm.svr.controlManager.Parked()} {
+		for _, c := range ctls {
+			c.proxiesMu.Lock()
+			proxies := make([]*Proxy, 0, len(c.proxies))
+			for _, pxy := range c.proxies {
+				proxies = append(proxies, pxy)
+			}
+			c.proxiesMu.Unlock()
+			for _, pxy := range proxies {
+				qm.applyProxy(c, pxy)
+			}
+		}
+	}
+}
+
+func (qm *QuotaManager) applyProxy(c *Control, pxy *Proxy) {
+	user := c.user.Name()
+	if qm.exhausted(c, pxy.name) {
+		if !pxy.isSuspended() {
+			pxy.suspend()
+			slog.Infof("proxy:%s user:%s suspended by quota", pxy.name, user)
+		}
+		return
+	}
+	if pxy.isSuspended() {
+		if err := pxy.resume(); err != nil {
+			slog.Warnf("proxy:%s user:%s resume err:%v", pxy.name, user, err)
+			return
+		}
+		slog.Infof("proxy:%s user:%s resumed", pxy.name, user)
+	}
+}
+
+// Reset starts counting the quota from zero until the period ends
+func (qm *QuotaManager) Reset(user, client, proxy string) error {
+	key := quotaKey{user: user, client: client, proxy: proxy}
+	qm.svr.accountProxies()
+	qm.mu.Lock()
+	q, ok := qm.quotas[key]
+	if !ok {
+		qm.mu.Unlock()
+		return ErrUnknownQuota
+	}
+	q.Baseline += qm.used(key, q)
+	q.Warned = 0
+	qm.mu.Unlock()
+	slog.Infof("quota user:%s client:%s proxy:%s reset", user, client, proxy)
+	qm.check()
+	return nil
+}
+
+// Raise sets the limit until the period ends
+func (qm *QuotaManager) Raise(user, client, proxy string, limit int64) error {
+	key := quotaKey{user: user, client: client, proxy: proxy}
+	qm.mu.Lock()
+	q, ok := qm.quotas[key]
+	if !ok {
+		qm.mu.Unlock()
+		return ErrUnknownQuota
+	}
+	q.Raised = limit
+	qm.mu.Unlock()
+	slog.Infof("quota user:%s client:%s proxy:%s limit raised to %d bytes", user, client, proxy, limit)
+	qm.check()
+	return nil
+}
+
+func (qm *QuotaManager) List() []QuotaInfo {
+	qm.svr.accountProxies()
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	infos := make([]QuotaInfo, 0, len(qm.quotas))
+	for key, q := range qm.quotas {
+		infos = append(infos, QuotaInfo{
+			User:        key.user,
+			Client:      key.client,
+			Proxy:       key.proxy,
+			Period:      string(q.period),
+			PeriodStart: q.PeriodStart,
+			PeriodEnd:   q.period.Next(q.PeriodStart),
+			Limit:       q.effectiveLimit(),
+			Used:        qm.used(key, q),
+			Exhausted:   q.Exhausted,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].User != infos[j].User {
+			return infos[i].User < infos[j].User
+		}
+		if infos[i].Client != infos[j].Client {
+			return infos[i].Client < infos[j].Client
+		}
+		return infos[i].Proxy < infos[j].Proxy
+	})
+	return infos
+}
@@ -0,0 +1,114 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+func newTestQuotaManager() *QuotaManager {
+	return &QuotaManager{
+		quotas: make(map[quotaKey]*quota),
+		saved:  make(map[quotaKey]quotaState),
+	}
+}
+
+func TestQuotaRestrict(t *testing.T) {
+	qm := newTestQuotaManager()
+	key := quotaKey{user: "u", proxy: "p"}
+	qm.declare(key, 100, v1.QuotaPeriodMonth, nil)
+
+	a, b := &Proxy{}, &Proxy{}
+	qm.restrict(key, a, 1000, v1.QuotaPeriodDay)
+	if q := qm.quotas[key]; q.limit != 100 || q.period != v1.QuotaPeriodMonth {
+		t.Fatalf("weic raised the quota to %d %s", q.limit, q.period)
+	}
+	qm.restrict(key, b, 50, v1.QuotaPeriodDay)
+	if q := qm.quotas[key]; q.limit != 50 || q.period != v1.QuotaPeriodMonth {
+		t.Fatalf("quota %d %s, want 50 month", q.limit, q.period)
+	}
+	qm.restrict(key, a, 80, v1.QuotaPeriodMonth)
+	if q := qm.quotas[key]; q.limit != 50 {
+		t.Fatalf("re-declare raised the quota to %d", q.limit)
+	}
+
+	// without a quota on weis weic may limit itself
+	own := quotaKey{user: "u", proxy: "own"}
+	qm.restrict(own, a, 10, v1.QuotaPeriodDay)
+	if q := qm.quotas[own]; q == nil || q.limit != 10 || q.period != v1.QuotaPeriodDay {
+		t.Fatalf("quota %+v, want 10 day", q)
+	}
+}
+
+func TestQuotaUnrestrict(t *testing.T) {
+	qm := newTestQuotaManager()
+	key := quotaKey{user: "u", proxy: "p"}
+	qm.declare(key, 100, v1.QuotaPeriodMonth, nil)
+
+	a, b := &Proxy{}, &Proxy{}
+	qm.restrict(key, a, 50, v1.QuotaPeriodMonth)
+	qm.restrict(key, b, 80, v1.QuotaPeriodMonth)
+	qm.unrestrict(key, a)
+	if q := qm.quotas[key]; q.limit != 80 {
+		t.Fatalf("quota %d after the lowest request closed, want 80", q.limit)
+	}
+	qm.unrestrict(key, b)
+	if q := qm.quotas[key]; q.limit != 100 {
+		t.Fatalf("quota %d after every request closed, want the configured 100", q.limit)
+	}
+	qm.declare(key, 200, v1.QuotaPeriodMonth, nil)
+	if q := qm.quotas[key]; q.limit != 200 {
+		t.Fatalf("quota %d after the config raised it, want 200", q.limit)
+	}
+
+	// a quota only weic asked for goes with its proxy, its usage is kept
+	own := quotaKey{user: "u", proxy: "own"}
+	qm.restrict(own, a, 10, v1.QuotaPeriodDay)
+	qm.quotas[own].Baseline = 5
+	qm.unrestrict(own, a)
+	if _, ok := qm.quotas[own]; ok {
+		t.Fatal("quota kept after its proxy closed")
+	}
+	qm.restrict(own, b, 20, v1.QuotaPeriodDay)
+	if q := qm.quotas[own]; q.limit != 20 || q.Baseline != 5 {
+		t.Fatalf("quota %d baseline %d, want 20 and the saved 5", q.limit, q.Baseline)
+	}
+}
+
+func TestQuotaSharedToken(t *testing.T) {
+	qm := newTestQuotaManager()
+	ctlA := &Control{clientId: "a"}
+	ctlB := &Control{clientId: "b"}
+	pxyA, pxyB := &Proxy{name: "p"}, &Proxy{name: "p"}
+	keyA, keyB := ctlA.quotaKey("p"), ctlB.quotaKey("p")
+	if keyA == keyB {
+		t.Fatalf("weics without a user share the quota key %+v", keyA)
+	}
+	qm.restrict(keyA, pxyA, 10, v1.QuotaPeriodDay)
+	qm.restrict(keyB, pxyB, 1000, v1.QuotaPeriodMonth)
+	if q := qm.quotas[keyB]; q.limit != 1000 || q.period != v1.QuotaPeriodMonth {
+		t.Fatalf("quota of b %d %s, want 1000 month", q.limit, q.period)
+	}
+
+	qm.quotas[keyA].Exhausted = true
+	if !qm.exhausted(ctlA, "p") {
+		t.Fatal("quota of a not exhausted")
+	}
+	if qm.exhausted(ctlB, "p") {
+		t.Fatal("quota of a suspends the proxy of b")
+	}
+}
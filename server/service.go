@@ -18,25 +18,37 @@ import (
 	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/gookit/slog"
 
 	"github.com/gucooing/weiwei/pkg/auth"
 	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/enroll"
 	"github.com/gucooing/weiwei/pkg/env"
+	"github.com/gucooing/weiwei/pkg/ipfilter"
 	"github.com/gucooing/weiwei/pkg/msg"
 	"github.com/gucooing/weiwei/pkg/net"
+	"github.com/gucooing/weiwei/pkg/plugin"
+	"github.com/gucooing/weiwei/pkg/traffic"
+	"github.com/gucooing/weiwei/pkg/util"
+	"github.com/gucooing/weiwei/pkg/util/compress"
 	"github.com/gucooing/weiwei/pkg/util/crypt"
 )
 
 const (
-	connReadTimeout time.Duration = 10 * time.Second
+	// ipFileCheckInterval how often ip rule files are checked for changes
+	ipFileCheckInterval = 5 * time.Second
 )
 
 var (
 	ErrWeicLoginTime = errors.New("weic login timeout")
 	ErrUnknownClient = errors.New("unknown client")
+	ErrProtocol      = errors.New("incompatible protocol version")
 )
 
 type Service struct {
@@ -48,14 +60,47 @@ type Service struct {
 	// weiListener service discovery listener
 	weiListener net.Listener
 
-	// weicLoginVerifier weic login auth
+	// weicLoginVerifier weic login auth, nil when only users can login
 	weicLoginVerifier auth.Verifier
 
+	// userManager weic accounts
+	userManager *UserManager
+
+	// pluginManager operation webhooks
+	pluginManager *plugin.Manager
+
+	// enrollStore enrollment tokens and client credentials
+	enrollStore *enroll.Store
+
 	// weicLoginCrypt weic login crypt
 	weicLoginCrypt crypt.Crypt
 
 	// ControlManager
 	controlManager *ControlManager
+
+	// traffic usage accounting
+	traffic *traffic.Store
+
+	// ports remote port ranges and allocations
+	ports *PortManager
+
+	// preAuth limits on conns until they authenticate
+	preAuth *preAuthGuard
+
+	// denyFilter server wide denyIPs checked on every proxy
+	denyFilter *ipfilter.Filter
+
+	// quotas traffic quotas of users and proxies
+	quotas *QuotaManager
+
+	// metrics prometheus metrics, served by the apiServer
+	metrics *serverMetrics
+
+	// apiServer admin HTTP API, nil when disabled
+	apiServer *ApiServer
+
+	// closing set once Close starts
+	closing atomic.Bool
 }
 
 func NewService() (*Service, error) {
@@ -70,13 +115,29 @@ func NewService() (*Service, error) {
 	slog.Debugf("network:%s address:%s new weiListener success", config.Server.ApiNetwork, config.Server.ApiAddress)
 	s.weiListener = wln
 
-	slog.Debugf("new weicLoginVerifier...")
-	wlv, err := auth.NewVerifier(config.Server.Auth.Method, config.Server.Auth.Token)
+	auth.SetMaxSkew(time.Duration(config.Server.Auth.MaxClockSkew) * time.Second)
+	if config.Server.Auth.Token != "" || len(config.Server.Auth.Users) == 0 ||
+		config.Server.Auth.Method == v1.AuthMethodOidc {
+		slog.Debugf("new weicLoginVerifier...")
+		wlv, err := auth.NewServerVerifier(config.Server.Auth)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debugf("new weicLoginVerifier success")
+		s.weicLoginVerifier = wlv
+	}
+
+	slog.Debugf("new userManager...")
+	var template *v1.User
+	if config.Server.Auth.Oidc != nil {
+		template = config.Server.Auth.Oidc.DefaultUser
+	}
+	um, err := NewUserManager(config.Server.Auth.Method, config.Server.Auth.Users, template)
 	if err != nil {
 		return nil, err
 	}
-	slog.Debugf("new weicLoginVerifier success")
-	s.weicLoginVerifier = wlv
+	slog.Debugf("userManager users:%v success", len(config.Server.Auth.Users))
+	s.userManager = um
 
 	slog.Debugf("new weicLoginCrypt...")
 	cry := &crypt.XOR{
@@ -88,6 +149,53 @@ func NewService() (*Service, error) {
 
 	s.controlManager = NewControlManager()
 
+	s.metrics = newServerMetrics(s)
+
+	s.preAuth = newPreAuthGuard(config.Server.PreAuth, s.metrics)
+
+	s.pluginManager = plugin.NewManager(config.Server.HTTPPlugins)
+
+	s.enrollStore = enroll.NewStore(config.Server.EnrollFile())
+
+	deny, err := ipfilter.Load(config.Server.DenyIPs, config.Server.DenyIPsFile)
+	if err != nil {
+		return nil, err
+	}
+	if s.denyFilter, err = ipfilter.New(nil, deny); err != nil {
+		return nil, err
+	}
+
+	slog.Debugf("load traffic file:%s...", config.Server.TrafficFile())
+	ts, err := newTrafficStore()
+	if err != nil {
+		return nil, err
+	}
+	s.traffic = ts
+
+	slog.Debugf("load ports file:%s...", config.Server.PortsFile())
+	pm, err := NewPortManager(config.Server.PortsFile(), config.Server.AllowPorts,
+		time.Duration(config.Server.PortLease)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	s.ports = pm
+
+	slog.Debugf("load quota file:%s...", config.Server.QuotaFile())
+	qm, err := NewQuotaManager(s, config.Server.QuotaFile())
+	if err != nil {
+		return nil, err
+	}
+	s.quotas = qm
+
+	if config.Server.WebServer != nil {
+		slog.Debugf("new apiServer...")
+		api, err := NewApiServer(s, config.Server.WebServer)
+		if err != nil {
+			return nil, err
+		}
+		s.apiServer = api
+	}
+
 	slog.Debugf("new multiListener...")
 
 	slog.Debugf("server service success")
@@ -100,7 +208,15 @@ func (svr *Service) Run(ctx context.Context) {
 	svr.ctx = ctx
 	svr.cancel = cancel
 
-	svr.mainHandle()
+	go svr.mainHandle()
+	go svr.trafficLoop()
+	go svr.quotaLoop()
+	go svr.denyIPsLoop()
+	go svr.preAuthLoop()
+	go svr.revokedLoop()
+	if svr.apiServer != nil {
+		go svr.apiServer.Run()
+	}
 	<-svr.ctx.Done()
 	// service context
 	svr.Close()
@@ -108,12 +224,39 @@ func (svr *Service) Run(ctx context.Context) {
 
 func (svr *Service) Close() {
 	slog.Debugf("server service close...")
+	svr.closing.Store(true)
+	// no new weic while the old ones drain
 	svr.weiListener.Close()
 	svr.controlManager.Close()
+	if svr.apiServer != nil {
+		svr.apiServer.Close()
+	}
+	svr.accountProxies()
+	if err := svr.traffic.Flush(); err != nil {
+		slog.Errorf("traffic flush err:%v", err)
+	}
 
 	slog.Debugf("server service close success")
 }
 
+// denyIPsLoop reloads denyIPsFile when it changes
+func (svr *Service) denyIPsLoop() {
+	if config.Server.DenyIPsFile == "" {
+		return
+	}
+	ipfilter.Watch(svr.ctx, ipFileCheckInterval, []string{config.Server.DenyIPsFile}, func() {
+		deny, err := ipfilter.Load(config.Server.DenyIPs, config.Server.DenyIPsFile)
+		if err == nil {
+			err = svr.denyFilter.Update(nil, deny)
+		}
+		if err != nil {
+			slog.Warnf("reload denyIPsFile %s err:%v", config.Server.DenyIPsFile, err)
+			return
+		}
+		slog.Infof("reload denyIPsFile %s rules:%d", config.Server.DenyIPsFile, len(deny))
+	})
+}
+
 func (svr *Service) mainHandle() {
 	slog.Debugf("run server service mainHandle")
 	for {
@@ -122,9 +265,17 @@ func (svr *Service) mainHandle() {
 			slog.Printf("server service weiListener accept err:%v", err)
 			return
 		}
+		ip := remoteIP(conn.RemoteAddr())
+		if reason, ok := svr.preAuth.admit(ip); !ok {
+			conn.Close()
+			slog.Debugf("addr:%s conn refused: %s", conn.RemoteAddr().String(), reason)
+			continue
+		}
 		conn.SetCrypt(svr.weicLoginCrypt)
+		conn.SetMaxFrameSize(config.Server.PreAuthMaxFrameSize)
 		go func(conn net.Conn) {
 			lerr := svr.newConn(conn)
+			svr.preAuth.release(ip, lerr)
 			if lerr != nil {
 				conn.Close()
 				slog.Errorf("addr:%s new conn  err:%v", conn.RemoteAddr().String(), lerr)
@@ -133,69 +284,215 @@ func (svr *Service) mainHandle() {
 	}
 }
 
+// newConn authenticates a login or a work conn, the socket deadline ends
+// the exchange after loginTimeout and is cleared once it is handed over
 func (svr *Service) newConn(conn net.Conn) error {
-	ctx := context.Background()
-	loginCtx, cancel := context.WithTimeout(ctx, connReadTimeout)
-	defer cancel()
-
-	select {
-	case <-loginCtx.Done():
-		ctx.Err()
+	conn.SetDeadline(time.Now().Add(time.Duration(config.Server.PreAuth.LoginTimeout) * time.Second))
+	err := svr.readFirstMsg(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
 		return ErrWeicLoginTime
+	}
+	return err
+}
+
+func (svr *Service) readFirstMsg(conn net.Conn) error {
+	rawMsg, err := msg.ReadMsg(conn)
+	if err != nil {
+		return err
+	}
+	switch m := rawMsg.(type) {
+	case *msg.CSLoginReq: // new weic
+		err := svr.loginWeic(conn, m)
+		svr.metrics.login(err)
+		return err
+	case *msg.CSAddWorkConnRsp: // new work conn
+		cry, ok := svr.controlManager.GetControl(string(m.RunId))
+		if !ok {
+			return ErrUnknownClient
+		}
+		return cry.addWorkConn(conn, m)
 	default:
-		rawMsg, err := msg.ReadMsg(conn)
+		return ErrUnknownClient
+	}
+}
+
+func (svr *Service) verifyLogin(loginReq *msg.CSLoginReq) (*User, error) {
+	// enrolled weic
+	if loginReq.ClientId != "" {
+		return svr.verifyCredential(loginReq)
+	}
+	// identity carried by the login key
+	if iv, ok := svr.weicLoginVerifier.(auth.IdentityVerifier); ok {
+		identity, err := iv.VerifyIdentity(loginReq.LoginKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		switch m := rawMsg.(type) {
-		case *msg.CSLoginReq: // new weic
-			return svr.loginWeic(conn, m)
-		case *msg.CSAddWorkConnRsp: // new work conn
-			cry, ok := svr.controlManager.GetControl(m.RunId)
-			if !ok {
-				return ErrUnknownClient
-			}
-			return cry.addWorkConn(conn, m)
-		default:
-			return ErrUnknownClient
+		return svr.userManager.GetOrAddUser(identity)
+	}
+	if loginReq.User == "" {
+		if svr.weicLoginVerifier == nil {
+			return nil, ErrUnknownUser
 		}
+		return nil, svr.weicLoginVerifier.
+			VerifyLogin(loginReq.Timestamp, "", loginReq.Nonce, loginReq.LoginKey)
+	}
+	user, ok := svr.userManager.GetUser(loginReq.User)
+	if !ok || user.verifier == nil {
+		return nil, ErrUnknownUser
 	}
+	return user, user.verifier.
+		VerifyLogin(loginReq.Timestamp, "", loginReq.Nonce, loginReq.LoginKey)
+}
 
+// refuseLogin tells weic why it is refused before the conn is closed
+func (svr *Service) refuseLogin(conn net.Conn, err error) error {
+	msg.WriteMsg(conn, &msg.SCLoginRsp{
+		Version: env.Version,
+		Error:   err.Error(),
+	})
+	return err
 }
 
-func (svr *Service) loginWeic(conn net.Conn, loginReq *msg.CSLoginReq) error {
+func (svr *Service) loginWeic(conn net.Conn, loginReq *msg.CSLoginReq) (err error) {
+	// protocol
+	version := msg.NegotiateVersion(loginReq.ProtocolVersion)
+	if version == 0 {
+		return svr.refuseLogin(conn, fmt.Errorf("%w: weic %d, weis accepts %d-%d",
+			ErrProtocol, loginReq.ProtocolVersion, msg.MinProtocolVersion, msg.ProtocolVersion))
+	}
+	caps := loginReq.Capabilities & msg.LocalCapabilities
+	// plugin
+	content, err := svr.pluginManager.Login(&plugin.LoginContent{
+		CSLoginReq: *loginReq,
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		return err
+	}
+	loginReq = &content.CSLoginReq
 	// auth
-	if err := svr.weicLoginVerifier.
-		VerifyLogin(loginReq.Timestamp, loginReq.LoginKey); err != nil {
+	var user *User
+	var cred *enroll.Credential
+	var sealedSecret string
+	if loginReq.EnrollToken != "" {
+		user, cred, sealedSecret, err = svr.enrollLogin(conn, loginReq)
+	} else {
+		user, err = svr.verifyLogin(loginReq)
+	}
+	if err != nil {
 		return err
 	}
-	slog.Debugf("addr:%s loginReq version:%s token:%s",
-		conn.RemoteAddr().String(), loginReq.Version, loginReq.LoginKey)
+	defer user.loginDone()
+	if cred != nil {
+		// the token is only spent by a login that completes
+		defer func() {
+			if err != nil {
+				svr.rollbackEnroll(loginReq.EnrollToken, cred)
+			}
+		}()
+	}
+	// the login key is a reusable bearer token with oidc, it stays out of the log
+	slog.Debugf("addr:%s loginReq version:%s auth:%s user:%s",
+		conn.RemoteAddr().String(), loginReq.Version, config.Server.Auth.Method, user.Name())
 	// new weic
-	cl, err := NewControl(conn)
+	cl, err := NewControl(svr, conn, user)
 	if err != nil {
 		return err
 	}
+	cl.clientId = util.EmptyDefault(loginReq.ClientId, util.EmptyDefault(loginReq.InstanceId, cl.runId))
+	if cred != nil {
+		cl.clientId = cred.ClientId
+		cl.credentialId = cred.ClientId
+	} else if loginReq.ClientId != "" {
+		// verifyLogin checked the credential
+		cl.credentialId = loginReq.ClientId
+	}
+	cl.version = loginReq.Version
+	cl.protocolVersion = version
+	cl.caps = caps
+	if !caps.Has(msg.CapSessionKey) {
+		if err := cl.useSeedSession(version); err != nil {
+			cl.Close()
+			return err
+		}
+	}
+	cl.instanceKey = instanceKey(user, loginReq.InstanceId)
+	cl.resumeToken = util.NewNonce(32)
+	if err := svr.controlManager.AddControl(cl.runId, cl, loginReq.ResumeToken); err != nil {
+		// weic learns why before the conn is closed
+		if errors.Is(err, ErrGoingAway) {
+			// logged in while weis shuts down
+			msg.WriteMsg(conn, &msg.SCKickNotify{
+				Code:           msg.KickServerShutdown,
+				Reason:         "weis shutdown",
+				ReconnectDelay: config.Server.ReconnectDelay,
+			})
+		} else {
+			svr.refuseLogin(conn, err)
+		}
+		cl.Close()
+		return err
+	}
 
 	loginRsp := &msg.SCLoginRsp{
-		Version: env.Version,
-		Seed:    cl.seed,
-		RunId:   cl.runId,
+		Version:         env.Version,
+		SessionKey:      cl.sessionKey,
+		RunId:           msg.SessionId(cl.runId),
+		Seed:            cl.seed,
+		ProtocolVersion: version,
+		Capabilities:    caps,
+		ResumeToken:     cl.resumeToken,
+		ResumedProxies:  cl.resumedProxies,
+	}
+	codec := msg.NegotiateCodec(caps)
+	if codec != msg.JsonCodec {
+		loginRsp.Codec = codec.Name()
+	}
+	cl.dispatcher.SetCodec(codec)
+	cl.dispatcher.SetEnvelope(caps.Has(msg.CapEnvelope))
+	comp := negotiateCompress(loginReq.Compress, caps)
+	if comp != compress.CompressTypeNone {
+		loginRsp.Compress = string(comp)
+	}
+	if cred != nil {
+		loginRsp.ClientId = cred.ClientId
+		loginRsp.ClientSecret = sealedSecret
 	}
-	cry, err := crypt.NewCrypt(crypt.CryptTypeXor, loginRsp.Seed)
+	cry, err := cl.sessionCrypt()
 	if err != nil {
+		svr.controlManager.DelControl(cl.runId)
 		return err
 	}
-	defer conn.SetCrypt(cry)
-	slog.Debugf("addr:%s loginRsp version:%s runId:%v seed:%v",
-		conn.RemoteAddr().String(), loginRsp.Version, loginRsp.RunId, loginRsp.Seed)
+	cmp, err := compress.NewCompress(comp)
+	if err != nil {
+		svr.controlManager.DelControl(cl.runId)
+		return err
+	}
+	slog.Debugf("addr:%s loginRsp version:%s protocol:%d runId:%v codec:%s compress:%s caps:%v",
+		conn.RemoteAddr().String(), loginRsp.Version, version, loginRsp.RunId,
+		codec.Name(), comp, caps.Names())
 	_, err = msg.WriteMsg(conn, loginRsp)
 	if err != nil {
+		svr.controlManager.DelControl(cl.runId)
 		return err
 	}
+	// before the dispatcher reads
+	conn.SetDeadline(time.Time{})
+	conn.SetMaxFrameSize(config.Server.MaxFrameSize)
+	conn.SetCrypt(cry)
+	conn.SetCompress(cmp)
 	go func() {
-		defer svr.controlManager.DelControl(loginRsp.RunId)
+		defer svr.controlManager.DelControl(cl.runId)
 		cl.Start()
 	}()
 	return nil
 }
+
+// negotiateCompress weic preferred compression when both sides have it
+func negotiateCompress(want string, shared msg.Capability) compress.CompressType {
+	c, ok := msg.CapabilityByName(want)
+	if !ok || c&(msg.CapCompressGzip|msg.CapCompressSnappy) == 0 || !shared.Has(c) {
+		return compress.CompressTypeNone
+	}
+	return compress.CompressType(want)
+}
@@ -0,0 +1,333 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	gonet "net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/auth"
+	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/msg"
+	"github.com/gucooing/weiwei/pkg/net"
+	"github.com/gucooing/weiwei/pkg/util"
+	"github.com/gucooing/weiwei/pkg/util/crypt"
+)
+
+const testToken = "test-token"
+
+// testService runs a weis on a free local port, returns its address
+func testService(t *testing.T, method v1.AuthMethod, opts ...func(*v1.ServerConfig)) string {
+	t.Helper()
+	ln, err := gonet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	config.Server = &v1.ServerConfig{
+		ApiNetwork: "tcp",
+		ApiAddress: addr,
+		DataDir:    t.TempDir(),
+		Log:        &v1.Log{Level: slog.ErrorLevel},
+		Auth: &v1.AuthConfig{
+			Method: method,
+			Token:  testToken,
+			XorKey: 42,
+		},
+	}
+	for _, opt := range opts {
+		opt(config.Server)
+	}
+	if err := config.Server.Init(); err != nil {
+		t.Fatal(err)
+	}
+	svr, err := NewService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svr.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return addr
+}
+
+func testDial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetCrypt(&crypt.XOR{Seed: 42, XorKey: crypt.SeedNewXorKey(42)})
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// testLogin logs a weic in, returns its runId and session key
+func testLogin(t *testing.T, addr string) (string, string) {
+	t.Helper()
+	rsp := sendLogin(t, testDial(t, addr), "")
+	if rsp.Error != "" {
+		t.Fatalf("login refused: %s", rsp.Error)
+	}
+	return string(rsp.RunId), rsp.SessionKey
+}
+
+// sendLogin logs in on conn as instanceId, returns the reply of weis
+func sendLogin(t *testing.T, conn net.Conn, instanceId string) *msg.SCLoginRsp {
+	t.Helper()
+	h, err := auth.NewHmac(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Now().UnixNano()
+	nonce := util.NewNonce(16)
+	if _, err := msg.WriteMsg(conn, &msg.CSLoginReq{
+		Timestamp:       timestamp,
+		LoginKey:        h.SetVerifyLogin(timestamp, "", nonce),
+		Nonce:           nonce,
+		ProtocolVersion: msg.ProtocolVersion,
+		Capabilities:    msg.LocalCapabilities,
+		InstanceId:      instanceId,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	rawMsg, err := msg.ReadMsg(conn)
+	if err != nil {
+		t.Fatalf("login reply: %v", err)
+	}
+	rsp, ok := rawMsg.(*msg.SCLoginRsp)
+	if !ok {
+		t.Fatalf("login reply %T", rawMsg)
+	}
+	return rsp
+}
+
+// workConnLogin the work conn login of runId signed with key
+func workConnLogin(t *testing.T, runId, key string) *msg.CSAddWorkConnRsp {
+	t.Helper()
+	h, err := auth.NewHmac(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Now().UnixNano()
+	nonce := util.NewNonce(16)
+	return &msg.CSAddWorkConnRsp{
+		RunId:     msg.SessionId(runId),
+		Timestamp: timestamp,
+		LoginKey:  h.SetVerifyLogin(timestamp, runId, nonce),
+		Nonce:     nonce,
+	}
+}
+
+// openWorkConn sends req on a new work conn, true when weis closed it
+func openWorkConn(t *testing.T, addr string, req *msg.CSAddWorkConnRsp) bool {
+	t.Helper()
+	conn := testDial(t, addr)
+	if _, err := msg.WriteMsg(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err := conn.Read()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	if err == nil {
+		t.Fatal("work conn got data before a user conn")
+	}
+	return true
+}
+
+func TestWorkConnAuth(t *testing.T) {
+	addr := testService(t, v1.AuthMethodHmac)
+	runId, sessionKey := testLogin(t, addr)
+
+	if !openWorkConn(t, addr, workConnLogin(t, util.NewSessionId(), sessionKey)) {
+		t.Error("work conn with an unknown runId was kept")
+	}
+	if !openWorkConn(t, addr, workConnLogin(t, runId, util.NewNonce(16))) {
+		t.Error("work conn with a wrong hmac key was kept")
+	}
+	req := workConnLogin(t, runId, sessionKey)
+	if openWorkConn(t, addr, req) {
+		t.Fatal("valid work conn was closed")
+	}
+	if !openWorkConn(t, addr, req) {
+		t.Error("work conn with a replayed login key was kept")
+	}
+	stale := workConnLogin(t, runId, sessionKey)
+	stale.Timestamp = time.Now().Add(-time.Hour).UnixNano()
+	h, _ := auth.NewHmac(sessionKey)
+	stale.LoginKey = h.SetVerifyLogin(stale.Timestamp, runId, stale.Nonce)
+	if !openWorkConn(t, addr, stale) {
+		t.Error("work conn with a stale timestamp was kept")
+	}
+}
+
+// baselineLoginReq, baselineLoginRsp and baselineWorkConn the messages of
+// a weic that predates protocol versions, only json and an int64 runId
+type baselineLoginReq struct {
+	Version   string `json:"version,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	LoginKey  string `json:"loginKey,omitempty"`
+}
+
+type baselineLoginRsp struct {
+	Version string `json:"version,omitempty"`
+	Seed    int64  `json:"seed,omitempty"`
+	RunId   int64  `json:"runId,omitempty"`
+}
+
+type baselineWorkConn struct {
+	RunId     int64  `json:"runId,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	LoginKey  string `json:"loginKey,omitempty"`
+}
+
+type baselinePing struct {
+	ClientTimestamp int64 `json:"clientTimestamp,omitempty"`
+}
+
+func cmdIdOf(t *testing.T, m msg.Message) uint16 {
+	t.Helper()
+	cmdId, err := msg.GetCmdIdByMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmdId
+}
+
+// writeBaseline sends v as json after the cmd id of m, as a baseline weic does
+func writeBaseline(t *testing.T, conn net.Conn, m msg.Message, v any) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := binary.BigEndian.AppendUint16(nil, cmdIdOf(t, m))
+	if _, err := conn.Write(append(buf, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readBaseline reads the next message of type m into v, skipping others
+func readBaseline(t *testing.T, conn net.Conn, m msg.Message, v any) {
+	t.Helper()
+	want := cmdIdOf(t, m)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, bin, err := conn.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bin) < 2 || binary.BigEndian.Uint16(bin) != want {
+			continue
+		}
+		if err := json.Unmarshal(bin[2:], v); err != nil {
+			t.Fatalf("baseline weic can not read %T: %v", m, err)
+		}
+		return
+	}
+}
+
+// openBaselineWorkConn true when weis closed the work conn
+func openBaselineWorkConn(t *testing.T, addr string, req *baselineWorkConn) bool {
+	t.Helper()
+	conn := testDial(t, addr)
+	writeBaseline(t, conn, &msg.CSAddWorkConnRsp{}, req)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err := conn.Read()
+	return !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestBaselineLogin(t *testing.T) {
+	addr := testService(t, v1.AuthMethodToken)
+	conn := testDial(t, addr)
+	token, _ := auth.NewToken(testToken)
+	timestamp := time.Now().UnixNano()
+	writeBaseline(t, conn, &msg.CSLoginReq{}, &baselineLoginReq{
+		Version:   "0.0.1",
+		Timestamp: timestamp,
+		LoginKey:  token.GetAuthKey(testToken, timestamp),
+	})
+	var rsp baselineLoginRsp
+	readBaseline(t, conn, &msg.SCLoginRsp{}, &rsp)
+	if rsp.RunId == 0 || rsp.Seed == 0 {
+		t.Fatalf("login rsp %+v, want a seed session", rsp)
+	}
+
+	// the control conn is keyed by the seed from now on
+	cry, err := crypt.NewCrypt(crypt.CryptTypeXor, rsp.Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetCrypt(cry)
+	writeBaseline(t, conn, &msg.CSPingReq{}, &baselinePing{ClientTimestamp: time.Now().UnixNano()})
+	var pong baselinePing
+	readBaseline(t, conn, &msg.SCPingRsp{}, &pong)
+
+	workToken, _ := auth.NewToken(strconv.FormatInt(rsp.Seed, 10))
+	timestamp = time.Now().UnixNano()
+	if !openBaselineWorkConn(t, addr, &baselineWorkConn{
+		RunId:     rsp.RunId,
+		Timestamp: timestamp,
+		LoginKey:  token.GetAuthKey(testToken, timestamp),
+	}) {
+		t.Error("baseline work conn signed with the login token was kept")
+	}
+	if openBaselineWorkConn(t, addr, &baselineWorkConn{
+		RunId:     rsp.RunId,
+		Timestamp: timestamp,
+		LoginKey:  workToken.SetVerifyLogin(timestamp, "", ""),
+	}) {
+		t.Error("baseline work conn was closed")
+	}
+}
+
+func TestDuplicateLoginReject(t *testing.T) {
+	addr := testService(t, v1.AuthMethodHmac, func(c *v1.ServerConfig) {
+		c.Session = &v1.SessionConfig{DuplicateLogin: v1.DuplicateLoginReject}
+	})
+	if rsp := sendLogin(t, testDial(t, addr), "laptop"); rsp.Error != "" {
+		t.Fatalf("first login refused: %s", rsp.Error)
+	}
+	rsp := sendLogin(t, testDial(t, addr), "laptop")
+	if rsp.Error != ErrDuplicateLogin.Error() {
+		t.Fatalf("second login error %q, want %q", rsp.Error, ErrDuplicateLogin)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/msg"
+)
+
+var (
+	ErrDuplicateLogin = errors.New("instance already online")
+	ErrSessionResumed = errors.New("session resumed by a new login")
+)
+
+// instanceKey instance ids are only unique per user
+func instanceKey(user *User, instanceId string) string {
+	if instanceId == "" {
+		return ""
+	}
+	return user.Name() + "/" + instanceId
+}
+
+func (c *Control) resumeTokenMatch(token string) bool {
+	return token != "" &&
+		subtle.ConstantTimeCompare([]byte(c.resumeToken), []byte(token)) == 1
+}
+
+// takeSession hands the session of the same instance over to control and
+// takes its client slot, it must hold cm.mu. The slot is taken before any
+// proxy moves, a refused login leaves the old session as it was. Returns
+// the control whose proxies the caller closes after unlocking, nil when
+// there is none
+func (cm *ControlManager) takeSession(control *Control, resumeToken string) (*Control, error) {
+	key := control.instanceKey
+	if key == "" {
+		return nil, control.user.acquireClient()
+	}
+	if old, ok := cm.parked[key]; ok {
+		// a parked control holds no slot
+		if err := control.user.acquireClient(); err != nil {
+			return nil, err
+		}
+		delete(cm.parked, key)
+		old.parkTimer.Stop()
+		if old.resumeTokenMatch(resumeToken) {
+			control.adoptProxies(old)
+			return nil, nil
+		}
+		return old, nil
+	}
+	live, ok := cm.sessions[key]
+	if !ok {
+		return nil, control.user.acquireClient()
+	}
+	resume := live.resumeTokenMatch(resumeToken)
+	if !resume && config.Server.Session.DuplicateLogin == v1.DuplicateLoginReject {
+		return nil, ErrDuplicateLogin
+	}
+	// the live control hands over its slot, nobody can take it under cm.mu
+	cm.supersede(live)
+	if err := control.user.acquireClient(); err != nil {
+		return nil, err
+	}
+	if resume {
+		control.adoptProxies(live)
+		go live.dispatcher.Close(ErrSessionResumed)
+		return nil, nil
+	}
+	go live.Kick(msg.KickDuplicateLogin, "logged in from "+control.conn.RemoteAddr().String(), 0)
+	return live, nil
+}
+
+// supersede the client slot goes to the new control right away, it must hold cm.mu
+func (cm *ControlManager) supersede(live *Control) {
+	live.noResume.Store(true)
+	live.superseded = true
+	live.user.releaseClient()
+	delete(cm.sessions, live.instanceKey)
+}
+
+// park keeps the proxies of a dropped control for ResumeGrace, false when
+// they should be closed now
+func (cm *ControlManager) park(c *Control) bool {
+	grace := time.Duration(config.Server.Session.ResumeGrace) * time.Second
+	if c.instanceKey == "" || grace <= 0 || c.noResume.Load() {
+		return false
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.closed || cm.sessions[c.instanceKey] != c {
+		return false
+	}
+	delete(cm.sessions, c.instanceKey)
+	cm.parked[c.instanceKey] = c
+	c.parkTimer = time.AfterFunc(grace, func() {
+		cm.expire(c)
+	})
+	slog.Infof("runId:%v session parked for %s", c.runId, grace)
+	return true
+}
+
+func (cm *ControlManager) expire(c *Control) {
+	cm.mu.Lock()
+	if cm.parked[c.instanceKey] != c {
+		cm.mu.Unlock()
+		return
+	}
+	delete(cm.parked, c.instanceKey)
+	cm.mu.Unlock()
+	slog.Infof("runId:%v session not resumed, closing proxies", c.runId)
+	c.closeProxies()
+}
+
+// adoptProxies moves the proxies of the old control of the session to c
+func (c *Control) adoptProxies(old *Control) {
+	old.proxiesMu.Lock()
+	proxies := old.proxies
+	old.proxies = make(map[string]*Proxy)
+	old.proxiesMu.Unlock()
+
+	c.proxiesMu.Lock()
+	defer c.proxiesMu.Unlock()
+	for name, pxy := range proxies {
+		pxy.setControl(c)
+		c.proxies[name] = pxy
+		c.resumedProxies = append(c.resumedProxies, name)
+	}
+	slog.Infof("runId:%v resumed session of runId:%v proxies:%v", c.runId, old.runId, c.resumedProxies)
+}
@@ -0,0 +1,89 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"github.com/gookit/slog"
+
+	"github.com/gucooing/weiwei/pkg/config"
+	"github.com/gucooing/weiwei/pkg/traffic"
+)
+
+func newTrafficStore() (*traffic.Store, error) {
+	tc := config.Server.Traffic
+	store := traffic.NewStore(config.Server.TrafficFile(),
+		time.Duration(tc.HourlyRetention)*24*time.Hour,
+		time.Duration(tc.DailyRetention)*24*time.Hour)
+	if err := store.Load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// trafficLoop samples the proxy counters into the store and writes it out
+func (svr *Service) trafficLoop() {
+	ticker := time.NewTicker(time.Duration(config.Server.Traffic.FlushInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svr.ctx.Done():
+			return
+		case <-ticker.C:
+			svr.accountProxies()
+			if err := svr.traffic.Flush(); err != nil {
+				slog.Errorf("traffic flush err:%v", err)
+			}
+		}
+	}
+}
+
+// accountProxies moves what every proxy counted since the last sample into the store
+func (svr *Service) accountProxies() {
+	for _, ctls := range [][]*Control{svr.controlManager.Controls(), svr.controlManager.Parked()} {
+		for _, c := range ctls {
+			c.proxiesMu.Lock()
+			proxies := make([]*Proxy, 0, len(c.proxies))
+			for _, pxy := range c.proxies {
+				proxies = append(proxies, pxy)
+			}
+			c.proxiesMu.Unlock()
+			for _, pxy := range proxies {
+				pxy.account()
+			}
+		}
+	}
+}
+
+// account adds the counters since the last call to the traffic store
+func (p *Proxy) account() {
+	p.acctMu.Lock()
+	in, out, conns := p.bytesIn.Load(), p.bytesOut.Load(), p.totalConns.Load()
+	usage := traffic.Usage{
+		BytesIn:  in - p.acctUsage.BytesIn,
+		BytesOut: out - p.acctUsage.BytesOut,
+		Conns:    conns - p.acctUsage.Conns,
+	}
+	p.acctUsage = traffic.Usage{BytesIn: in, BytesOut: out, Conns: conns}
+	p.acctMu.Unlock()
+
+	ctl := p.control()
+	ctl.svr.traffic.Add(traffic.Key{
+		User:   ctl.user.Name(),
+		Client: ctl.clientId,
+		Proxy:  p.name,
+	}, usage, time.Now())
+}
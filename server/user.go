@@ -0,0 +1,277 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gucooing/weiwei/pkg/auth"
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+	"github.com/gucooing/weiwei/pkg/msg"
+	"github.com/gucooing/weiwei/pkg/util/limit"
+)
+
+var (
+	ErrUnknownUser          = errors.New("unknown user")
+	ErrUserMaxClients       = errors.New("user max clients exceeded")
+	ErrUserMaxProxies       = errors.New("user max proxies exceeded")
+	ErrProxyTypeNotAllowed  = errors.New("proxy type not allowed")
+	ErrRemotePortNotAllowed = errors.New("remote port not allowed")
+	ErrDomainNotAllowed     = errors.New("domain not allowed")
+)
+
+type UserManager struct {
+	mu    sync.RWMutex
+	users map[string]*User
+	// template of users added for identities without an account, nil refuses them
+	template *v1.User
+}
+
+func NewUserManager(method v1.AuthMethod, users []*v1.User, template *v1.User) (*UserManager, error) {
+	um := &UserManager{
+		users:    make(map[string]*User, len(users)),
+		template: template,
+	}
+	for _, cfg := range users {
+		u := newUser(cfg)
+		// oidc users are verified by the issuer
+		if method != v1.AuthMethodOidc {
+			verifier, err := auth.NewVerifier(method, cfg.Token)
+			if err != nil {
+				return nil, fmt.Errorf("user:%s %w", cfg.Name, err)
+			}
+			u.verifier = verifier
+		}
+		um.users[cfg.Name] = u
+	}
+	return um, nil
+}
+
+func (um *UserManager) GetUser(name string) (*User, bool) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	u, ok := um.users[name]
+	return u, ok
+}
+
+// GetOrAddUser identities without a configured account get one from the
+// template, it is dropped again once the user has no clients and proxies.
+// The caller ends the login with loginDone
+func (um *UserManager) GetOrAddUser(name string) (*User, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	u, ok := um.users[name]
+	if !ok {
+		if um.template == nil {
+			return nil, ErrUnknownUser
+		}
+		cfg := *um.template
+		cfg.Name, cfg.Token = name, ""
+		u = newUser(&cfg)
+		u.um = um
+		um.users[name] = u
+	}
+	if u.um != nil {
+		u.mu.Lock()
+		u.logins++
+		u.mu.Unlock()
+	}
+	return u, nil
+}
+
+// dropIdle removes u if it was added for an identity and nothing uses it
+func (um *UserManager) dropIdle(u *User) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.logins == 0 && u.clients == 0 && u.proxies == 0 && um.users[u.cfg.Name] == u {
+		delete(um.users, u.cfg.Name)
+	}
+}
+
+func newUser(cfg *v1.User) *User {
+	u := &User{
+		cfg: cfg,
+	}
+	if bps, _ := cfg.BandwidthLimit.Bytes(); bps > 0 {
+		u.limitIn = limit.NewLimiter(bps)
+		u.limitOut = limit.NewLimiter(bps)
+	}
+	return u
+}
+
+// User an authenticated weic account, nil is the shared token user without limits
+type User struct {
+	cfg      *v1.User
+	verifier auth.Verifier
+	// limitIn and limitOut shared by every proxy of the user, nil without a limit
+	limitIn  *limit.Limiter
+	limitOut *limit.Limiter
+
+	// um set on users added by GetOrAddUser, they are dropped once idle
+	um *UserManager
+
+	mu      sync.Mutex
+	clients int
+	// proxies registered over all controls of the user, parked ones included
+	proxies int
+	// logins got the user from GetOrAddUser and have not ended yet
+	logins int
+}
+
+func (u *User) Name() string {
+	if u == nil {
+		return ""
+	}
+	return u.cfg.Name
+}
+
+// limiters bytes from and to users over all proxies of the user
+func (u *User) limiters() (in, out *limit.Limiter) {
+	if u == nil {
+		return nil, nil
+	}
+	return u.limitIn, u.limitOut
+}
+
+// allowPorts remote port ranges of the user, empty allows all
+func (u *User) allowPorts() []v1.PortRange {
+	if u == nil {
+		return nil
+	}
+	return u.cfg.AllowPorts
+}
+
+func (u *User) acquireClient() error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.cfg.MaxClients > 0 && u.clients >= u.cfg.MaxClients {
+		return ErrUserMaxClients
+	}
+	u.clients++
+	return nil
+}
+
+func (u *User) releaseClient() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.clients--
+	u.mu.Unlock()
+	if u.um != nil {
+		u.um.dropIdle(u)
+	}
+}
+
+// loginDone ends a login that got u from GetOrAddUser, it holds a client
+// slot by now or failed
+func (u *User) loginDone() {
+	if u == nil || u.um == nil {
+		return
+	}
+	u.mu.Lock()
+	u.logins--
+	u.mu.Unlock()
+	u.um.dropIdle(u)
+}
+
+// acquireProxy counts a proxy against MaxProxies over all clients of the user
+func (u *User) acquireProxy() error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.cfg.MaxProxies > 0 && u.proxies >= u.cfg.MaxProxies {
+		return ErrUserMaxProxies
+	}
+	u.proxies++
+	return nil
+}
+
+func (u *User) releaseProxy() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.proxies--
+	u.mu.Unlock()
+	if u.um != nil {
+		u.um.dropIdle(u)
+	}
+}
+
+// CheckProxy proxy types, remote ports and domains the user may register
+func (u *User) CheckProxy(req *msg.CSNewProxyReq) error {
+	if u == nil {
+		return nil
+	}
+	if len(u.cfg.AllowProxyTypes) > 0 {
+		allow := false
+		for _, t := range u.cfg.AllowProxyTypes {
+			if string(t) == req.ProxyType {
+				allow = true
+				break
+			}
+		}
+		if !allow {
+			return ErrProxyTypeNotAllowed
+		}
+	}
+	if len(u.cfg.AllowPorts) > 0 && req.RemotePort != 0 {
+		allow := false
+		for _, r := range u.cfg.AllowPorts {
+			if r.Contains(req.RemotePort) {
+				allow = true
+				break
+			}
+		}
+		if !allow {
+			return ErrRemotePortNotAllowed
+		}
+	}
+	if len(u.cfg.AllowDomains) > 0 {
+		for _, domain := range req.CustomDomains {
+			if !matchDomains(u.cfg.AllowDomains, domain) {
+				return ErrDomainNotAllowed
+			}
+		}
+	}
+	return nil
+}
+
+// matchDomains supports exact names and "*.example.com" wildcards
+func matchDomains(patterns []string, domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == domain {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(p, "*"); ok &&
+			strings.HasSuffix(domain, suffix) && len(domain) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+// Copyright 2025 gucooing, gucooing@alsl.xyz
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"testing"
+
+	v1 "github.com/gucooing/weiwei/pkg/config/v1"
+)
+
+func TestGetOrAddUser(t *testing.T) {
+	um, err := NewUserManager(v1.AuthMethodOidc, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.GetOrAddUser("alice"); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("identity without a template err:%v", err)
+	}
+
+	um, err = NewUserManager(v1.AuthMethodOidc, nil, &v1.User{
+		Name:            "defaultUser",
+		Token:           "secret",
+		MaxProxies:      1,
+		AllowProxyTypes: []v1.ProxyType{v1.ProxyTypeTcp},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := um.GetOrAddUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name() != "alice" || u.cfg.Token != "" || u.cfg.MaxProxies != 1 {
+		t.Fatalf("user from template %+v", u.cfg)
+	}
+	if err := u.acquireProxy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.acquireProxy(); !errors.Is(err, ErrUserMaxProxies) {
+		t.Fatalf("second proxy err:%v", err)
+	}
+
+	// the login holds the user until it has a client slot
+	if err := u.acquireClient(); err != nil {
+		t.Fatal(err)
+	}
+	u.loginDone()
+	u.releaseProxy()
+	if _, ok := um.GetUser("alice"); !ok {
+		t.Fatal("user with a client dropped")
+	}
+	u.releaseClient()
+	if _, ok := um.GetUser("alice"); ok {
+		t.Fatal("idle user kept")
+	}
+	// a failed login drops it too
+	if _, err := um.GetOrAddUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	bob, _ := um.GetUser("bob")
+	bob.loginDone()
+	if _, ok := um.GetUser("bob"); ok {
+		t.Fatal("user of a failed login kept")
+	}
+}